@@ -1,20 +1,25 @@
 package main
 
 import (
+	gocontext "context"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/dop251/goja"
 	"github.com/tinylib/msgp/msgp"
+	"github.com/tyler-smith/go-bip32"
 
 	"github.com/smartbch/egvm/egvm-script/context"
 	"github.com/smartbch/egvm/egvm-script/request"
 	"github.com/smartbch/egvm/egvm-script/types"
+	"github.com/smartbch/egvm/keygrantor"
 )
 
 var maxMemSize uint64 = 1024 * 1024 * 1024   // 1G
@@ -25,22 +30,152 @@ func main() {
 	var singleMode bool
 	var perpetualMode bool
 	var keygrantorUrl string
+	var counter string
+	var attestReceipts bool
+	var keyProvider string
+	var devSeed string
+	var keyFile string
+	var keyMode string
+	var keyMinSVN uint
+	var keygrantorSignerID string
+	var keygrantorUniqueID string
+	var thresholdXpub string
+	var threshold int
+	var migrateFrom string
+	var plainHTTP bool
 	flag.Int64Var(&timeLimitInLoopMode, "t", defaultRunTimeLimitInLoopMode, "enable loop mode: specific run time limit in second")
 	flag.BoolVar(&singleMode, "s", false, "enable single mode: accept one input and return one output, then process exit")
 	flag.BoolVar(&perpetualMode, "p", false, "enable perpetual mode: not clear the state after script run, accept continuous input")
-	flag.StringVar(&keygrantorUrl, "k", "http://127.0.0.1:8084", "keygrantor url")
+	flag.StringVar(&keygrantorUrl, "k", "https://127.0.0.1:8084", "keygrantor url")
+	flag.StringVar(&counter, "counter", "", "monotonic counter against state rollback: empty to disable, 'keygrantor' or a local file path "+
+		"(keygrantor keeps the counters in a file which its own host can roll back, so run it on another host)")
+	flag.BoolVar(&attestReceipts, "attest", false, "embed an attestation report of the signing key in receipts")
+	flag.StringVar(&keyProvider, "keyprovider", defaultKeyProvider(), "where root keys come from: keygrantor, threshold, devseed, sealedfile or random (devseed and random only in debug enclaves)")
+	flag.StringVar(&devSeed, "devseed", "egvm dev seed", "seed of the devseed key provider, for dev and test only")
+	flag.StringVar(&keyFile, "keyfile", "/data/key.txt", "sealed master key file of the sealedfile key provider")
+	flag.StringVar(&keyMode, "keymode", keygrantor.KeyModeUnique, "how keygrantor binds the keys: 'unique' to the UniqueID, 'signer' to the SignerID and ProductID")
+	flag.UintVar(&keyMinSVN, "keyminsvn", 0, "in the signer key mode, the minimum SecurityVersion of the enclaves which can get the keys")
+	flag.StringVar(&keygrantorSignerID, "ksigner", "", "the expected SignerID of keygrantor in hex, required in SGX to use keygrantor")
+	flag.StringVar(&keygrantorUniqueID, "kunique", "", "the expected UniqueID of keygrantor in hex, not checked if empty")
+	flag.StringVar(&thresholdXpub, "kxpub", "", "in the threshold mode, the xpub of the keygrantors' master key")
+	flag.IntVar(&threshold, "kthreshold", 0, "in the threshold mode, the number of keygrantors whose shares make a key")
+	flag.StringVar(&migrateFrom, "kmigratefrom", "", "the UniqueID in hex of an old egvmscript, whose keys are migrated from keygrantor")
+	flag.BoolVar(&plainHTTP, "kplainhttp", false, "allow 'http://' keygrantor urls without attesting the connection, for dev and test only")
 	flag.Parse()
 	setRlimit(maxMemSize)
+	context.SetReceiptAttestation(attestReceipts)
+	keygrantor.AllowPlainHTTP = plainHTTP
+	if keyProvider == "keygrantor" || keyProvider == "threshold" || counter == "keygrantor" {
+		checkKeyGrantorSigner(keygrantorSignerID)
+	}
+	kgClient := newKeyGrantorClient(keygrantorUrl, keygrantorSignerID, keygrantorUniqueID)
+	initKeyProvider(keyProvider, kgClient, devSeed, keyFile, keyMode, keyMinSVN, thresholdXpub, threshold, migrateFrom)
+	initStateCounter(counter, kgClient, keyMode, keyMinSVN)
 	if perpetualMode {
-		executeLambdaJob(false, true, 0, keygrantorUrl)
+		executeLambdaJob(false, true, 0)
 	} else if singleMode {
-		executeLambdaJob(true, false, 0, keygrantorUrl)
+		executeLambdaJob(true, false, 0)
 	} else { // loop mode
-		executeLambdaJob(false, false, timeLimitInLoopMode, keygrantorUrl)
+		executeLambdaJob(false, false, timeLimitInLoopMode)
+	}
+}
+
+// use local rand key to replace keygrantor for dev and test on darwin
+func defaultKeyProvider() string {
+	if runtime.GOOS == "darwin" {
+		return "random"
 	}
+	return "keygrantor"
 }
 
-func executeLambdaJob(isSingleMode bool, isPerpetualMode bool, timeLimit int64, keygrantorUrl string) {
+// The client of the keygrantor at '-k', which is attested against the expected identity, also
+// before its TLS certificate is trusted
+func newKeyGrantorClient(keygrantorUrl, signerID, uniqueID string) *keygrantor.KeyGrantorClient {
+	signerIDBz, err := hex.DecodeString(signerID)
+	if err != nil {
+		panic("invalid keygrantor SignerID: " + signerID)
+	}
+	uniqueIDBz, err := hex.DecodeString(uniqueID)
+	if err != nil {
+		panic("invalid keygrantor UniqueID: " + uniqueID)
+	}
+	return keygrantor.NewKeyGrantorClient(keygrantorUrl, signerIDBz, uniqueIDBz)
+}
+
+// Without the expected SignerID, any enclave, even one signed by the host, could pose as keygrantor,
+// so it is required in SGX
+func checkKeyGrantorSigner(signerID string) {
+	if runtime.GOOS == "darwin" {
+		return
+	}
+	if signerID == "" {
+		panic("-ksigner is required to attest keygrantor")
+	}
+}
+
+func initKeyProvider(keyProvider string, kgClient *keygrantor.KeyGrantorClient, devSeed, keyFile, keyMode string, keyMinSVN uint,
+	thresholdXpub string, threshold int, migrateFrom string) {
+	keygrantorUrl := kgClient.Url
+	switch keyProvider {
+	case "keygrantor":
+		p := &context.KeyGrantorKeyProvider{Client: kgClient}
+		p.Mode, p.MinSVN = keyMode, keyMinSVN
+		if migrateFrom != "" {
+			var err error
+			p.MigrateFrom, err = hex.DecodeString(migrateFrom)
+			if err != nil || keyMode == keygrantor.KeyModeSigner {
+				panic("invalid UniqueID to migrate from: " + migrateFrom)
+			}
+		}
+		context.SetKeyProvider(p)
+	case "threshold":
+		// '-k' has the comma-separated urls of the keygrantors in the threshold mode, which are
+		// attested against '-kxpub' and the identity of '-ksigner' and '-kunique'
+		xpub, err := bip32.B58Deserialize(thresholdXpub)
+		if err != nil {
+			panic("invalid threshold xpub: " + thresholdXpub)
+		}
+		if threshold < 1 {
+			panic("threshold must be positive")
+		}
+		client := keygrantor.NewThresholdClient(strings.Split(keygrantorUrl, ","), xpub, threshold, kgClient.SignerID, kgClient.UniqueID)
+		p := context.NewThresholdKeyProvider(client)
+		p.Mode, p.MinSVN = keyMode, keyMinSVN
+		context.SetKeyProvider(p)
+	case "devseed":
+		checkDevKeyProvider(keyProvider)
+		p, err := context.NewDevSeedKeyProvider(devSeed)
+		if err != nil {
+			panic(err)
+		}
+		context.SetKeyProvider(p)
+	case "sealedfile":
+		context.SetKeyProvider(context.NewSealedFileKeyProvider(keyFile))
+	case "random":
+		checkDevKeyProvider(keyProvider)
+		context.SetKeyProvider(context.RandomKeyProvider{})
+	default:
+		panic("unknown key provider: " + keyProvider)
+	}
+}
+
+// The keys of devseed are known to anyone, and those of random are made up, so a production enclave
+// must not sign receipts or seal states with them. They are only allowed in debug enclaves and the
+// builds without SGX.
+func checkDevKeyProvider(keyProvider string) {
+	if runtime.GOOS == "darwin" {
+		return
+	}
+	selfReport, err := keygrantor.DefaultAttester.SelfReport()
+	if err != nil {
+		panic(err)
+	}
+	if !selfReport.Debug {
+		panic("key provider " + keyProvider + " is only for debug enclaves")
+	}
+}
+
+func executeLambdaJob(isSingleMode bool, isPerpetualMode bool, timeLimit int64) {
 	context.EGVMCtx = new(context.EGVMContext)
 	var isFirstRun = true
 	vm := goja.New()
@@ -52,8 +187,8 @@ func executeLambdaJob(isSingleMode bool, isPerpetualMode bool, timeLimit int64,
 		if err != nil {
 			e = err.Error()
 		}
-		if (isPerpetualMode && isFirstRun) || isSingleMode || timeLimit != 0 {
-			err = context.SetContext(&job, keygrantorUrl)
+		if e == "" && ((isPerpetualMode && isFirstRun) || isSingleMode || timeLimit != 0) {
+			err = context.SetContext(&job)
 			if err != nil {
 				e = err.Error()
 			}
@@ -61,6 +196,10 @@ func executeLambdaJob(isSingleMode bool, isPerpetualMode bool, timeLimit int64,
 			if err != nil {
 				e = err.Error()
 			}
+			err = request.InitNetPolicy(job.NetPolicy)
+			if err != nil {
+				e = err.Error()
+			}
 		}
 		if isPerpetualMode && scriptForPerpetualMode == "" {
 			scriptForPerpetualMode = job.Script
@@ -70,9 +209,12 @@ func executeLambdaJob(isSingleMode bool, isPerpetualMode bool, timeLimit int64,
 			script = scriptForPerpetualMode
 			context.SetContextInputs(job.Inputs)
 		}
-		_, err = run(vm, script, timeLimit)
-		if err != nil {
-			e = err.Error()
+		// never run a script against a tampered or stale state
+		if e == "" {
+			_, err = run(vm, script, timeLimit)
+			if err != nil {
+				e = err.Error()
+			}
 		}
 		res := context.CollectResult(e)
 		bz, _ := res.MarshalMsg(nil)
@@ -92,14 +234,42 @@ func executeLambdaJob(isSingleMode bool, isPerpetualMode bool, timeLimit int64,
 	}
 }
 
+func initStateCounter(counter string, kgClient *keygrantor.KeyGrantorClient, keyMode string, keyMinSVN uint) {
+	if counter == "" {
+		return
+	}
+	if counter != "keygrantor" { // local stand-in for dev and test
+		fc, err := keygrantor.NewFileCounter(counter, nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		context.SetStateCounter(fc)
+		return
+	}
+	xpub, _, err := kgClient.AttestedXpub(keygrantor.LatestEpoch)
+	if err != nil {
+		panic(err)
+	}
+	// keygrantor scopes the counters to this enclave as it binds the keys, so they survive the same upgrades
+	hc := keygrantor.NewHttpCounter(kgClient.Url, xpub)
+	hc.Mode, hc.MinSVN = keyMode, keyMinSVN
+	hc.ReportCheck = kgClient.CheckIdentity
+	context.SetStateCounter(hc)
+}
+
 func run(vm *goja.Runtime, script string, timeLimit int64) (goja.Value, error) {
 	registerFunctions(vm)
+	// vm.Interrupt cannot stop a pending HttpsRequest, but canceling its context can
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	request.SetScriptContext(ctx)
 	if timeLimit != 0 {
 		var closeChan = make(chan bool)
 		defer close(closeChan)
 		go func() {
 			select {
 			case <-time.After(time.Duration(timeLimit) * time.Second):
+				cancel()
 				vm.Interrupt(errors.New("execution time exceed"))
 			case <-closeChan:
 				vm.ClearInterrupt()
@@ -72,6 +72,7 @@ func registerFunctions(vm *goja.Runtime) {
 	vm.Set("U64ToBufLE", extension.U64ToBufLE)
 	vm.Set("U32ToBufBE", extension.U32ToBufBE)
 	vm.Set("U32ToBufLE", extension.U32ToBufLE)
+	vm.Set("UseUint8Array", extension.UseUint8Array)
 
 	// signature
 	vm.Set("GetEthSignedMessage", extension.GetEthSignedMessage)
@@ -1,18 +1,17 @@
 package context
 
 import (
-	"crypto/sha256"
-	"reflect"
-	"runtime"
 	"sort"
+	"strconv"
 
 	"github.com/dop251/goja"
-	"github.com/edgelesssys/ego/enclave"
 	gethcrypto "github.com/ethereum/go-ethereum/crypto"
 	"github.com/tyler-smith/go-bip32"
 
 	"github.com/smartbch/egvm/egvm-script/extension"
+	"github.com/smartbch/egvm/egvm-script/request"
 	"github.com/smartbch/egvm/egvm-script/types"
+	"github.com/smartbch/egvm/egvm-script/utils"
 	"github.com/smartbch/egvm/keygrantor"
 )
 
@@ -23,46 +22,123 @@ type EGVMContext struct {
 	outputBufLists [][]byte
 	certs          []string
 	privKey        extension.Bip32Key
+	store          *types.Store // loaded from state on the first call of Store()
+	scriptHash     [32]byte
+	stateKey       []byte // nil means the state is not sealed
+	stateVersion   uint64
+	stateOpened    bool       // the job's state is opened, so the result can have a new state
+	rootKey        *bip32.Key // given to the script
+	receiptKey     *bip32.Key // signs the receipts, out of the script's reach, nil means no receipt
+	keyIdentity    []byte
+	keyEpoch       int64                // epoch of rootKey
+	epochRootKeys  map[int64]*bip32.Key // root keys of the other epochs got by the script
+	jobConfig      string               // config in the job, which SetConfig does not change
+	prevState      []byte               // state in the job as it was received
+	receiptReport  []byte
 }
 
-var EGVMCtx *EGVMContext
+var (
+	EGVMCtx *EGVMContext
 
-func SetContext(job *types.LambdaJob, keygrantorUrl string) error {
+	keyProvider KeyProvider = RandomKeyProvider{}
+)
+
+func SetKeyProvider(p KeyProvider) {
+	keyProvider = p
+}
+
+func SetContext(job *types.LambdaJob) error {
 	EGVMCtx.config = job.Config
 	EGVMCtx.inputBufLists = job.Inputs
-	EGVMCtx.state = job.State
 	EGVMCtx.certs = job.Certs
 	sort.Strings(EGVMCtx.certs)
+	EGVMCtx.scriptHash = types.ScriptHash(job.Script)
+	EGVMCtx.jobConfig = job.Config
+	EGVMCtx.prevState = job.State
 
-	// use local rand key to replace keygrantor for dev and test on darwin
-	if runtime.GOOS == "darwin" {
-		seed, err := bip32.NewSeed()
-		if err != nil {
-			return err
-		}
-		privKey, err := bip32.NewMasterKey(seed)
+	EGVMCtx.keyIdentity = KeyIdentity(EGVMCtx.scriptHash, job.KeySalt)
+	EGVMCtx.epochRootKeys = nil
+	privKey, epoch, err := keyProvider.RootKey(EGVMCtx.keyIdentity, keygrantor.LatestEpoch)
+	if err != nil {
+		return err
+	}
+	EGVMCtx.privKey = extension.NewBip32Key(privKey)
+	EGVMCtx.rootKey = privKey
+	EGVMCtx.keyEpoch = epoch
+	EGVMCtx.receiptKey, _, err = keyProvider.RootKey(ReceiptIdentity(EGVMCtx.scriptHash, job.KeySalt), keygrantor.LatestEpoch)
+	if err != nil {
+		return err
+	}
+	EGVMCtx.receiptReport = nil
+	EGVMCtx.stateKey = DeriveStateKey(privKey, EGVMCtx.scriptHash)
+	return EGVMCtx.openState(job.State)
+}
+
+// rootKeyAt returns the root key of an epoch, which may be older than the latest one
+func (e *EGVMContext) rootKeyAt(epoch int64) (*bip32.Key, error) {
+	if epoch == keygrantor.LatestEpoch || epoch == e.keyEpoch {
+		return e.rootKey, nil
+	}
+	if key, ok := e.epochRootKeys[epoch]; ok {
+		return key, nil
+	}
+	key, _, err := keyProvider.RootKey(e.keyIdentity, epoch)
+	if err != nil {
+		return nil, err
+	}
+	if e.epochRootKeys == nil {
+		e.epochRootKeys = make(map[int64]*bip32.Key)
+	}
+	e.epochRootKeys[epoch] = key
+	return key, nil
+}
+
+// openState decrypts the sealed state and rejects it if it is tampered or stale. A state sealed
+// in an older key epoch is opened with that epoch's key, and sealed again in the latest epoch.
+func (e *EGVMContext) openState(sealed []byte) error {
+	e.state, e.stateVersion, e.stateOpened = nil, 0, false
+	if len(sealed) != 0 {
+		epoch, err := SealedStateEpoch(sealed)
 		if err != nil {
 			return err
 		}
-		EGVMCtx.privKey = extension.NewBip32Key(privKey)
-	} else {
-		bz, err := job.MarshalMsg(nil)
-		if err != nil {
-			return nil
+		key := e.stateKey
+		if epoch != e.keyEpoch {
+			rootKey, err := e.rootKeyAt(epoch)
+			if err != nil {
+				return err
+			}
+			key = DeriveStateKey(rootKey, e.scriptHash)
 		}
-		selfR, err := enclave.GetSelfReport()
+		state, version, err := OpenState(key, e.scriptHash, sealed)
 		if err != nil {
 			return err
 		}
-		uniqueID := selfR.UniqueID
-		jobAndSandboxHash := sha256.Sum256(append(bz, uniqueID...))
-		privKey, err := keygrantor.GetKeyFromKeyGrantor(keygrantorUrl, jobAndSandboxHash)
+		e.state, e.stateVersion = state, version
+	}
+	if err := checkStateVersion(StateCounterKey(e.keyIdentity), e.stateVersion); err != nil {
+		return err
+	}
+	e.stateOpened = true
+	return nil
+}
+
+// sealState encrypts the state with the next version
+func (e *EGVMContext) sealState() ([]byte, error) {
+	version := e.stateVersion + 1
+	if stateCounter != nil {
+		var err error
+		version, err = stateCounter.Increase(StateCounterKey(e.keyIdentity), e.stateVersion)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		EGVMCtx.privKey = extension.NewBip32Key(privKey)
 	}
-	return nil
+	sealed, err := SealState(e.stateKey, e.scriptHash, e.keyEpoch, version, e.state)
+	if err != nil {
+		return nil, err
+	}
+	e.stateVersion = version
+	return sealed, checkStateVersion(StateCounterKey(e.keyIdentity), version)
 }
 
 func SetContextInputs(inputs [][]byte) {
@@ -74,13 +150,54 @@ func ResetContext() {
 	EGVMCtx.inputBufLists = nil
 	EGVMCtx.outputBufLists = nil
 	EGVMCtx.state = nil
+	EGVMCtx.store = nil
+	EGVMCtx.stateKey = nil
+	EGVMCtx.stateVersion = 0
+	EGVMCtx.stateOpened = false
+	EGVMCtx.rootKey = nil
+	EGVMCtx.receiptKey = nil
+	EGVMCtx.keyIdentity = nil
+	EGVMCtx.keyEpoch = 0
+	EGVMCtx.epochRootKeys = nil
+	EGVMCtx.prevState = nil
+	EGVMCtx.receiptReport = nil
+	request.CloseTransport()
 }
 
 func CollectResult(err string) *types.LambdaResult {
+	// the store, once used, replaces the state set by SetState
+	if EGVMCtx.store != nil {
+		EGVMCtx.state = EGVMCtx.store.Serialize()
+	}
+	var state []byte
+	switch {
+	case !EGVMCtx.stateOpened:
+		// the job's state is not opened, so a new state would overwrite it without reading it
+	case EGVMCtx.stateKey == nil:
+		state = EGVMCtx.state
+	default:
+		sealed, sealErr := EGVMCtx.sealState()
+		if sealErr != nil && err == "" {
+			err = "failed to seal state: " + sealErr.Error()
+		}
+		state = sealed
+	}
+	// a failed run has no receipt, which would endorse its partial outputs
+	var receipt *types.Receipt
+	if EGVMCtx.receiptKey != nil && err == "" {
+		var receiptErr error
+		receipt, receiptErr = EGVMCtx.signReceipt(state)
+		if receiptErr != nil && err == "" {
+			err = "failed to sign receipt: " + receiptErr.Error()
+		}
+	}
+	// in perpetual mode, the next run starts from this state
+	EGVMCtx.prevState = state
 	return &types.LambdaResult{
 		Outputs: EGVMCtx.outputBufLists,
-		State:   EGVMCtx.state,
+		State:   state,
 		Error:   err,
+		Receipt: receipt,
 	}
 }
 
@@ -99,9 +216,9 @@ func (e *EGVMContext) SetConfig(cfg string) {
 }
 
 func (e *EGVMContext) GetCerts(_ goja.FunctionCall, vm *goja.Runtime) goja.Value {
-	results := make([]goja.ArrayBuffer, 0, len(e.certs))
+	results := make([]goja.Value, 0, len(e.certs))
 	for _, c := range e.certs {
-		results = append(results, vm.NewArrayBuffer([]byte(c)))
+		results = append(results, utils.NewBuffer(vm, []byte(c)))
 	}
 	return vm.ToValue(results)
 }
@@ -113,49 +230,96 @@ func (e *EGVMContext) GetCertsHash(_ goja.FunctionCall, vm *goja.Runtime) goja.V
 	}
 
 	certsHashBz := gethcrypto.Keccak256(certsBzArray...)
-	return vm.ToValue(vm.NewArrayBuffer(certsHashBz))
+	return utils.NewBuffer(vm, certsHashBz)
 }
 
 func (e *EGVMContext) GetState(_ goja.FunctionCall, vm *goja.Runtime) goja.Value {
-	return vm.ToValue(vm.NewArrayBuffer(e.state))
+	return utils.NewBuffer(vm, e.state)
 }
 
 func (e *EGVMContext) SetState(s goja.Value, vm *goja.Runtime) {
-	switch s.Export().(type) {
-	case goja.ArrayBuffer:
-		e.state = s.Export().(goja.ArrayBuffer).Bytes()
-	default:
+	bz, ok := utils.GetBytes(s)
+	if !ok {
 		panic(vm.ToValue("param should be arraybuffer"))
 	}
+	e.state = append([]byte{}, bz...)
 }
 
+// Store returns the persistent key-value store, which is loaded from the job's state and
+// serialized into the result's state automatically
+func (e *EGVMContext) Store(_ goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	if e.store == nil {
+		store, err := types.LoadStore(e.state)
+		if err != nil {
+			panic(goja.NewSymbol("Error in loading store: " + err.Error()))
+		}
+		e.store = store
+	}
+	return vm.ToValue(e.store)
+}
+
+// GetInputs returns copies of the inputs, so the script cannot change the ones in the receipt
 func (e *EGVMContext) GetInputs(_ goja.FunctionCall, vm *goja.Runtime) goja.Value {
-	var res []goja.ArrayBuffer
+	var res []goja.Value
 	for _, input := range e.inputBufLists {
-		res = append(res, vm.NewArrayBuffer(input))
+		res = append(res, utils.NewBuffer(vm, append([]byte{}, input...)))
 	}
 	return vm.ToValue(res)
 }
 
 func (e *EGVMContext) SetOutputs(s goja.Value, vm *goja.Runtime) {
-	switch t := s.Export().(type) {
-	case []interface{}:
-		outputBufLists := s.Export().([]interface{})
-		for _, output := range outputBufLists {
-			switch output.(type) {
-			case goja.ArrayBuffer:
-				e.outputBufLists = append(e.outputBufLists, output.(goja.ArrayBuffer).Bytes())
-			default:
-				panic(vm.ToValue("param not arraybuffer type"))
-			}
+	if bz, ok := utils.GetBytes(s); ok {
+		e.outputBufLists = append(e.outputBufLists, append([]byte{}, bz...))
+		return
+	}
+	obj, ok := s.(*goja.Object)
+	if !ok || obj.ClassName() != "Array" {
+		panic(vm.ToValue("param not array type or arraybuffer, its:" + s.String()))
+	}
+	length := obj.Get("length").ToInteger()
+	for i := int64(0); i < length; i++ {
+		bz, ok := utils.GetBytes(obj.Get(strconv.FormatInt(i, 10)))
+		if !ok {
+			panic(vm.ToValue("param not arraybuffer type"))
 		}
-	case goja.ArrayBuffer:
-		e.outputBufLists = append(e.outputBufLists, s.Export().(goja.ArrayBuffer).Bytes())
-	default:
-		panic(vm.ToValue("param not array type or arraybuffer, its:" + reflect.TypeOf(t).String()))
+		e.outputBufLists = append(e.outputBufLists, append([]byte{}, bz...))
 	}
 }
 
 func (e *EGVMContext) GetRootKey(_ goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	return vm.ToValue(e.privKey)
 }
+
+// arguments: name string, epoch int (optional)
+// GetKey returns a key derived from the root key by name, so a script can use different keys
+// for different purposes. The same script and KeySalt always get the same key for a name.
+// The key is of the latest epoch, unless an older epoch is given, e.g. to decrypt old data.
+func (e *EGVMContext) GetKey(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	if len(f.Arguments) != 1 && len(f.Arguments) != 2 {
+		panic(utils.IncorrectArgumentCount)
+	}
+	name, ok := f.Arguments[0].Export().(string)
+	if !ok || len(name) == 0 {
+		panic(goja.NewSymbol("The first argument must be non-empty string"))
+	}
+	epoch := int64(keygrantor.LatestEpoch)
+	if len(f.Arguments) == 2 {
+		epoch, ok = f.Arguments[1].Export().(int64)
+		if !ok || epoch < 0 {
+			panic(goja.NewSymbol("The second argument must be non-negative integer"))
+		}
+	}
+	if e.rootKey == nil {
+		panic(goja.NewSymbol("No root key in context"))
+	}
+	rootKey, err := e.rootKeyAt(epoch)
+	if err != nil {
+		panic(goja.NewSymbol("Error in getting root key: " + err.Error()))
+	}
+	return vm.ToValue(extension.NewBip32Key(DeriveNamedKey(rootKey, name)))
+}
+
+// GetKeyEpoch returns the epoch of the root key, which is the latest one when the job started
+func (e *EGVMContext) GetKeyEpoch() int64 {
+	return e.keyEpoch
+}
@@ -1,4 +1,5 @@
 import {Bip32Key} from "../extension/bip32key";
+import {Store} from "../types/store";
 
 export interface EGVMContext {
     readonly GetConfig: () => string;
@@ -6,10 +7,13 @@ export interface EGVMContext {
     readonly GetCerts: () => Array<ArrayBuffer>;
     readonly GetCertsHash: () => ArrayBuffer;
     readonly GetState: () => ArrayBuffer;
-    readonly SetState: (s: ArrayBuffer) => void;
+    readonly SetState: (s: ArrayBuffer | ArrayBufferView) => void;
+    readonly Store: () => Store;
     readonly GetInputs: () => Array<ArrayBuffer>;
-    readonly SetOutputs: (outputs: any[] | ArrayBuffer) => void;
+    readonly SetOutputs: (outputs: Array<ArrayBuffer | ArrayBufferView> | ArrayBuffer | ArrayBufferView) => void;
     readonly GetRootKey: () => Bip32Key;
+    readonly GetKey: (name: string, epoch?: number) => Bip32Key;
+    readonly GetKeyEpoch: () => number;
 }
 
 export declare const GetEGVMContext: () => EGVMContext;
@@ -125,6 +125,24 @@ func TestEGVMContextOutputsW(t *testing.T) {
 	require.Equal(t, 3, len(EGVMCtx.outputBufLists[2]))
 }
 
+func TestEGVMContextTypedArrayOutputsAndState(t *testing.T) {
+	vm := goja.New()
+	EGVMCtx = &EGVMContext{}
+	vm.Set("GetEGVMContext", GetEGVMContext)
+
+	_, err := vm.RunString(`
+	let EGVMCtx = GetEGVMContext()
+	let bz = new Uint8Array([1, 2, 3, 4, 5])
+	EGVMCtx.SetOutputs([bz.subarray(1, 3), new DataView(bz.buffer, 3)])
+	EGVMCtx.SetOutputs(bz.subarray(4))
+	EGVMCtx.SetState(bz.subarray(0, 2))
+	bz[0] = 9
+`)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{{2, 3}, {4, 5}, {5}}, EGVMCtx.outputBufLists)
+	require.Equal(t, []byte{1, 2}, EGVMCtx.state)
+}
+
 func TestEGVMContextCertsR(t *testing.T) {
 	vm := goja.New()
 	EGVMCtx = &EGVMContext{certs: []string{
@@ -137,17 +155,19 @@ func TestEGVMContextCertsR(t *testing.T) {
 	_, err := vm.RunString(`
 	let EGVMCtx = GetEGVMContext()
 	let certs = EGVMCtx.GetCerts()
+	let l = certs.length
+	let first = String.fromCharCode(...new Uint8Array(certs[0]))
 `)
 	require.Nil(t, err)
-	certs := vm.Get("certs").Export().([]string)
-	require.Equal(t, 2, len(certs))
-	require.Equal(t, "abc", certs[0])
+	require.Equal(t, int64(2), vm.Get("l").Export().(int64))
+	require.Equal(t, "abc", vm.Get("first").Export().(string))
 }
 
 func TestEGVMContextRootKeyR(t *testing.T) {
 	vm := goja.New()
 	EGVMCtx = &EGVMContext{}
-	SetContext(&types.LambdaJob{}, "")
+	useDevSeedKeyProvider(t)
+	require.NoError(t, SetContext(&types.LambdaJob{Script: "root key"}))
 	rootS := EGVMCtx.privKey.B58Serialize()
 	vm.Set("GetEGVMContext", GetEGVMContext)
 	vm.Set("NewOrderedMapReader", types.NewOrderedMapReader)
@@ -162,3 +182,25 @@ func TestEGVMContextRootKeyR(t *testing.T) {
 	out := vm.Get("out").Export().(string)
 	require.Equal(t, rootS, out)
 }
+
+func TestEGVMContextStore(t *testing.T) {
+	vm := goja.New()
+	EGVMCtx = &EGVMContext{}
+	require.NoError(t, EGVMCtx.openState(nil))
+	vm.Set("GetEGVMContext", GetEGVMContext)
+
+	_, err := vm.RunString(`
+	let EGVMCtx = GetEGVMContext()
+	EGVMCtx.Store().IntMap('counter').Set('n', 1)
+`)
+	require.NoError(t, err)
+	res := CollectResult("")
+
+	ResetContext()
+	EGVMCtx.state = res.State
+	_, err = vm.RunString(`
+	const [n] = GetEGVMContext().Store().IntMap('counter').Get('n')
+`)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, vm.Get("n").Export())
+}
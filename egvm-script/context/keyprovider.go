@@ -0,0 +1,188 @@
+package context
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strconv"
+
+	"github.com/tyler-smith/go-bip32"
+
+	"github.com/smartbch/egvm/keygrantor"
+)
+
+var (
+	ErrMigrationMode = errors.New("keys can only be migrated in the unique key mode")
+)
+
+// KeyProvider gives the root key of a job from the bytes identifying the job
+type KeyProvider interface {
+	// RootKey returns the root key of an epoch, or of the latest epoch if epoch is
+	// keygrantor.LatestEpoch, together with the epoch of the returned key
+	RootKey(identity []byte, epoch int64) (*bip32.Key, int64, error)
+}
+
+var (
+	_ KeyProvider = (*KeyGrantorKeyProvider)(nil)
+	_ KeyProvider = (*ThresholdKeyProvider)(nil)
+	_ KeyProvider = (*DevSeedKeyProvider)(nil)
+	_ KeyProvider = (*SealedFileKeyProvider)(nil)
+	_ KeyProvider = RandomKeyProvider{}
+)
+
+// KeyGrantorKeyProvider gets keys from keygrantor, which binds them to this enclave's UniqueID, or
+// to its SignerID and ProductID in keygrantor.KeyModeSigner, such that upgrades get the same keys.
+// The keys are checked against keygrantor's attested xpub.
+type KeyGrantorKeyProvider struct {
+	Client *keygrantor.KeyGrantorClient
+	Mode   string
+	MinSVN uint
+	// the UniqueID of an old egvmscript, whose keys are migrated through '/migratekey' instead, only
+	// in keygrantor.KeyModeUnique
+	MigrateFrom []byte
+}
+
+func NewKeyGrantorKeyProvider(keygrantorUrl string) *KeyGrantorKeyProvider {
+	return &KeyGrantorKeyProvider{Client: keygrantor.NewKeyGrantorClient(keygrantorUrl, nil, nil)}
+}
+
+func (p *KeyGrantorKeyProvider) RootKey(identity []byte, epoch int64) (*bip32.Key, int64, error) {
+	if len(p.MigrateFrom) != 0 {
+		if p.Mode == keygrantor.KeyModeSigner {
+			return nil, 0, ErrMigrationMode
+		}
+		// the old version hashed its own UniqueID into the client data, which is known to this one
+		return p.Client.MigrateKey(p.MigrateFrom, jobAndSandboxHash(identity, p.MigrateFrom), epoch)
+	}
+	clientData, err := keyClientData(identity, p.Mode)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := keygrantor.KeyOptions{Epoch: epoch, Mode: p.Mode, MinSVN: p.MinSVN}
+	return p.Client.GetKey(clientData, opts)
+}
+
+// The client data sent to keygrantor. In the signer mode it must not contain the UniqueID of the
+// sandbox, otherwise the keys would still change with upgrades.
+func keyClientData(identity []byte, mode string) ([]byte, error) {
+	if mode == keygrantor.KeyModeSigner {
+		hash := sha256.Sum256(identity)
+		return hash[:], nil
+	}
+	selfR, err := keygrantor.DefaultAttester.SelfReport()
+	if err != nil {
+		return nil, err
+	}
+	return jobAndSandboxHash(identity, selfR.UniqueID), nil
+}
+
+func jobAndSandboxHash(identity, sandboxUniqueID []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, identity...), sandboxUniqueID...))
+	return hash[:]
+}
+
+// ThresholdKeyProvider gets key shares from t of N keygrantors in the threshold mode, and combines
+// them inside this enclave. The keygrantors only have epoch 0.
+type ThresholdKeyProvider struct {
+	Client *keygrantor.ThresholdClient
+	Mode   string
+	MinSVN uint
+}
+
+func NewThresholdKeyProvider(client *keygrantor.ThresholdClient) *ThresholdKeyProvider {
+	return &ThresholdKeyProvider{Client: client}
+}
+
+func (p *ThresholdKeyProvider) RootKey(identity []byte, epoch int64) (*bip32.Key, int64, error) {
+	if epoch != keygrantor.LatestEpoch && epoch != 0 {
+		return nil, 0, keygrantor.ErrUnknownEpoch
+	}
+	clientData, err := keyClientData(identity, p.Mode)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := keygrantor.KeyOptions{Mode: p.Mode, MinSVN: p.MinSVN}
+	key, err := p.Client.GetKey(clientData, opts)
+	return key, 0, err
+}
+
+// DevSeedKeyProvider derives keys from master keys generated by a fixed seed. The keys are
+// reproducible on any machine, so it is only for dev and test.
+type DevSeedKeyProvider struct {
+	seed         string
+	currentEpoch int64
+}
+
+func NewDevSeedKeyProvider(seed string) (*DevSeedKeyProvider, error) {
+	p := &DevSeedKeyProvider{seed: seed}
+	if _, err := p.masterKey(0); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// the master key of epoch 0 is generated by the seed itself, and a later one by seed + ":" + epoch
+func (p *DevSeedKeyProvider) masterKey(epoch int64) (*bip32.Key, error) {
+	seed := p.seed
+	if epoch != 0 {
+		seed += ":" + strconv.FormatInt(epoch, 10)
+	}
+	seedHash := sha256.Sum256([]byte(seed))
+	return bip32.NewMasterKey(seedHash[:])
+}
+
+// Rotate moves to a new epoch, as keygrantor does with '-rotate'
+func (p *DevSeedKeyProvider) Rotate() int64 {
+	p.currentEpoch++
+	return p.currentEpoch
+}
+
+func (p *DevSeedKeyProvider) RootKey(identity []byte, epoch int64) (*bip32.Key, int64, error) {
+	if epoch == keygrantor.LatestEpoch {
+		epoch = p.currentEpoch
+	}
+	if epoch < 0 || epoch > p.currentEpoch {
+		return nil, 0, keygrantor.ErrUnknownEpoch
+	}
+	master, err := p.masterKey(epoch)
+	if err != nil {
+		return nil, 0, err
+	}
+	return keygrantor.DeriveKey(master, sha256.Sum256(identity)), epoch, nil
+}
+
+// SealedFileKeyProvider derives keys from a master key sealed to this enclave in a local file,
+// which is generated at the first time. It works without a keygrantor and only has epoch 0.
+type SealedFileKeyProvider struct {
+	master *bip32.Key
+}
+
+func NewSealedFileKeyProvider(fname string) *SealedFileKeyProvider {
+	master, fileExists := keygrantor.RecoverKeyFromFile(fname)
+	if !fileExists {
+		master = keygrantor.GetRandomExtPrivKey()
+		keygrantor.SealKeyToFile(fname, master)
+	}
+	return &SealedFileKeyProvider{master: master}
+}
+
+func (p *SealedFileKeyProvider) RootKey(identity []byte, epoch int64) (*bip32.Key, int64, error) {
+	if epoch != keygrantor.LatestEpoch && epoch != 0 {
+		return nil, 0, keygrantor.ErrUnknownEpoch
+	}
+	return keygrantor.DeriveKey(p.master, sha256.Sum256(identity)), 0, nil
+}
+
+// RandomKeyProvider gives a new random key each time, so the sealed state cannot be reopened
+type RandomKeyProvider struct{}
+
+func (RandomKeyProvider) RootKey(_ []byte, epoch int64) (*bip32.Key, int64, error) {
+	if epoch == keygrantor.LatestEpoch {
+		epoch = 0
+	}
+	seed, err := bip32.NewSeed()
+	if err != nil {
+		return nil, 0, err
+	}
+	key, err := bip32.NewMasterKey(seed)
+	return key, epoch, err
+}
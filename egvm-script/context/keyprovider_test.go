@@ -0,0 +1,193 @@
+package context
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/tyler-smith/go-bip32"
+
+	"github.com/smartbch/egvm/keygrantor"
+)
+
+func TestDevSeedKeyProvider(t *testing.T) {
+	p, err := NewDevSeedKeyProvider("test seed")
+	require.NoError(t, err)
+	k1, _, err := p.RootKey([]byte("job1"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	k2, _, err := p.RootKey([]byte("job2"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.NotEqual(t, k1.Key, k2.Key)
+
+	p2, err := NewDevSeedKeyProvider("test seed")
+	require.NoError(t, err)
+	k3, _, err := p2.RootKey([]byte("job1"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.Equal(t, k1.Key, k3.Key)
+
+	p3, err := NewDevSeedKeyProvider("another seed")
+	require.NoError(t, err)
+	k4, _, err := p3.RootKey([]byte("job1"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.NotEqual(t, k1.Key, k4.Key)
+}
+
+func TestRandomKeyProvider(t *testing.T) {
+	k1, _, err := RandomKeyProvider{}.RootKey([]byte("job"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	k2, _, err := RandomKeyProvider{}.RootKey([]byte("job"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.NotEqual(t, k1.Key, k2.Key)
+}
+
+func TestDevSeedKeyProviderEpochs(t *testing.T) {
+	p, err := NewDevSeedKeyProvider("test seed")
+	require.NoError(t, err)
+	k0, epoch, err := p.RootKey([]byte("job"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	_, _, err = p.RootKey([]byte("job"), 1)
+	require.ErrorIs(t, err, keygrantor.ErrUnknownEpoch)
+
+	require.EqualValues(t, 1, p.Rotate())
+	k1, epoch, err := p.RootKey([]byte("job"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+	require.NotEqual(t, k0.Key, k1.Key)
+	old, epoch, err := p.RootKey([]byte("job"), 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	require.Equal(t, k0.Key, old.Key)
+}
+
+func TestKeyGrantorKeyProvider(t *testing.T) {
+	signKey, err := gethcrypto.GenerateKey()
+	require.NoError(t, err)
+	mock := keygrantor.NewMockAttestation(signKey, attestation.Report{
+		UniqueID:  []byte("egvmscript"),
+		SignerID:  []byte("signer"),
+		ProductID: []byte{1},
+		TCBStatus: tcbstatus.UpToDate,
+	})
+	keygrantor.DefaultAttester, keygrantor.DefaultVerifier = mock, mock
+	keygrantor.AllowPlainHTTP = true
+	defer func() {
+		keygrantor.DefaultAttester, keygrantor.DefaultVerifier = keygrantor.EgoAttester{}, keygrantor.EgoVerifier{}
+		keygrantor.AllowPlainHTTP = false
+	}()
+
+	keys, err := keygrantor.NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	seed := sha256.Sum256([]byte("keygrantor seed"))
+	master, err := bip32.NewMasterKey(seed[:])
+	require.NoError(t, err)
+	_, err = keys.Append(master)
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	require.NoError(t, (&keygrantor.Server{Keys: keys, Attester: mock, Verifier: mock}).RegisterHandlers(mux))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := NewKeyGrantorKeyProvider(server.URL)
+	key, epoch, err := p.RootKey([]byte("job"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	jobAndSandboxHash := sha256.Sum256([]byte("jobegvmscript"))
+	expected := keygrantor.DeriveKey(master, sha256.Sum256(append([]byte("egvmscript"), jobAndSandboxHash[:]...)))
+	require.Equal(t, expected.B58Serialize(), key.B58Serialize())
+
+	// the root key of a script can be predicted from the xpub before the script runs
+	scriptHash := sha256.Sum256([]byte("script"))
+	rootKey, _, err := p.RootKey(KeyIdentity(scriptHash, "salt"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	predicted, err := PredictRootPubKey(master.PublicKey(), []byte("egvmscript"), scriptHash, "salt")
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(rootKey.PublicKey().Key), predicted.PubKey)
+	receiptKey, _, err := p.RootKey(ReceiptIdentity(scriptHash, "salt"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	predicted, err = PredictReceiptPubKey(master.PublicKey(), []byte("egvmscript"), scriptHash, "salt")
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(receiptKey.PublicKey().Key), predicted.PubKey)
+	require.NotEqual(t, rootKey.PublicKey().Key, receiptKey.PublicKey().Key)
+
+	// in the signer mode, the UniqueID of the sandbox is in neither the client data nor the derivation
+	p.Mode = keygrantor.KeyModeSigner
+	signerKey, _, err := p.RootKey([]byte("job"), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.NotEqual(t, key.B58Serialize(), signerKey.B58Serialize())
+	selfR, err := mock.SelfReport()
+	require.NoError(t, err)
+	jobHash := sha256.Sum256([]byte("job"))
+	selfR.Data = append(make([]byte, 32), jobHash[:]...)
+	selfR.UniqueID = []byte("upgraded egvmscript")
+	hash, err := keygrantor.DerivationHash(&selfR, keygrantor.KeyModeSigner, 0)
+	require.NoError(t, err)
+	require.Equal(t, keygrantor.DeriveKey(master, hash).B58Serialize(), signerKey.B58Serialize())
+}
+
+func TestKeyGrantorKeyProviderMigration(t *testing.T) {
+	signKey, err := gethcrypto.GenerateKey()
+	require.NoError(t, err)
+	oldReport := attestation.Report{
+		UniqueID:  []byte("egvmscript v1"),
+		SignerID:  []byte("signer"),
+		ProductID: []byte{1},
+		TCBStatus: tcbstatus.UpToDate,
+	}
+	mock := keygrantor.NewMockAttestation(signKey, oldReport)
+	keygrantor.DefaultAttester, keygrantor.DefaultVerifier = mock, mock
+	keygrantor.AllowPlainHTTP = true
+	defer func() {
+		keygrantor.DefaultAttester, keygrantor.DefaultVerifier = keygrantor.EgoAttester{}, keygrantor.EgoVerifier{}
+		keygrantor.AllowPlainHTTP = false
+	}()
+
+	keys, err := keygrantor.NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	seed := sha256.Sum256([]byte("keygrantor seed"))
+	master, err := bip32.NewMasterKey(seed[:])
+	require.NoError(t, err)
+	_, err = keys.Append(master)
+	require.NoError(t, err)
+	audit, err := keygrantor.NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), nil, nil)
+	require.NoError(t, err)
+	policy, err := keygrantor.ParsePolicy([]byte(`{"endpoints": {"/getkey": {}, "/migratekey": {
+		"migrate_from": ["` + hex.EncodeToString(oldReport.UniqueID) + `"]
+	}}}`))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	require.NoError(t, (&keygrantor.Server{Keys: keys, Attester: mock, Verifier: mock, Policy: policy, Audit: audit}).RegisterHandlers(mux))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scriptHash := sha256.Sum256([]byte("script"))
+	oldKey, _, err := NewKeyGrantorKeyProvider(server.URL).RootKey(KeyIdentity(scriptHash, ""), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+
+	newReport := oldReport
+	newReport.UniqueID = []byte("egvmscript v2")
+	keygrantor.DefaultAttester = keygrantor.NewMockAttestation(signKey, newReport)
+	p := NewKeyGrantorKeyProvider(server.URL)
+	newKey, _, err := p.RootKey(KeyIdentity(scriptHash, ""), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.NotEqual(t, oldKey.B58Serialize(), newKey.B58Serialize())
+
+	p.MigrateFrom = oldReport.UniqueID
+	migrated, _, err := p.RootKey(KeyIdentity(scriptHash, ""), keygrantor.LatestEpoch)
+	require.NoError(t, err)
+	require.Equal(t, oldKey.B58Serialize(), migrated.B58Serialize())
+
+	p.MigrateFrom = []byte("egvmscript v0")
+	_, _, err = p.RootKey(KeyIdentity(scriptHash, ""), keygrantor.LatestEpoch)
+	require.ErrorContains(t, err, keygrantor.ErrPolicyMigration.Error())
+	p.MigrateFrom, p.Mode = oldReport.UniqueID, keygrantor.KeyModeSigner
+	_, _, err = p.RootKey(KeyIdentity(scriptHash, ""), keygrantor.LatestEpoch)
+	require.ErrorIs(t, err, ErrMigrationMode)
+}
@@ -0,0 +1,69 @@
+package context
+
+import (
+	"crypto/sha256"
+
+	"github.com/tyler-smith/go-bip32"
+
+	"github.com/smartbch/egvm/keygrantor"
+)
+
+// KeyIdentityVersion versions the scheme deriving keys for jobs. The keys of a job only depend
+// on the script and the job's KeySalt, so they survive the changes of inputs, state and config:
+//
+//	identity   = "egvm.key.v1" || sha256(script) || sha256(keySalt)
+//	rootKey    = KeyProvider.RootKey(identity, epoch)
+//	namedKey   = DeriveKey(rootKey, sha256("egvm.key.v1/name" || name))
+//	stateKey   = DeriveKey(rootKey, sha256("egvm.state" || sha256(script)))
+//	receiptKey = KeyProvider.RootKey("egvm.receipt.v1" || sha256(script) || sha256(keySalt), epoch)
+//
+// The receipt key is a root of its own, so the script, which has its root key, cannot sign
+// receipts.
+//
+// The scheme must never be changed in place, since that changes all the keys. A new scheme
+// must come with a new version string.
+const KeyIdentityVersion = "egvm.key.v1"
+
+const namedKeyPrefix = KeyIdentityVersion + "/name"
+
+// ReceiptIdentityVersion prefixes the identity of the receipt key, instead of KeyIdentityVersion
+const ReceiptIdentityVersion = "egvm.receipt.v1"
+
+// KeyIdentity returns the bytes identifying the keys of a script, which are passed to KeyProvider
+func KeyIdentity(scriptHash [32]byte, keySalt string) []byte {
+	return identityOf(KeyIdentityVersion, scriptHash, keySalt)
+}
+
+// ReceiptIdentity returns the bytes identifying the key signing the receipts of a script
+func ReceiptIdentity(scriptHash [32]byte, keySalt string) []byte {
+	return identityOf(ReceiptIdentityVersion, scriptHash, keySalt)
+}
+
+func identityOf(version string, scriptHash [32]byte, keySalt string) []byte {
+	saltHash := sha256.Sum256([]byte(keySalt))
+	identity := make([]byte, 0, len(version)+64)
+	identity = append(identity, version...)
+	identity = append(identity, scriptHash[:]...)
+	return append(identity, saltHash[:]...)
+}
+
+// DeriveNamedKey derives the key returned by ctx.GetKey(name) from the root key
+func DeriveNamedKey(rootKey *bip32.Key, name string) *bip32.Key {
+	h := sha256.Sum256(append([]byte(namedKeyPrefix), name...))
+	return keygrantor.DeriveKey(rootKey, h)
+}
+
+// PredictRootPubKey computes the public part of the root key that the egvmscript of sandboxUniqueID
+// gets from the keygrantor of xpub for a script, in the default key mode. It only needs the xpub,
+// so the script's addresses are known before it ever runs.
+func PredictRootPubKey(xpub *bip32.Key, sandboxUniqueID []byte, scriptHash [32]byte, keySalt string) (*keygrantor.DerivedPubKey, error) {
+	clientData := jobAndSandboxHash(KeyIdentity(scriptHash, keySalt), sandboxUniqueID)
+	return keygrantor.DerivePubKey(xpub, sandboxUniqueID, clientData)
+}
+
+// PredictReceiptPubKey computes the public part of the key signing the receipts of a script, as
+// PredictRootPubKey does for the root key
+func PredictReceiptPubKey(xpub *bip32.Key, sandboxUniqueID []byte, scriptHash [32]byte, keySalt string) (*keygrantor.DerivedPubKey, error) {
+	clientData := jobAndSandboxHash(ReceiptIdentity(scriptHash, keySalt), sandboxUniqueID)
+	return keygrantor.DerivePubKey(xpub, sandboxUniqueID, clientData)
+}
@@ -0,0 +1,101 @@
+package context
+
+import (
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/egvm/egvm-script/types"
+)
+
+func useDevSeedKeyProvider(t *testing.T) {
+	p, err := NewDevSeedKeyProvider("test seed")
+	require.NoError(t, err)
+	SetKeyProvider(p)
+	t.Cleanup(func() { SetKeyProvider(RandomKeyProvider{}) })
+}
+
+func TestKeyIdentity(t *testing.T) {
+	h1 := types.ScriptHash("script1")
+	h2 := types.ScriptHash("script2")
+	require.Equal(t, KeyIdentity(h1, ""), KeyIdentity(h1, ""))
+	require.NotEqual(t, KeyIdentity(h1, ""), KeyIdentity(h2, ""))
+	require.NotEqual(t, KeyIdentity(h1, ""), KeyIdentity(h1, "salt"))
+	require.Len(t, KeyIdentity(h1, "salt"), len(KeyIdentityVersion)+64)
+}
+
+func TestKeysSurviveInputChanges(t *testing.T) {
+	useDevSeedKeyProvider(t)
+	EGVMCtx = &EGVMContext{}
+	defer ResetContext()
+
+	job := &types.LambdaJob{Script: "keys", Config: "cfg1", Inputs: [][]byte{{1}}}
+	require.NoError(t, SetContext(job))
+	root1 := EGVMCtx.rootKey.B58Serialize()
+	named1 := DeriveNamedKey(EGVMCtx.rootKey, "signer").B58Serialize()
+	ResetContext()
+
+	job = &types.LambdaJob{Script: "keys", Config: "cfg2", Inputs: [][]byte{{2}, {3}}}
+	require.NoError(t, SetContext(job))
+	require.Equal(t, root1, EGVMCtx.rootKey.B58Serialize())
+	require.Equal(t, named1, DeriveNamedKey(EGVMCtx.rootKey, "signer").B58Serialize())
+	require.NotEqual(t, named1, DeriveNamedKey(EGVMCtx.rootKey, "other").B58Serialize())
+	ResetContext()
+
+	job = &types.LambdaJob{Script: "keys", KeySalt: "salt"}
+	require.NoError(t, SetContext(job))
+	require.NotEqual(t, root1, EGVMCtx.rootKey.B58Serialize())
+}
+
+func TestEGVMContextGetKey(t *testing.T) {
+	useDevSeedKeyProvider(t)
+	EGVMCtx = &EGVMContext{}
+	defer ResetContext()
+	require.NoError(t, SetContext(&types.LambdaJob{Script: "get key"}))
+	expected := DeriveNamedKey(EGVMCtx.rootKey, "signer").B58Serialize()
+
+	vm := goja.New()
+	vm.Set("GetEGVMContext", GetEGVMContext)
+	_, err := vm.RunString(`
+	let EGVMCtx = GetEGVMContext()
+	let out = EGVMCtx.GetKey('signer').B58Serialize()
+	let root = EGVMCtx.GetRootKey().B58Serialize()
+`)
+	require.NoError(t, err)
+	require.Equal(t, expected, vm.Get("out").Export().(string))
+	require.NotEqual(t, expected, vm.Get("root").Export().(string))
+
+	_, err = vm.RunString(`EGVMCtx.GetKey('')`)
+	require.Error(t, err)
+	_, err = vm.RunString(`EGVMCtx.GetKey('signer', 1)`)
+	require.Error(t, err)
+}
+
+func TestEGVMContextGetKeyOfEpoch(t *testing.T) {
+	p, err := NewDevSeedKeyProvider("test seed")
+	require.NoError(t, err)
+	SetKeyProvider(p)
+	defer SetKeyProvider(RandomKeyProvider{})
+	EGVMCtx = &EGVMContext{}
+	defer ResetContext()
+
+	require.NoError(t, SetContext(&types.LambdaJob{Script: "get key"}))
+	old := DeriveNamedKey(EGVMCtx.rootKey, "signer").B58Serialize()
+	ResetContext()
+	p.Rotate()
+	require.NoError(t, SetContext(&types.LambdaJob{Script: "get key"}))
+
+	vm := goja.New()
+	vm.Set("GetEGVMContext", GetEGVMContext)
+	_, err = vm.RunString(`
+	let EGVMCtx = GetEGVMContext()
+	let epoch = EGVMCtx.GetKeyEpoch()
+	let latest = EGVMCtx.GetKey('signer').B58Serialize()
+	let old = EGVMCtx.GetKey('signer', 0).B58Serialize()
+`)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, vm.Get("epoch").Export())
+	require.Equal(t, old, vm.Get("old").Export().(string))
+	require.NotEqual(t, old, vm.Get("latest").Export().(string))
+}
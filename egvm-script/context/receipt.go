@@ -0,0 +1,42 @@
+package context
+
+import (
+	"crypto/sha256"
+
+	"github.com/edgelesssys/ego/enclave"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/smartbch/egvm/egvm-script/types"
+)
+
+// when enabled, receipts embed an attestation report over sha256(pubkey)
+var attestReceipts bool
+
+func SetReceiptAttestation(enable bool) {
+	attestReceipts = enable
+}
+
+// signReceipt signs the hashes of this run with the receipt key
+func (e *EGVMContext) signReceipt(newState []byte) (*types.Receipt, error) {
+	r := types.NewReceipt(e.scriptHash, e.jobConfig, e.inputBufLists, e.prevState, e.outputBufLists, newState)
+	prv, err := gethcrypto.ToECDSA(e.receiptKey.Key)
+	if err != nil {
+		return nil, err
+	}
+	r.Signature, err = gethcrypto.Sign(r.Digest(), prv)
+	if err != nil {
+		return nil, err
+	}
+	r.PubKey = e.receiptKey.PublicKey().Key
+	if attestReceipts {
+		if e.receiptReport == nil {
+			pubKeyHash := sha256.Sum256(r.PubKey)
+			e.receiptReport, err = enclave.GetRemoteReport(pubKeyHash[:])
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.Report = e.receiptReport
+	}
+	return r, nil
+}
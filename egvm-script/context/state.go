@@ -0,0 +1,186 @@
+package context
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/tinylib/msgp/msgp"
+	"github.com/tyler-smith/go-bip32"
+
+	"github.com/smartbch/egvm/keygrantor"
+)
+
+// SealedStateMagic prefixes the state sealed by egvmscript. The states sealed with the older
+// SealedStateMagicV1, which has no key epoch, are opened as epoch 0.
+const (
+	SealedStateMagic   = "egvm.sealed.v2"
+	SealedStateMagicV1 = "egvm.sealed.v1"
+)
+
+var (
+	ErrStateNotSealed = errors.New("state is not sealed by egvmscript")
+	ErrStateTampered  = errors.New("state is tampered or sealed by another script")
+	ErrStateStale     = errors.New("state is staler than the last one seen")
+	ErrStateAhead     = errors.New("state is ahead of the monotonic counter")
+)
+
+var (
+	// optional, the state version is checked against and bumped with it when set
+	stateCounter keygrantor.MonotonicCounter
+
+	// the latest state version seen for each key identity in this process, to reject rolled back states
+	lastStateVersions     = make(map[[32]byte]uint64)
+	lastStateVersionsLock sync.Mutex
+)
+
+// DeriveStateKey derives the AES-256 key protecting the state of a script from the root key
+func DeriveStateKey(rootKey *bip32.Key, scriptHash [32]byte) []byte {
+	h := sha256.Sum256(append([]byte("egvm.state"), scriptHash[:]...))
+	return keygrantor.DeriveKey(rootKey, h).Key
+}
+
+func stateAAD(magic string, scriptHash [32]byte, epoch int64, version uint64) []byte {
+	aad := make([]byte, 0, len(magic)+32+16)
+	aad = append(aad, magic...)
+	aad = append(aad, scriptHash[:]...)
+	var numBz [8]byte
+	if magic != SealedStateMagicV1 {
+		binary.BigEndian.PutUint64(numBz[:], uint64(epoch))
+		aad = append(aad, numBz[:]...)
+	}
+	binary.BigEndian.PutUint64(numBz[:], version)
+	return append(aad, numBz[:]...)
+}
+
+func newStateGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealState encrypts the state with AES-GCM. The script hash, the epoch of the root key which
+// the key is derived from, and the version are authenticated.
+func SealState(key []byte, scriptHash [32]byte, epoch int64, version uint64, state []byte) ([]byte, error) {
+	gcm, err := newStateGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b := msgp.AppendString(nil, SealedStateMagic)
+	b = msgp.AppendInt64(b, epoch)
+	b = msgp.AppendUint64(b, version)
+	b = msgp.AppendBytes(b, nonce)
+	b = msgp.AppendBytes(b, gcm.Seal(nil, nonce, state, stateAAD(SealedStateMagic, scriptHash, epoch, version)))
+	return b, nil
+}
+
+type sealedState struct {
+	magic      string
+	epoch      int64
+	version    uint64
+	nonce      []byte
+	ciphertext []byte
+}
+
+func parseSealedState(sealed []byte) (*sealedState, error) {
+	var s sealedState
+	magic, b, err := msgp.ReadStringBytes(sealed)
+	if err != nil || (magic != SealedStateMagic && magic != SealedStateMagicV1) {
+		return nil, ErrStateNotSealed
+	}
+	s.magic = magic
+	if magic != SealedStateMagicV1 {
+		s.epoch, b, err = msgp.ReadInt64Bytes(b)
+		if err != nil || s.epoch < 0 {
+			return nil, ErrStateNotSealed
+		}
+	}
+	s.version, b, err = msgp.ReadUint64Bytes(b)
+	if err != nil {
+		return nil, ErrStateNotSealed
+	}
+	s.nonce, b, err = msgp.ReadBytesBytes(b, nil)
+	if err != nil {
+		return nil, ErrStateNotSealed
+	}
+	s.ciphertext, _, err = msgp.ReadBytesBytes(b, nil)
+	if err != nil {
+		return nil, ErrStateNotSealed
+	}
+	return &s, nil
+}
+
+// SealedStateEpoch returns the key epoch of a sealed state, so the key can be got before opening it
+func SealedStateEpoch(sealed []byte) (int64, error) {
+	s, err := parseSealedState(sealed)
+	if err != nil {
+		return 0, err
+	}
+	return s.epoch, nil
+}
+
+// OpenState decrypts the state sealed by SealState and returns it with its version
+func OpenState(key []byte, scriptHash [32]byte, sealed []byte) (state []byte, version uint64, err error) {
+	s, err := parseSealedState(sealed)
+	if err != nil {
+		return nil, 0, err
+	}
+	gcm, err := newStateGCM(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(s.nonce) != gcm.NonceSize() {
+		return nil, 0, ErrStateTampered
+	}
+	state, err = gcm.Open(nil, s.nonce, s.ciphertext, stateAAD(s.magic, scriptHash, s.epoch, s.version))
+	if err != nil {
+		return nil, 0, ErrStateTampered
+	}
+	return state, s.version, nil
+}
+
+// SetStateCounter enables the rollback protection across processes and hosts. It is only as good as
+// the counter: keygrantor keeps its counters in a file, which keygrantor's host can roll back, so it
+// protects against the host of egvmscript when keygrantor runs on another one.
+func SetStateCounter(counter keygrantor.MonotonicCounter) {
+	stateCounter = counter
+}
+
+// StateCounterKey returns the key of the state version in the monotonic counter. It is the hash of
+// the key identity, so the jobs of the same script with different KeySalts, whose states are
+// sealed by different keys, have their own versions.
+func StateCounterKey(keyIdentity []byte) [32]byte {
+	return sha256.Sum256(keyIdentity)
+}
+
+// checkStateVersion rejects a state older than the latest one seen for the same counter key
+func checkStateVersion(counterKey [32]byte, version uint64) error {
+	lastStateVersionsLock.Lock()
+	defer lastStateVersionsLock.Unlock()
+	if version < lastStateVersions[counterKey] {
+		return ErrStateStale
+	}
+	if stateCounter != nil {
+		latest, err := stateCounter.Get(counterKey)
+		if err != nil {
+			return err
+		}
+		if version < latest {
+			return ErrStateStale
+		} else if version > latest {
+			return ErrStateAhead
+		}
+	}
+	lastStateVersions[counterKey] = version
+	return nil
+}
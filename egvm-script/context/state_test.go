@@ -0,0 +1,222 @@
+package context
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/stretchr/testify/require"
+	"github.com/tinylib/msgp/msgp"
+	"github.com/tyler-smith/go-bip32"
+
+	"github.com/smartbch/egvm/egvm-script/types"
+	"github.com/smartbch/egvm/keygrantor"
+)
+
+func newTestStateKey(t *testing.T, script string) ([]byte, [32]byte) {
+	seed := sha256.Sum256([]byte("state test seed"))
+	rootKey, err := bip32.NewMasterKey(seed[:])
+	require.NoError(t, err)
+	scriptHash := sha256.Sum256([]byte(script))
+	return DeriveStateKey(rootKey, scriptHash), scriptHash
+}
+
+func TestSealAndOpenState(t *testing.T) {
+	key, scriptHash := newTestStateKey(t, "script a")
+	sealed, err := SealState(key, scriptHash, 0, 7, []byte("hello"))
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "hello")
+
+	state, version, err := OpenState(key, scriptHash, sealed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), state)
+	require.EqualValues(t, 7, version)
+
+	// another script cannot open it
+	otherKey, otherHash := newTestStateKey(t, "script b")
+	_, _, err = OpenState(otherKey, otherHash, sealed)
+	require.ErrorIs(t, err, ErrStateTampered)
+	_, _, err = OpenState(key, otherHash, sealed)
+	require.ErrorIs(t, err, ErrStateTampered)
+
+	// flipping any byte of the ciphertext is detected
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, _, err = OpenState(key, scriptHash, tampered)
+	require.ErrorIs(t, err, ErrStateTampered)
+
+	_, _, err = OpenState(key, scriptHash, []byte("plain state"))
+	require.ErrorIs(t, err, ErrStateNotSealed)
+}
+
+func TestSealedStateRollback(t *testing.T) {
+	key, scriptHash := newTestStateKey(t, "script rollback")
+	EGVMCtx = &EGVMContext{stateKey: key, scriptHash: scriptHash, keyIdentity: KeyIdentity(scriptHash, "")}
+	require.NoError(t, EGVMCtx.openState(nil))
+
+	EGVMCtx.state = []byte("v1")
+	first := CollectResult("").State
+	EGVMCtx.state = []byte("v2")
+	second := CollectResult("").State
+
+	require.NoError(t, EGVMCtx.openState(second))
+	require.Equal(t, []byte("v2"), EGVMCtx.state)
+	require.ErrorIs(t, EGVMCtx.openState(first), ErrStateStale)
+	require.ErrorIs(t, EGVMCtx.openState(nil), ErrStateStale)
+}
+
+func TestSealedStateWithCounter(t *testing.T) {
+	fc, err := keygrantor.NewFileCounter(filepath.Join(t.TempDir(), "counter.txt"), nil, nil)
+	require.NoError(t, err)
+	SetStateCounter(fc)
+	defer SetStateCounter(nil)
+
+	key, scriptHash := newTestStateKey(t, "script counter")
+	EGVMCtx = &EGVMContext{stateKey: key, scriptHash: scriptHash, keyIdentity: KeyIdentity(scriptHash, "")}
+	require.NoError(t, EGVMCtx.openState(nil))
+	EGVMCtx.state = []byte("v1")
+	first := CollectResult("").State
+	EGVMCtx.state = []byte("v2")
+	second := CollectResult("").State
+	latest, err := fc.Get(StateCounterKey(KeyIdentity(scriptHash, "")))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, latest)
+
+	// a fresh process has no memory of the versions, but the counter still rejects old states
+	lastStateVersionsLock.Lock()
+	delete(lastStateVersions, StateCounterKey(KeyIdentity(scriptHash, "")))
+	lastStateVersionsLock.Unlock()
+	require.ErrorIs(t, EGVMCtx.openState(first), ErrStateStale)
+	require.NoError(t, EGVMCtx.openState(second))
+
+	// a concurrent writer based on the same version loses
+	other := &EGVMContext{stateKey: key, scriptHash: scriptHash, keyIdentity: KeyIdentity(scriptHash, ""), stateVersion: 1}
+	_, err = other.sealState()
+	require.ErrorIs(t, err, keygrantor.ErrCounterMismatch)
+
+	// the same script with another KeySalt has a state of its own
+	salted := &EGVMContext{stateKey: key, scriptHash: scriptHash, keyIdentity: KeyIdentity(scriptHash, "salt")}
+	require.NoError(t, salted.openState(nil))
+}
+
+func TestCollectResultWithReceipt(t *testing.T) {
+	seed := sha256.Sum256([]byte("receipt seed"))
+	rootKey, err := bip32.NewMasterKey(seed[:])
+	require.NoError(t, err)
+	job := &types.LambdaJob{Script: "script receipt", Config: "cfg", Inputs: [][]byte{{1}}}
+	scriptHash := types.ScriptHash(job.Script)
+	EGVMCtx = &EGVMContext{
+		rootKey:       rootKey,
+		receiptKey:    DeriveNamedKey(rootKey, "receipt"),
+		stateKey:      DeriveStateKey(rootKey, scriptHash),
+		scriptHash:    scriptHash,
+		keyIdentity:   KeyIdentity(scriptHash, ""),
+		jobConfig:     job.Config,
+		inputBufLists: job.Inputs,
+	}
+	require.NoError(t, EGVMCtx.openState(nil))
+	EGVMCtx.outputBufLists = [][]byte{{2}}
+	EGVMCtx.state = []byte("new state")
+	res := CollectResult("")
+	require.NoError(t, types.VerifyReceipt(job, res, EGVMCtx.receiptKey.PublicKey().Key))
+	require.ErrorIs(t, types.VerifyReceipt(job, res, rootKey.PublicKey().Key), types.ErrReceiptSigner)
+
+	// no receipt for a failed run
+	require.Nil(t, CollectResult("script error").Receipt)
+}
+
+func TestCollectResultWithChangedInputs(t *testing.T) {
+	seed := sha256.Sum256([]byte("receipt seed"))
+	rootKey, err := bip32.NewMasterKey(seed[:])
+	require.NoError(t, err)
+	job := &types.LambdaJob{Script: "script inputs", Inputs: [][]byte{{1, 2}}}
+	scriptHash := types.ScriptHash(job.Script)
+	EGVMCtx = &EGVMContext{
+		rootKey:       rootKey,
+		receiptKey:    DeriveNamedKey(rootKey, "receipt"),
+		stateKey:      DeriveStateKey(rootKey, scriptHash),
+		scriptHash:    scriptHash,
+		keyIdentity:   KeyIdentity(scriptHash, ""),
+		inputBufLists: job.Inputs,
+	}
+	require.NoError(t, EGVMCtx.openState(nil))
+	vm := goja.New()
+	vm.Set("GetEGVMContext", GetEGVMContext)
+	_, err = vm.RunString(`
+		const input = new Uint8Array(GetEGVMContext().GetInputs()[0])
+		input[0] = 9
+		GetEGVMContext().SetOutputs(input.buffer)
+	`)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1, 2}}, job.Inputs)
+	res := CollectResult("")
+	require.Equal(t, [][]byte{{9, 2}}, res.Outputs)
+	require.NoError(t, types.VerifyReceipt(job, res, EGVMCtx.receiptKey.PublicKey().Key))
+}
+
+func TestCollectResultWithoutOpenedState(t *testing.T) {
+	key, scriptHash := newTestStateKey(t, "script unopened")
+	EGVMCtx = &EGVMContext{stateKey: key, scriptHash: scriptHash, keyIdentity: KeyIdentity(scriptHash, "")}
+	require.NoError(t, EGVMCtx.openState(nil))
+	EGVMCtx.state = []byte("v1")
+	sealed := CollectResult("").State
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	require.ErrorIs(t, EGVMCtx.openState(tampered), ErrStateTampered)
+	res := CollectResult(ErrStateTampered.Error())
+	require.Nil(t, res.State)
+
+	// never opened at all
+	EGVMCtx = &EGVMContext{stateKey: key, scriptHash: scriptHash, keyIdentity: KeyIdentity(scriptHash, "")}
+	EGVMCtx.state = []byte("v2")
+	require.Nil(t, CollectResult("").State)
+}
+
+func TestOpenStateSealedV1(t *testing.T) {
+	key, scriptHash := newTestStateKey(t, "script v1")
+	gcm, err := newStateGCM(key)
+	require.NoError(t, err)
+	nonce := make([]byte, gcm.NonceSize())
+	b := msgp.AppendString(nil, SealedStateMagicV1)
+	b = msgp.AppendUint64(b, 3)
+	b = msgp.AppendBytes(b, nonce)
+	b = msgp.AppendBytes(b, gcm.Seal(nil, nonce, []byte("old"), stateAAD(SealedStateMagicV1, scriptHash, 0, 3)))
+
+	epoch, err := SealedStateEpoch(b)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	state, version, err := OpenState(key, scriptHash, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), state)
+	require.EqualValues(t, 3, version)
+}
+
+func TestSealedStateAcrossKeyEpochs(t *testing.T) {
+	p, err := NewDevSeedKeyProvider("epoch seed")
+	require.NoError(t, err)
+	SetKeyProvider(p)
+	defer SetKeyProvider(RandomKeyProvider{})
+	EGVMCtx = &EGVMContext{}
+	defer ResetContext()
+
+	job := &types.LambdaJob{Script: "script epochs"}
+	require.NoError(t, SetContext(job))
+	EGVMCtx.state = []byte("sealed in epoch 0")
+	job.State = CollectResult("").State
+	ResetContext()
+
+	p.Rotate()
+	require.NoError(t, SetContext(job))
+	require.EqualValues(t, 1, EGVMCtx.GetKeyEpoch())
+	require.Equal(t, []byte("sealed in epoch 0"), EGVMCtx.state)
+	job.State = CollectResult("").State
+	epoch, err := SealedStateEpoch(job.State)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+	ResetContext()
+
+	require.NoError(t, SetContext(job))
+	require.Equal(t, []byte("sealed in epoch 0"), EGVMCtx.state)
+}
@@ -2,6 +2,10 @@
 
 package enclaveutil
 
-func VerifyEnclaveReportBz(pubKey, reportBz, signerIDBz, uniqueIDBz []byte) error {
-	return nil
+import (
+	"github.com/edgelesssys/ego/attestation"
+)
+
+func VerifyEnclaveReportBz(reportData, reportBz []byte, policy *ReportPolicy) (attestation.Report, error) {
+	return attestation.Report{}, nil
 }
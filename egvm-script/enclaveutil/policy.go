@@ -0,0 +1,153 @@
+package enclaveutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+)
+
+var (
+	ErrNoIdentity = errors.New("the policy must have signer IDs or a unique ID")
+)
+
+// ReportPolicy decides which enclaves' reports are accepted
+type ReportPolicy struct {
+	SignerIDs   [][]byte // the report must have one of them, if not empty
+	UniqueID    []byte   // the report must have it, if not empty
+	ProductID   *uint16  // the report must have it, if not nil
+	MinSVN      uint
+	TCBStatuses []tcbstatus.Status // accepted besides UpToDate
+	AllowDebug  bool
+}
+
+// DefaultReportPolicy accepts the production enclaves with the exact signerID and uniqueID, whose
+// ProductID is 1 and SVN is at least 2
+func DefaultReportPolicy(signerID, uniqueID []byte) *ReportPolicy {
+	productID := uint16(1)
+	return &ReportPolicy{
+		SignerIDs: [][]byte{signerID},
+		UniqueID:  uniqueID,
+		ProductID: &productID,
+		MinSVN:    2,
+	}
+}
+
+type reportPolicyJSON struct {
+	SignerIDs   []string `json:"signerIDs"`
+	UniqueID    string   `json:"uniqueID"`
+	ProductID   *uint16  `json:"productID"`
+	MinSVN      uint     `json:"minSVN"`
+	TCBStatuses []string `json:"tcbStatuses"`
+	AllowDebug  bool     `json:"allowDebug"`
+}
+
+// ParseReportPolicy parses a policy in JSON, whose IDs are in hex and TCB statuses are named as
+// tcbstatus.Status.String(), e.g. "SWHardeningNeeded"
+func ParseReportPolicy(bz []byte) (*ReportPolicy, error) {
+	var pj reportPolicyJSON
+	err := json.Unmarshal(bz, &pj)
+	if err != nil {
+		return nil, err
+	}
+	p := &ReportPolicy{ProductID: pj.ProductID, MinSVN: pj.MinSVN, AllowDebug: pj.AllowDebug}
+	for _, s := range pj.SignerIDs {
+		signerID, err := decodeHex(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signer ID %s: %w", s, err)
+		}
+		p.SignerIDs = append(p.SignerIDs, signerID)
+	}
+	p.UniqueID, err = decodeHex(pj.UniqueID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unique ID %s: %w", pj.UniqueID, err)
+	}
+	for _, name := range pj.TCBStatuses {
+		status, ok := parseTCBStatus(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown TCB status %s", name)
+		}
+		p.TCBStatuses = append(p.TCBStatuses, status)
+	}
+	if len(p.SignerIDs) == 0 && len(p.UniqueID) == 0 {
+		return nil, ErrNoIdentity
+	}
+	return p, nil
+}
+
+func decodeHex(s string) ([]byte, error) {
+	if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+	}
+	return hex.DecodeString(s)
+}
+
+func parseTCBStatus(name string) (tcbstatus.Status, bool) {
+	for s := tcbstatus.UpToDate; s <= tcbstatus.Unknown; s++ {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// Check checks a verified report against the policy. tcbErr is the error of verifying the report,
+// which is accepted if it is only about a TCB status the policy allows.
+func (p *ReportPolicy) Check(report *attestation.Report, tcbErr error) error {
+	if tcbErr != nil {
+		if !errors.Is(tcbErr, attestation.ErrTCBLevelInvalid) || !p.allowsTCBStatus(report.TCBStatus) {
+			return tcbErr
+		}
+	} else if !p.allowsTCBStatus(report.TCBStatus) {
+		return fmt.Errorf("TCB status %s is not allowed", report.TCBStatus)
+	}
+	if len(p.SignerIDs) == 0 && len(p.UniqueID) == 0 {
+		return ErrNoIdentity
+	}
+	if len(p.SignerIDs) != 0 && !p.allowsSignerID(report.SignerID) {
+		return fmt.Errorf("signer-id not allowed: %x", report.SignerID)
+	}
+	if len(p.UniqueID) != 0 && !bytes.Equal(report.UniqueID, p.UniqueID) {
+		return fmt.Errorf("unique-id not match! expected: %x, got: %x", p.UniqueID, report.UniqueID)
+	}
+	if p.ProductID != nil {
+		productID := make([]byte, 2)
+		copy(productID, report.ProductID)
+		if binary.LittleEndian.Uint16(productID) != *p.ProductID {
+			return errors.New("invalid product ID")
+		}
+	}
+	if report.SecurityVersion < p.MinSVN {
+		return errors.New("invalid security version")
+	}
+	if report.Debug && !p.AllowDebug {
+		return errors.New("should not open debug mode")
+	}
+	return nil
+}
+
+func (p *ReportPolicy) allowsSignerID(signerID []byte) bool {
+	for _, id := range p.SignerIDs {
+		if bytes.Equal(id, signerID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ReportPolicy) allowsTCBStatus(status tcbstatus.Status) bool {
+	if status == tcbstatus.UpToDate {
+		return true
+	}
+	for _, s := range p.TCBStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package enclaveutil
+
+import (
+	"testing"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockReport() attestation.Report {
+	return attestation.Report{
+		SecurityVersion: 2,
+		UniqueID:        []byte{0x01, 0x02},
+		SignerID:        []byte{0xaa, 0xbb},
+		ProductID:       []byte{1, 0},
+		TCBStatus:       tcbstatus.UpToDate,
+	}
+}
+
+func TestDefaultReportPolicy(t *testing.T) {
+	policy := DefaultReportPolicy([]byte{0xaa, 0xbb}, []byte{0x01, 0x02})
+	report := newMockReport()
+	require.NoError(t, policy.Check(&report, nil))
+
+	report.SecurityVersion = 1
+	require.EqualError(t, policy.Check(&report, nil), "invalid security version")
+	report = newMockReport()
+	report.ProductID = []byte{2, 0}
+	require.EqualError(t, policy.Check(&report, nil), "invalid product ID")
+	report = newMockReport()
+	report.UniqueID = []byte{0x03}
+	require.ErrorContains(t, policy.Check(&report, nil), "unique-id not match")
+	report = newMockReport()
+	report.SignerID = []byte{0xcc}
+	require.ErrorContains(t, policy.Check(&report, nil), "signer-id not allowed")
+	report = newMockReport()
+	report.Debug = true
+	require.EqualError(t, policy.Check(&report, nil), "should not open debug mode")
+	report = newMockReport()
+	report.TCBStatus = tcbstatus.SWHardeningNeeded
+	require.ErrorIs(t, policy.Check(&report, attestation.ErrTCBLevelInvalid), attestation.ErrTCBLevelInvalid)
+}
+
+func TestParseReportPolicy(t *testing.T) {
+	policy, err := ParseReportPolicy([]byte(`{
+		"signerIDs": ["0x1122", "aabb"],
+		"productID": 3,
+		"minSVN": 5,
+		"tcbStatuses": ["SWHardeningNeeded"],
+		"allowDebug": true
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{0x11, 0x22}, {0xaa, 0xbb}}, policy.SignerIDs)
+	require.Empty(t, policy.UniqueID)
+
+	// any UniqueID of an allowed signer
+	report := newMockReport()
+	report.ProductID = []byte{3, 0}
+	report.SecurityVersion = 5
+	report.UniqueID = []byte("any build")
+	report.Debug = true
+	require.NoError(t, policy.Check(&report, nil))
+	report.TCBStatus = tcbstatus.SWHardeningNeeded
+	require.NoError(t, policy.Check(&report, attestation.ErrTCBLevelInvalid))
+	report.TCBStatus = tcbstatus.OutOfDate
+	require.ErrorIs(t, policy.Check(&report, attestation.ErrTCBLevelInvalid), attestation.ErrTCBLevelInvalid)
+	report.TCBStatus = tcbstatus.UpToDate
+	report.SecurityVersion = 4
+	require.EqualError(t, policy.Check(&report, nil), "invalid security version")
+
+	// without productID, any ProductID is accepted
+	policy, err = ParseReportPolicy([]byte(`{"uniqueID": "0102"}`))
+	require.NoError(t, err)
+	report = newMockReport()
+	report.ProductID = []byte{9, 9}
+	report.SecurityVersion = 0
+	require.NoError(t, policy.Check(&report, nil))
+
+	_, err = ParseReportPolicy([]byte(`{"minSVN": 1}`))
+	require.ErrorIs(t, err, ErrNoIdentity)
+	_, err = ParseReportPolicy([]byte(`{"uniqueID": "0102", "tcbStatuses": ["Fine"]}`))
+	require.EqualError(t, err, "unknown TCB status Fine")
+	_, err = ParseReportPolicy([]byte(`{"signerIDs": ["xyz"]}`))
+	require.ErrorContains(t, err, "invalid signer ID")
+	require.ErrorIs(t, (&ReportPolicy{}).Check(&report, nil), ErrNoIdentity)
+}
@@ -290,11 +290,11 @@ func MerkleProofToRootAndMatches(f goja.FunctionCall, vm *goja.Runtime) goja.Val
 		panic(goja.NewSymbol("Error extracting txn matches from merkle tree traversal"))
 	}
 
-	result := make([]goja.ArrayBuffer, 1, len(matches)+1)
+	result := make([]goja.Value, 1, len(matches)+1)
 	hash := bytesReverse(merkleRoot.CloneBytes())
-	result[0] = vm.NewArrayBuffer(hash)
+	result[0] = utils.NewBuffer(vm, hash)
 	for _, tx := range matches {
-		result = append(result, vm.NewArrayBuffer(bytesReverse(tx.CloneBytes())))
+		result = append(result, utils.NewBuffer(vm, bytesReverse(tx.CloneBytes())))
 	}
 
 	return vm.ToValue(result)
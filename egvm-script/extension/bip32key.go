@@ -62,7 +62,7 @@ func (key Bip32Key) PublicKey() Bip32Key {
 
 func (key Bip32Key) Serialize(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	bz, _ := key.key.Serialize() // impossible to generate error
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func (key Bip32Key) IsPrivate() bool {
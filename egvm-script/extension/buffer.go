@@ -15,20 +15,19 @@ func BufConcat(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	var data [][]byte
 	totalLen := 0
 	for _, arg := range f.Arguments {
-		switch v := arg.Export().(type) {
-		case goja.ArrayBuffer:
-			data = append(data, v.Bytes())
-			totalLen += len(v.Bytes())
-		default:
+		bz, ok := utils.GetBytes(arg)
+		if !ok {
 			panic(vm.ToValue("Unsupported type for BufConcat"))
 		}
+		data = append(data, bz)
+		totalLen += len(bz)
 	}
 
 	result := make([]byte, 0, totalLen)
 	for _, bz := range data {
 		result = append(result, bz...)
 	}
-	return vm.ToValue(vm.NewArrayBuffer(result))
+	return utils.NewBuffer(vm, result)
 }
 
 func B64ToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -43,7 +42,7 @@ func B64ToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		panic(goja.NewSymbol("error in B64ToBuf: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(data))
+	return utils.NewBuffer(vm, data)
 }
 
 func HexToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -56,7 +55,7 @@ func HexToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	}
 
 	data := gethcmn.FromHex(str)
-	return vm.ToValue(vm.NewArrayBuffer(data))
+	return utils.NewBuffer(vm, data)
 }
 
 func UTF8StrToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -68,7 +67,7 @@ func UTF8StrToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 		panic(goja.NewSymbol("The first argument must be string"))
 	}
 
-	return vm.ToValue(vm.NewArrayBuffer([]byte(str)))
+	return utils.NewBuffer(vm, []byte(str))
 }
 
 // HexToPaddingBuf encodes a hex string to a padding buffer in big-endian
@@ -92,7 +91,7 @@ func HexToPaddingBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 
 	data := gethcmn.FromHex(str)
 	paddingData := gethcmn.LeftPadBytes(data, int(n))
-	return vm.ToValue(vm.NewArrayBuffer(paddingData))
+	return utils.NewBuffer(vm, paddingData)
 }
 
 func BufToB64(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -119,7 +118,7 @@ func BufCompare(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 
 func BufReverse(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	a := utils.GetOneArrayBuffer(f)
-	return vm.ToValue(vm.NewArrayBuffer(bytesReverse(a)))
+	return utils.NewBuffer(vm, bytesReverse(a))
 }
 
 func BufToU32BE(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -136,28 +135,42 @@ func U64ToBufBE(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	u64 := utils.GetOneUint64(f)
 	var buf [8]byte
 	binary.BigEndian.PutUint64(buf[:], u64)
-	return vm.ToValue(vm.NewArrayBuffer(buf[:]))
+	return utils.NewBuffer(vm, buf[:])
 }
 
 func U64ToBufLE(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	u64 := utils.GetOneUint64(f)
 	var buf [8]byte
 	binary.LittleEndian.PutUint64(buf[:], u64)
-	return vm.ToValue(vm.NewArrayBuffer(buf[:]))
+	return utils.NewBuffer(vm, buf[:])
 }
 
 func U32ToBufBE(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	u64 := utils.GetOneUint64(f)
 	var buf [4]byte
 	binary.BigEndian.PutUint32(buf[:], uint32(u64))
-	return vm.ToValue(vm.NewArrayBuffer(buf[:]))
+	return utils.NewBuffer(vm, buf[:])
 }
 
 func U32ToBufLE(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	u64 := utils.GetOneUint64(f)
 	var buf [4]byte
 	binary.LittleEndian.PutUint32(buf[:], uint32(u64))
-	return vm.ToValue(vm.NewArrayBuffer(buf[:]))
+	return utils.NewBuffer(vm, buf[:])
+}
+
+// UseUint8Array makes the following native calls return Uint8Array instead of ArrayBuffer
+// arguments: enable bool
+func UseUint8Array(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	if len(f.Arguments) != 1 {
+		panic(utils.IncorrectArgumentCount)
+	}
+	enable, ok := f.Arguments[0].Export().(bool)
+	if !ok {
+		panic(goja.NewSymbol("The first argument must be boolean"))
+	}
+	utils.SetUint8ArrayMode(vm, enable)
+	return goja.Undefined()
 }
 
 func bytesReverse(bz []byte) []byte {
@@ -1,4 +1,7 @@
-export declare const BufConcat: (...buf: ArrayBuffer[]) => ArrayBuffer;
+// Every native accepting an ArrayBuffer also accepts a TypedArray or a DataView
+export type BufLike = ArrayBuffer | ArrayBufferView;
+
+export declare const BufConcat: (...buf: BufLike[]) => ArrayBuffer;
 export declare const B64ToBuf: (s: string) => ArrayBuffer;
 export declare const HexToBuf: (s: string) => ArrayBuffer;
 export declare const UTF8StrToBuf: (s: string) => ArrayBuffer;
@@ -14,3 +17,4 @@ export declare const U64ToBufBE:(uint64: number) => ArrayBuffer;
 export declare const U64ToBufLE:(uint64: number) => ArrayBuffer;
 export declare const U32ToBufBE:(uint32: number) => ArrayBuffer;
 export declare const U32ToBufLE:(uint32: number) => ArrayBuffer;
+export declare const UseUint8Array:(enable: boolean) => void;
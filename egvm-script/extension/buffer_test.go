@@ -208,3 +208,55 @@ func TestBufToUint(t *testing.T) {
 	require.EqualValues(t, "00002710", bufbe32Hex)
 	require.EqualValues(t, "10270000", bufle32Hex)
 }
+
+func TestBufFunctionsWithTypedArrayViews(t *testing.T) {
+	vm := setupGojaVmForBuffer()
+	_, err := vm.RunString(`
+		const bz = new Uint8Array([0, 255, 17, 0])
+		const hex1 = BufToHex(bz.subarray(1, 3))
+		const hex2 = BufToHex(new DataView(bz.buffer, 1, 2))
+		const hex3 = BufToHex(new Uint16Array(bz.buffer, 2, 1))
+		const eq = BufEqual(bz.subarray(1, 3), HexToBuf('ff11'))
+		const concat = BufConcat(bz.subarray(1, 2), new DataView(bz.buffer, 3))
+	`)
+	require.NoError(t, err)
+	require.EqualValues(t, "ff11", vm.Get("hex1").Export().(string))
+	require.EqualValues(t, "ff11", vm.Get("hex2").Export().(string))
+	require.EqualValues(t, "1100", vm.Get("hex3").Export().(string))
+	require.True(t, vm.Get("eq").Export().(bool))
+	concat := vm.Get("concat").Export().(goja.ArrayBuffer)
+	require.EqualValues(t, "ff00", gethcmn.Bytes2Hex(concat.Bytes()))
+
+	_, err = vm.RunString(`BufToHex("ff11")`)
+	require.Error(t, err)
+}
+
+func TestBufFunctionsRejectFakeViews(t *testing.T) {
+	vm := setupGojaVmForBuffer()
+	for _, script := range []string{
+		`BufToHex({buffer: new ArrayBuffer(4), byteOffset: 0, byteLength: 1e9})`,
+		`BufToHex({buffer: new ArrayBuffer(4), byteOffset: 2, byteLength: 4})`,
+		`BufToHex(Object.create(Uint8Array.prototype))`,
+		`BufToHex(Object.create(DataView.prototype))`,
+	} {
+		_, err := vm.RunString(script)
+		require.Error(t, err, script)
+	}
+}
+
+func TestUseUint8Array(t *testing.T) {
+	vm := setupGojaVmForBuffer()
+	vm.Set("UseUint8Array", UseUint8Array)
+	_, err := vm.RunString(`
+		UseUint8Array(true)
+		const u8a = HexToBuf('ff11')
+		const isU8a = u8a instanceof Uint8Array
+		const first = u8a[0]
+		UseUint8Array(false)
+		const isAb = HexToBuf('ff11') instanceof ArrayBuffer
+	`)
+	require.NoError(t, err)
+	require.True(t, vm.Get("isU8a").Export().(bool))
+	require.EqualValues(t, 255, vm.Get("first").Export().(int64))
+	require.True(t, vm.Get("isAb").Export().(bool))
+}
@@ -16,14 +16,14 @@ func ZstdDecompress(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		panic(goja.NewSymbol("error in ZstdDecompress: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func ZstdCompress(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	src := utils.GetOneArrayBuffer(f)
 	var encoder, _ = zstd.NewWriter(nil)
 	bz := encoder.EncodeAll(src, make([]byte, 0, len(src)))
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 // =================== non-deterministic =============
@@ -42,7 +42,7 @@ func GetTSC(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	tsc := gotsc.TSCOverhead()
 	var result [8]byte
 	binary.BigEndian.PutUint64(result[:], tsc)
-	return vm.ToValue(vm.NewArrayBuffer(result[:]))
+	return utils.NewBuffer(vm, result[:])
 }
 
 func GetTSCBenchStart(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -55,7 +55,7 @@ func GetTSCBenchStart(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	start := gotsc.BenchStart()
 	var result [8]byte
 	binary.BigEndian.PutUint64(result[:], start)
-	return vm.ToValue(vm.NewArrayBuffer(result[:]))
+	return utils.NewBuffer(vm, result[:])
 }
 
 func GetTSCBenchEnd(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -68,5 +68,5 @@ func GetTSCBenchEnd(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	end := gotsc.BenchEnd()
 	var result [8]byte
 	binary.BigEndian.PutUint64(result[:], end)
-	return vm.ToValue(vm.NewArrayBuffer(result[:]))
+	return utils.NewBuffer(vm, result[:])
 }
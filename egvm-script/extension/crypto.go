@@ -58,7 +58,7 @@ func AesGcmEncrypt(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		panic(goja.NewSymbol("error in AesGcmEncrypt: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func AesGcmDecrypt(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -67,7 +67,7 @@ func AesGcmDecrypt(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		return vm.ToValue([2]any{nil, false})
 	}
-	return vm.ToValue([2]any{vm.NewArrayBuffer(bz), true})
+	return vm.ToValue([2]any{utils.NewBuffer(vm, bz), true})
 }
 
 // --------- Public-Key Cryptography ---------
@@ -80,13 +80,13 @@ type PublicKey struct {
 	key *ecies.PublicKey
 }
 
-func BufToPrivateKey(buf goja.ArrayBuffer) PrivateKey {
-	key := ecies.NewPrivateKeyFromBytes(buf.Bytes())
+func BufToPrivateKey(buf goja.Value) PrivateKey {
+	key := ecies.NewPrivateKeyFromBytes(utils.MustGetBytes(buf, "first"))
 	return PrivateKey{key: key}
 }
 
-func BufToPublicKey(buf goja.ArrayBuffer) PublicKey {
-	key, _ := ecies.NewPublicKeyFromBytes(buf.Bytes())
+func BufToPublicKey(buf goja.Value) PublicKey {
+	key, _ := ecies.NewPublicKeyFromBytes(utils.MustGetBytes(buf, "first"))
 	return PublicKey{key: key}
 }
 
@@ -106,7 +106,7 @@ func (prv PrivateKey) ECDH(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		panic(goja.NewSymbol("error in ECDH: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func (prv PrivateKey) Encapsulate(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -121,7 +121,7 @@ func (prv PrivateKey) Encapsulate(f goja.FunctionCall, vm *goja.Runtime) goja.Va
 	if err != nil {
 		panic(goja.NewSymbol("error in Encapsulate: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func (prv PrivateKey) toECDSA() *ecdsa.PrivateKey {
@@ -142,7 +142,7 @@ func (prv PrivateKey) Sign(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		panic(goja.NewSymbol("error in Sign: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(sig))
+	return utils.NewBuffer(vm, sig)
 }
 
 func (prv PrivateKey) Equal(other PrivateKey) bool {
@@ -157,7 +157,7 @@ func (prv PrivateKey) Serialize(f goja.FunctionCall, vm *goja.Runtime) goja.Valu
 	if len(f.Arguments) != 0 {
 		panic(utils.IncorrectArgumentCount)
 	}
-	return vm.ToValue(vm.NewArrayBuffer(prv.key.Bytes()))
+	return utils.NewBuffer(vm, prv.key.Bytes())
 }
 
 func (prv PrivateKey) Decrypt(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -166,7 +166,7 @@ func (prv PrivateKey) Decrypt(f goja.FunctionCall, vm *goja.Runtime) goja.Value
 	if err != nil {
 		return vm.ToValue([2]any{nil, false})
 	}
-	return vm.ToValue([2]any{vm.NewArrayBuffer(bz), true})
+	return vm.ToValue([2]any{utils.NewBuffer(vm, bz), true})
 }
 
 func (pub PublicKey) Decapsulate(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -181,7 +181,7 @@ func (pub PublicKey) Decapsulate(f goja.FunctionCall, vm *goja.Runtime) goja.Val
 	if err != nil {
 		panic(goja.NewSymbol("error in Decapsulate: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func (pub PublicKey) Equal(other PublicKey) bool {
@@ -196,7 +196,7 @@ func (pub PublicKey) toBuf(f goja.FunctionCall, vm *goja.Runtime, compressed boo
 	if len(f.Arguments) != 0 {
 		panic(utils.IncorrectArgumentCount)
 	}
-	return vm.ToValue(vm.NewArrayBuffer(pub.key.Bytes(compressed)))
+	return utils.NewBuffer(vm, pub.key.Bytes(compressed))
 }
 
 func (pub PublicKey) SerializeCompressed(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -213,7 +213,7 @@ func (pub PublicKey) Encrypt(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if err != nil {
 		panic(goja.NewSymbol("error in Encrypt: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(bz))
+	return utils.NewBuffer(vm, bz)
 }
 
 func eciesEncrypt(pubkey *ecies.PublicKey, msg, entropy []byte) ([]byte, error) {
@@ -264,7 +264,7 @@ func (pub PublicKey) ToEvmAddress(f goja.FunctionCall, vm *goja.Runtime) goja.Va
 	}
 	key := pub.toECDSA()
 	addr := gethcrypto.PubkeyToAddress(*key)
-	return vm.ToValue(vm.NewArrayBuffer(addr[:]))
+	return utils.NewBuffer(vm, addr[:])
 }
 
 func (pub PublicKey) ToCashAddress(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -272,7 +272,7 @@ func (pub PublicKey) ToCashAddress(f goja.FunctionCall, vm *goja.Runtime) goja.V
 		panic(utils.IncorrectArgumentCount)
 	}
 	pubKeyHash := bchutil.Hash160(pub.key.Bytes(true))
-	return vm.ToValue(vm.NewArrayBuffer(pubKeyHash[:]))
+	return utils.NewBuffer(vm, pubKeyHash[:])
 }
 
 func (prv PrivateKey) VrfProve(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -281,7 +281,7 @@ func (prv PrivateKey) VrfProve(f goja.FunctionCall, vm *goja.Runtime) goja.Value
 	if err != nil {
 		panic(goja.NewSymbol("error in VrfProve: " + err.Error()))
 	}
-	return vm.ToValue([2]goja.ArrayBuffer{vm.NewArrayBuffer(beta), vm.NewArrayBuffer(pi)})
+	return vm.ToValue([2]goja.Value{utils.NewBuffer(vm, beta), utils.NewBuffer(vm, pi)})
 }
 
 func (pub PublicKey) VrfVerify(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -290,7 +290,7 @@ func (pub PublicKey) VrfVerify(f goja.FunctionCall, vm *goja.Runtime) goja.Value
 	if err != nil {
 		panic(goja.NewSymbol("error in VrfVerify: " + err.Error()))
 	}
-	return vm.ToValue(vm.NewArrayBuffer(beta[:]))
+	return utils.NewBuffer(vm, beta[:])
 }
 
 // --------- Signature ---------
@@ -298,7 +298,7 @@ func (pub PublicKey) VrfVerify(f goja.FunctionCall, vm *goja.Runtime) goja.Value
 func GetEthSignedMessage(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	msg := utils.GetOneArrayBuffer(f)
 	ethMsg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg[:]), msg[:])
-	return vm.ToValue(vm.NewArrayBuffer([]byte(ethMsg)))
+	return utils.NewBuffer(vm, []byte(ethMsg))
 }
 
 func VerifySignature(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -13,6 +13,7 @@ import (
 	"golang.org/x/crypto/sha3"
 
 	"github.com/smartbch/egvm/egvm-script/types"
+	"github.com/smartbch/egvm/egvm-script/utils"
 )
 
 // ===============
@@ -35,13 +36,15 @@ func hashFunc(f goja.FunctionCall, vm *goja.Runtime, h io.Writer) {
 				panic(vm.ToValue("Non-ascii string is not supported for hash"))
 			}
 			h.Write([]byte(v))
-		case goja.ArrayBuffer:
-			h.Write(v.Bytes())
 		case types.Uint256:
 			v.X.WriteToArray32(&buf)
 			h.Write(buf[:])
 		default:
-			panic(vm.ToValue("Unsupported type for hash"))
+			bz, ok := utils.GetBytes(arg)
+			if !ok {
+				panic(vm.ToValue("Unsupported type for hash"))
+			}
+			h.Write(bz)
 		}
 	}
 }
@@ -49,38 +52,38 @@ func hashFunc(f goja.FunctionCall, vm *goja.Runtime, h io.Writer) {
 func Keccak256(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	h := sha3.NewLegacyKeccak256()
 	hashFunc(f, vm, h)
-	return vm.ToValue(vm.NewArrayBuffer(h.Sum(nil)))
+	return utils.NewBuffer(vm, h.Sum(nil))
 }
 
 func Sha256(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	h := sha256.New()
 	hashFunc(f, vm, h)
-	return vm.ToValue(vm.NewArrayBuffer(h.Sum(nil)))
+	return utils.NewBuffer(vm, h.Sum(nil))
 }
 
 func Ripemd160(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	h := ripemd160.New()
 	hashFunc(f, vm, h)
-	return vm.ToValue(vm.NewArrayBuffer(h.Sum(nil)))
+	return utils.NewBuffer(vm, h.Sum(nil))
 }
 
 func XxHash32(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	h := xxh32.New32()
 	hashFunc(f, vm, h)
-	return vm.ToValue(vm.NewArrayBuffer(h.Sum(nil)))
+	return utils.NewBuffer(vm, h.Sum(nil))
 }
 
 func XxHash64(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	h := xxhash.New()
 	hashFunc(f, vm, h)
-	return vm.ToValue(vm.NewArrayBuffer(h.Sum(nil)))
+	return utils.NewBuffer(vm, h.Sum(nil))
 }
 
 func XxHash128(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	h := xxh3.New()
 	hashFunc(f, vm, h)
 	hash128 := h.Sum128().Bytes()
-	return vm.ToValue(vm.NewArrayBuffer(hash128[:]))
+	return utils.NewBuffer(vm, hash128[:])
 }
 
 func XxHash32Int(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -21,6 +21,7 @@ export * from './types/orderedbufmap';
 export * from './types/orderedintmap';
 export * from './types/orderedstrmap';
 export * from './types/s256';
+export * from './types/store';
 export * from './types/u256';
 
 
@@ -1,27 +1,37 @@
 package request
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"net/http"
+	"net"
 
 	"github.com/dop251/goja"
+	"github.com/edgelesssys/ego/attestation"
 	gethcmn "github.com/ethereum/go-ethereum/common"
 
 	"github.com/smartbch/egvm/egvm-script/enclaveutil"
 	"github.com/smartbch/egvm/egvm-script/utils"
+	"github.com/smartbch/egvm/keygrantor"
 )
 
-type attestationResult struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
-	Result  string `json:"result"`
+// EnclaveAttestation is the attested identity of an enclave server, in hex except the numbers
+type EnclaveAttestation struct {
+	PubKey          string
+	ExtraData       string
+	SignerID        string
+	UniqueID        string
+	SecurityVersion uint
+	ProductID       uint16
+	TCBStatus       string
 }
 
 // parameters: serverURL string, signerID string, uniqueID string
-// return: isSuccess bool, reason string
+// or: serverURL string, policy object, as enclaveutil.ParseReportPolicy parses
+// return: EnclaveAttestation of the keygrantor.SimpleClient serving serverURL, whose report endorses
+// its TLS certificate, pubkey and extra data. It throws if the attestation fails.
 func AttestEnclaveServer(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
-	if len(f.Arguments) != 3 {
+	if len(f.Arguments) != 2 && len(f.Arguments) != 3 {
 		panic(utils.IncorrectArgumentCount)
 	}
 
@@ -30,53 +40,60 @@ func AttestEnclaveServer(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 		panic(goja.NewSymbol("The first argument must be server URL"))
 	}
 
-	signerID, ok := f.Arguments[1].Export().(string)
-	if !ok {
-		panic(goja.NewSymbol("The second argument must be signer ID"))
-	}
-
-	uniqueID, ok := f.Arguments[2].Export().(string)
-	if !ok {
-		panic(goja.NewSymbol("The third argument must be unique ID"))
-	}
+	var policy *enclaveutil.ReportPolicy
+	if len(f.Arguments) == 2 {
+		policyObj, ok := f.Arguments[1].Export().(map[string]any)
+		if !ok {
+			panic(goja.NewSymbol("The second argument must be policy object"))
+		}
+		bz, err := json.Marshal(policyObj)
+		if err != nil {
+			panic(goja.NewSymbol("Invalid policy: " + err.Error()))
+		}
+		policy, err = enclaveutil.ParseReportPolicy(bz)
+		if err != nil {
+			panic(goja.NewSymbol("Invalid policy: " + err.Error()))
+		}
+	} else {
+		signerID, ok := f.Arguments[1].Export().(string)
+		if !ok {
+			panic(goja.NewSymbol("The second argument must be signer ID"))
+		}
 
-	// 1. get server public key
-	pubKeyResp := HttpsRequest(http.MethodGet, fmt.Sprintf("%v/pubkey", serverURL), "", "Content-Type:application/json")
-	if pubKeyResp.StatusCode != http.StatusOK {
-		panic(goja.NewSymbol(fmt.Sprintf("Error when get server pubkey: %v, body: %v", pubKeyResp.StatusCode, pubKeyResp.Body)))
+		uniqueID, ok := f.Arguments[2].Export().(string)
+		if !ok {
+			panic(goja.NewSymbol("The third argument must be unique ID"))
+		}
+		policy = enclaveutil.DefaultReportPolicy(gethcmn.FromHex(signerID), gethcmn.FromHex(uniqueID))
 	}
 
-	var pubKeyResult attestationResult
-	err := json.Unmarshal([]byte(pubKeyResp.Body), &pubKeyResult)
+	// 1. get the report, pubkey and extra data from the server presenting the certificate, which the
+	// job's network policy allows
+	dialer := &net.Dialer{Control: netPolicy.dialControl}
+	ev, err := keygrantor.GetSimpleClientEvidenceWithPolicy(serverURL, netPolicy.CheckURL, dialer.DialContext)
 	if err != nil {
-		panic(goja.NewSymbol("Failed to unmarshal pubKey response: " + err.Error()))
+		panic(goja.NewSymbol("Error when get server attestation: " + err.Error()))
 	}
 
-	// 2. get server enclave report
-	reportResp := HttpsRequest(http.MethodGet, fmt.Sprintf("%v/pubkey_report", serverURL), "", "Content-Type:application/json")
-	if reportResp.StatusCode != http.StatusOK {
-		panic(goja.NewSymbol(fmt.Sprintf("Error when get server pubkey: %v, body: %v", reportResp.StatusCode, reportResp.Body)))
-	}
-
-	var reportResult attestationResult
-	err = json.Unmarshal([]byte(reportResp.Body), &reportResult)
+	// 2. verify
+	reportData := keygrantor.SimpleReportData(ev.Cert, ev.PubKey, ev.ExtraReportData)
+	report, err := enclaveutil.VerifyEnclaveReportBz(reportData, ev.Report, policy)
 	if err != nil {
-		panic(goja.NewSymbol("Failed to unmarshal report response: " + err.Error()))
+		panic(goja.NewSymbol("Failed to verify server attestation: " + err.Error()))
 	}
+	return vm.ToValue(newEnclaveAttestation(ev, &report))
+}
 
-	// 3. verify
-	var result [2]any
-
-	pubKeyBz := gethcmn.FromHex(pubKeyResult.Result)
-	reportBz := gethcmn.FromHex(reportResult.Result)
-	signerIDBz := gethcmn.FromHex(signerID)
-	uniqueIDBz := gethcmn.FromHex(uniqueID)
-	err = enclaveutil.VerifyEnclaveReportBz(pubKeyBz, reportBz, signerIDBz, uniqueIDBz)
-	if err != nil {
-		result = [2]any{false, err.Error()}
-		return vm.ToValue(result)
+func newEnclaveAttestation(ev *keygrantor.SimpleClientEvidence, report *attestation.Report) EnclaveAttestation {
+	productID := make([]byte, 2)
+	copy(productID, report.ProductID)
+	return EnclaveAttestation{
+		PubKey:          hex.EncodeToString(ev.PubKey),
+		ExtraData:       hex.EncodeToString(ev.ExtraReportData),
+		SignerID:        hex.EncodeToString(report.SignerID),
+		UniqueID:        hex.EncodeToString(report.UniqueID),
+		SecurityVersion: report.SecurityVersion,
+		ProductID:       binary.LittleEndian.Uint16(productID),
+		TCBStatus:       report.TCBStatus.String(),
 	}
-
-	result = [2]any{true, ""}
-	return vm.ToValue(result)
 }
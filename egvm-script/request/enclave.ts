@@ -1 +1,24 @@
-export declare const AttestEnclaveServer: (url: string, signerId: string, uniqueId: string) => [boolean, string];
+export interface EnclaveAttestation {
+    PubKey: string
+    ExtraData: string
+    SignerID: string
+    UniqueID: string
+    SecurityVersion: number
+    ProductID: number
+    TCBStatus: string
+}
+
+export interface ReportPolicy {
+    signerIDs?: string[]
+    uniqueID?: string
+    productID?: number
+    minSVN?: number
+    tcbStatuses?: string[] // accepted besides "UpToDate", e.g. "SWHardeningNeeded"
+    allowDebug?: boolean
+}
+
+// the url must be allowed by the network policy of the job, as in HttpsRequest
+export declare const AttestEnclaveServer: {
+    (url: string, signerId: string, uniqueId: string): EnclaveAttestation
+    (url: string, policy: ReportPolicy): EnclaveAttestation
+};
@@ -5,13 +5,15 @@ import (
 
 	"github.com/dop251/goja"
 	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/egvm/egvm-script/types"
 )
 
 const (
 	AttestScriptTemplate = `
 		const signerID = '8c83745f1d946d0b9ab8b2233d63449f4274504fc6f67870598ef90f663187df'
 		const uniqueID = 'a30551d6f49a81fb52b74ebe6743e8ace4e141e5d89d59ea51eedcfdc74d8654'
-		const [ok, reason] = AttestEnclaveServer('https://elfincdn111.paralinker.io', signerID, uniqueID)
+		const result = AttestEnclaveServer('https://elfincdn111.paralinker.io', signerID, uniqueID)
 	`
 )
 
@@ -24,12 +26,30 @@ func setupGojaVmForEnclave() *goja.Runtime {
 // Note: test it with CGO_FLAGS and CGO_LDFLAGS
 func TestAttestEnclaveServer(t *testing.T) {
 	vm := setupGojaVmForEnclave()
-	tlsConfig, _ = loadTlsConfigForTest(TrustedCertsPathForTest)
 	_, err := vm.RunString(AttestScriptTemplate)
 	require.NoError(t, err)
 
-	ok := vm.Get("ok").Export().(bool)
-	reason := vm.Get("reason").Export().(string)
-	require.True(t, ok)
-	require.Empty(t, reason)
+	result := vm.Get("result").Export().(EnclaveAttestation)
+	require.Equal(t, "8c83745f1d946d0b9ab8b2233d63449f4274504fc6f67870598ef90f663187df", result.SignerID)
+	require.Equal(t, "a30551d6f49a81fb52b74ebe6743e8ace4e141e5d89d59ea51eedcfdc74d8654", result.UniqueID)
+	require.NotEmpty(t, result.PubKey)
+}
+
+func TestAttestEnclaveServerPolicy(t *testing.T) {
+	vm := setupGojaVmForEnclave()
+	_, err := vm.RunString(`AttestEnclaveServer('https://127.0.0.1:1', {minSVN: 2})`)
+	require.ErrorContains(t, err, "Invalid policy: the policy must have signer IDs or a unique ID")
+	_, err = vm.RunString(`AttestEnclaveServer('https://127.0.0.1:1', {signerIDs: ['aabb'], tcbStatuses: ['Fine']})`)
+	require.ErrorContains(t, err, "Invalid policy: unknown TCB status Fine")
+
+	// the job's network policy applies, too
+	_, err = vm.RunString(`AttestEnclaveServer('https://127.0.0.1:1', {signerIDs: ['aabb'], productID: 1})`)
+	require.ErrorContains(t, err, "IP 127.0.0.1 is in 127.0.0.0/8")
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{"example.com"}})
+	_, err = vm.RunString(`AttestEnclaveServer('https://127.0.0.1:1', {signerIDs: ['aabb'], productID: 1})`)
+	require.ErrorContains(t, err, "host 127.0.0.1:1 is not allowed")
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{"127.0.0.1"}, AllowPrivateIPs: true})
+	_, err = vm.RunString(`AttestEnclaveServer('https://127.0.0.1:1', {signerIDs: ['aabb'], productID: 1})`)
+	require.ErrorContains(t, err, "Error when get server attestation")
+	require.NotContains(t, err.Error(), errDestinationDenied.Error())
 }
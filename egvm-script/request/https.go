@@ -1,24 +1,38 @@
 package request
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dop251/goja"
+
+	"github.com/smartbch/egvm/egvm-script/utils"
 )
 
 var (
 	// NOTE: before calling any request functions, tlsConfig must be initialized.
 	tlsConfig *tls.Config
+
+	// MaxConnsPerHost limits the connections to each host, including the idle ones kept for reuse
+	MaxConnsPerHost = 4
+
+	// the job-scoped transport which reuses the connections, dialed with transportTLS and transportPolicy
+	transportLock   sync.Mutex
+	transport       *http.Transport
+	transportTLS    *tls.Config
+	transportPolicy *NetPolicy
 )
 
 func InitTrustedHttpsCerts(certs []string) error {
@@ -27,72 +41,282 @@ func InitTrustedHttpsCerts(certs []string) error {
 	return err
 }
 
+// getTransport returns the transport of the current job, which is created again if tlsConfig or
+// netPolicy changes
+func getTransport() *http.Transport {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport != nil && transportTLS == tlsConfig && transportPolicy == netPolicy {
+		return transport
+	}
+	if transport != nil {
+		transport.CloseIdleConnections()
+	}
+	cfg, policy := tlsConfig, netPolicy
+	netDialer := &net.Dialer{Control: policy.dialControl}
+	dialer := &tls.Dialer{NetDialer: netDialer, Config: cfg}
+	transport = &http.Transport{
+		// only for the hosts which policy allows over plain http
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := connectContext(ctx)
+			defer cancel()
+			return netDialer.DialContext(ctx, network, addr)
+		},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := connectContext(ctx)
+			defer cancel()
+			return dialer.DialContext(ctx, network, addr)
+		},
+		MaxConnsPerHost:     MaxConnsPerHost,
+		MaxIdleConnsPerHost: MaxConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	transportTLS, transportPolicy = cfg, policy
+	return transport
+}
+
+// CloseTransport closes the idle connections of the current job, so the next job does not reuse them
+func CloseTransport() {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport != nil {
+		transport.CloseIdleConnections()
+	}
+	transport, transportTLS = nil, nil
+}
+
 type HttpResponse struct {
 	Status     string
 	StatusCode int
 	Headers    [][2]string
 	Body       string
+	BodyBuf    goja.Value // the same bytes as Body, in an ArrayBuffer
+
+	body []byte
 }
 
-func HttpsRequest(method, serverURL, body string, headers ...string) HttpResponse {
-	if serverURL == "" {
-		panic(goja.NewSymbol("Empty url"))
+// parameters: method string, serverURL string, body string|ArrayBuffer, headers ...(string|[string, string][]|object),
+// {options: options object} (optional)
+// A header is a string like 'Name: Value', an array of [name, value] pairs, or an object of names to
+// values, which can also be in options.headers. The options are only recognized as the 'options' of
+// the last argument, so an object there without it is a header object, too.
+// return: HttpResponse. It throws an Error whose 'code' is one of the ErrCode* constants on failure.
+func HttpsRequest(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	args := f.Arguments
+	if len(args) < 3 {
+		panic(utils.IncorrectArgumentCount)
+	}
+	invalid := func(msg string) {
+		throwHttpError(vm, &HttpError{Code: ErrCodeInvalidRequest, Message: msg})
 	}
+	opts := DefaultRequestOptions()
+	var headers [][2]string
+	if options := getOptions(args[len(args)-1]); len(args) > 3 && options != nil {
+		var err error
+		opts, err = parseRequestOptions(vm, options)
+		if err == nil {
+			headers, err = parseHeaders(options.Get("headers"))
+		}
+		if err != nil {
+			invalid("Invalid options: " + err.Error())
+		}
+		args = args[:len(args)-1]
+	}
+	method, ok := args[0].Export().(string)
+	if !ok {
+		invalid("The method argument must be string")
+	}
+	serverURL, ok := args[1].Export().(string)
+	if !ok {
+		invalid("The url argument must be string")
+	}
+	body, ok := utils.GetBytes(args[2])
+	if !ok {
+		bodyStr, isStr := args[2].Export().(string)
+		if !isStr {
+			invalid("The body argument must be string or ArrayBuffer")
+		}
+		body = []byte(bodyStr)
+	}
+	for i, arg := range args[3:] {
+		h, err := parseHeaders(arg)
+		if err != nil {
+			invalid(fmt.Sprintf("Invalid header argument %d: %s", i+4, err.Error()))
+		}
+		headers = append(headers, h...)
+	}
+	result, herr := doHttpsRequest(method, serverURL, body, headers, opts)
+	if herr != nil {
+		throwHttpError(vm, herr)
+	}
+	result.BodyBuf = utils.NewBuffer(vm, result.body)
+	return vm.ToValue(result)
+}
 
-	req, err := newHttpRequest(method, serverURL, body, headers...)
-	if err != nil {
-		panic(goja.NewSymbol("Error in parsing http request: " + err.Error()))
+// get the options object in {options: {...}}, or nil if v is not of this form. A header object
+// cannot have it, since the values of headers are strings.
+func getOptions(v goja.Value) *goja.Object {
+	obj, ok := v.(*goja.Object)
+	if !ok || obj.ClassName() == "Array" {
+		return nil
+	}
+	if _, isBuf := utils.GetBytes(v); isBuf {
+		return nil
+	}
+	options, ok := obj.Get("options").(*goja.Object)
+	if !ok || options.ClassName() == "Array" {
+		return nil
 	}
-	// disable keepalive
-	req.Close = true
+	return options
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				conn, err := tls.Dial(network, addr, tlsConfig)
-				return conn, err
-			},
-		},
+// parse the headers in a string like 'Name: Value', an array of [name, value] pairs, or an object
+// of names to values
+func parseHeaders(v goja.Value) ([][2]string, error) {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil, nil
+	}
+	switch h := v.Export().(type) {
+	case string:
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, errors.New("Invalid header: " + h)
+		}
+		return checkHeader(name, value)
+	case []any:
+		var headers [][2]string
+		for _, item := range h {
+			pair, ok := item.([]any)
+			if !ok || len(pair) != 2 {
+				return nil, errors.New("a header must be a [name, value] pair")
+			}
+			name, ok1 := pair[0].(string)
+			value, ok2 := pair[1].(string)
+			if !ok1 || !ok2 {
+				return nil, errors.New("the name and value of a header must be strings")
+			}
+			header, err := checkHeader(name, value)
+			if err != nil {
+				return nil, err
+			}
+			headers = append(headers, header...)
+		}
+		return headers, nil
+	}
+	obj, ok := v.(*goja.Object)
+	if !ok {
+		return nil, errors.New("headers must be string, array of pairs or object")
+	}
+	var headers [][2]string
+	for _, name := range obj.Keys() {
+		value, ok := obj.Get(name).Export().(string)
+		if !ok {
+			return nil, errors.New("the value of a header must be a string")
+		}
+		header, err := checkHeader(name, value)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header...)
+	}
+	return headers, nil
+}
+
+func checkHeader(name, value string) ([][2]string, error) {
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+		return nil, errors.New("Invalid header: " + name)
 	}
+	return [][2]string{{name, value}}, nil
+}
 
-	resp, err := client.Do(&req)
+// doHttpsRequest sends the request, and retries the idempotent ones as opts allows, within
+// maxRequestTime and until the script is interrupted
+func doHttpsRequest(method, serverURL string, body []byte, headers [][2]string, opts RequestOptions) (HttpResponse, *HttpError) {
+	if serverURL == "" {
+		return HttpResponse{}, &HttpError{Code: ErrCodeInvalidRequest, Message: "Empty url"}
+	}
+	ctx, cancel := context.WithTimeout(scriptCtx, maxRequestTime)
+	defer cancel()
+	policy := netPolicy
+	client := &http.Client{Transport: getTransport(), CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if err := policy.CheckURL(req.URL); err != nil {
+			return err
+		}
+		return opts.checkRedirect(req, via)
+	}}
+	for attempt := 1; ; attempt++ {
+		result, err := sendHttpsRequest(ctx, client, method, serverURL, body, headers, opts)
+		var herr *HttpError
+		if err != nil {
+			if errors.As(err, &herr) { // not retryable
+				herr.Attempts = attempt
+				return result, herr
+			}
+			herr = newHttpError(err)
+			herr.Attempts = attempt
+		}
+		retryable := (herr != nil && (herr.Code == ErrCodeTimeout || herr.Code == ErrCodeNetwork)) ||
+			(herr == nil && isRetryableStatus(result.StatusCode))
+		if !retryable || attempt > opts.Retries || !isIdempotent(method) {
+			return result, herr
+		}
+		select {
+		case <-time.After(opts.retryDelay(attempt)):
+		case <-ctx.Done():
+			if herr == nil {
+				herr = newHttpError(ctx.Err())
+				herr.Attempts = attempt
+			}
+			return result, herr
+		}
+	}
+}
+
+// send the request once, within opts.Timeout and the lifetime of ctx
+func sendHttpsRequest(ctx context.Context, client *http.Client, method, serverURL string, body []byte, headers [][2]string, opts RequestOptions) (HttpResponse, error) {
+	req, err := newHttpRequest(method, serverURL, body, headers)
 	if err != nil {
-		panic(goja.NewSymbol("Error in sending http request: " + err.Error()))
+		return HttpResponse{}, &HttpError{Code: ErrCodeInvalidRequest, Message: "Error in parsing http request: " + err.Error()}
+	}
+	if err = netPolicy.CheckURL(req.URL); err != nil {
+		return HttpResponse{}, &HttpError{Code: ErrCodeForbidden, Message: err.Error()}
 	}
-	result, err := newHttpResponse(resp)
+	ctx, cancel := context.WithTimeout(withConnectTimeout(ctx, opts.ConnectTimeout), opts.Timeout)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		panic(goja.NewSymbol("Error in parsing http response: " + err.Error()))
+		return HttpResponse{}, err
 	}
-	return result
+	return newHttpResponse(resp, opts.MaxBodySize)
 }
 
-func newHttpRequest(method, serverURL, body string, headers ...string) (result http.Request, err error) {
-	result.Method = method
-	result.URL, err = url.Parse(serverURL)
+func newHttpRequest(method, serverURL string, body []byte, headers [][2]string) (*http.Request, error) {
+	req, err := http.NewRequest(method, serverURL, bytes.NewReader(body))
 	if err != nil {
-		return
+		return nil, err
 	}
-	result.Header = make(http.Header)
 	for _, h := range headers {
-		fields := strings.Split(h, ":")
-		if len(fields) != 2 {
-			return result, errors.New("Invalid header: " + h)
-		}
-		result.Header.Add(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]))
+		req.Header.Add(h[0], h[1])
 	}
-	result.Body = io.NopCloser(strings.NewReader(body))
-	return
+	return req, nil
 }
 
-func newHttpResponse(resp *http.Response) (result HttpResponse, err error) {
+func newHttpResponse(resp *http.Response, maxBodySize int64) (result HttpResponse, err error) {
+	defer resp.Body.Close() // the connection is reused after the body is read and closed
 	result.Status = resp.Status
 	result.StatusCode = resp.StatusCode
-	buf := new(strings.Builder)
-	_, err = io.Copy(buf, resp.Body)
+	if resp.ContentLength > maxBodySize {
+		return result, fmt.Errorf("%w: %d bytes", errBodyTooLarge, resp.ContentLength)
+	}
+	result.body, err = io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
 	if err != nil {
 		return
 	}
-	result.Body = buf.String()
+	if int64(len(result.body)) > maxBodySize {
+		return result, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, maxBodySize)
+	}
+	result.Body = string(result.body)
 	keys := make([]string, 0, len(resp.Header))
 	for k := range resp.Header {
 		keys = append(keys, k)
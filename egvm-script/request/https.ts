@@ -1,8 +1,31 @@
+// the numbers must be non-negative integers, otherwise HttpsRequest throws INVALID_REQUEST
+export interface HttpsRequestOptions {
+    connectTimeout?: number // in milliseconds, 10000 by default, at most 60000
+    timeout?: number // in milliseconds of each attempt, 30000 by default, 1 to 60000
+    maxBodySize?: number // in bytes, 8MB by default
+    retries?: number // of GET, HEAD, OPTIONS, TRACE, PUT and DELETE in any case, 0 by default
+    retryDelay?: number // in milliseconds before the first retry, doubled for the next ones
+    maxRedirects?: number // 0 returns the redirect response, 10 by default
+    headers?: Record<string, string> | Array<[string, string]>
+}
+
+// thrown by HttpsRequest, which gives up with TIMEOUT after 2 minutes of all the attempts and the
+// delays between them, or when the script is interrupted
+export interface HttpsRequestError extends Error {
+    code: 'INVALID_REQUEST' | 'TIMEOUT' | 'NETWORK' | 'BODY_TOO_LARGE' | 'TOO_MANY_REDIRECTS' | 'FORBIDDEN'
+    attempts: number
+}
+
+// a header is 'Name: Value', an array of pairs or an object of names to values; the options are only
+// taken from {options: ...} as the last argument, and any other object is a header object, e.g.
+// HttpsRequest('GET', url, '', {'Accept': 'text/plain'}, {options: {timeout: 1000}})
 export declare const HttpsRequest:
-    (method, serverURL, body: string, ...headers: string[])
+    (method, serverURL: string, body: string | ArrayBuffer | ArrayBufferView,
+     ...headersAndOptions: Array<string | Array<[string, string]> | Record<string, string> | {options: HttpsRequestOptions}>)
         => {
         Status: string
         StatusCode: number
         Headers: Array<[string, string]>
         Body: string
+        BodyBuf: ArrayBuffer // or Uint8Array in Uint8Array mode
     }
@@ -1,16 +1,26 @@
 package request
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dop251/goja"
 	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/egvm/egvm-script/types"
 )
 
 const (
@@ -79,3 +89,213 @@ func TestHttpRequest(t *testing.T) {
 	require.EqualValues(t, 200, resp.StatusCode)
 	require.EqualValues(t, `{"isSuccess":true,"message":"pong"}`, resp.Body)
 }
+
+// start a https server whose certificate is trusted by tlsConfig, and count its new connections
+func newTestHttpsServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *int32) {
+	var newConns int32
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	prevConfig := tlsConfig
+	t.Cleanup(func() { tlsConfig = prevConfig })
+	tlsConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsConfig.RootCAs.AddCert(server.Certificate())
+	t.Cleanup(CloseTransport)
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{"127.0.0.1"}, AllowPrivateIPs: true})
+	return server, &newConns
+}
+
+func useNetPolicy(t *testing.T, policy *types.NetPolicy) {
+	require.NoError(t, InitNetPolicy(policy))
+	t.Cleanup(func() { netPolicy = DefaultNetPolicy() })
+}
+
+func TestHttpRequestKeepAlive(t *testing.T) {
+	server, newConns := newTestHttpsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	})
+	vm := setupGojaVmForHttp()
+	vm.Set("url", server.URL)
+	_, err := vm.RunString(`
+		let bodies = ''
+		for (let i = 0; i < 10; i++) {
+			bodies += HttpsRequest('GET', url, '').Body
+		}
+	`)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("pong", 10), vm.Get("bodies").Export())
+	require.EqualValues(t, 1, atomic.LoadInt32(newConns))
+	require.Equal(t, MaxConnsPerHost, getTransport().MaxConnsPerHost)
+
+	// the connections are not reused by the next job
+	CloseTransport()
+	_, herr := doHttpsRequest(http.MethodGet, server.URL, nil, nil, DefaultRequestOptions())
+	require.Nil(t, herr)
+	require.EqualValues(t, 2, atomic.LoadInt32(newConns))
+
+	// nor with other trusted certificates
+	tlsConfig = tlsConfig.Clone()
+	_, herr = doHttpsRequest(http.MethodGet, server.URL, nil, nil, DefaultRequestOptions())
+	require.Nil(t, herr)
+	require.EqualValues(t, 3, atomic.LoadInt32(newConns))
+}
+
+func TestHttpRequestOptions(t *testing.T) {
+	var attempts int32
+	server, _ := newTestHttpsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/big":
+			w.Write([]byte(strings.Repeat("x", 100)))
+			return
+		case "/flaky":
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/redirect":
+			http.Redirect(w, r, "/redirect", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	vm := setupGojaVmForHttp()
+	vm.Set("url", server.URL)
+	run := func(script string) goja.Value {
+		v, err := vm.RunString(script)
+		require.NoError(t, err)
+		return v
+	}
+	// the exceptions have the code and the number of attempts
+	catch := `; try { %s } catch (e) { [e.code, e.attempts, e.message] }`
+	require.Equal(t, []any{ErrCodeTimeout, int64(1)}, run(fmt.Sprintf(catch,
+		`HttpsRequest('GET', url + '/slow', '', {options: {timeout: 50}})`)).Export().([]any)[:2])
+	require.Equal(t, "ok", run(`HttpsRequest('GET', url + '/slow', '', {options: {timeout: 1000}}).Body`).Export())
+
+	require.Equal(t, []any{ErrCodeBodyTooLarge, int64(1)}, run(fmt.Sprintf(catch,
+		`HttpsRequest('GET', url + '/big', '', {options: {maxBodySize: 99}})`)).Export().([]any)[:2])
+	require.EqualValues(t, 100, run(`HttpsRequest('GET', url + '/big', '', {options: {maxBodySize: 100}}).Body.length`).Export())
+
+	// POST is not retried
+	require.EqualValues(t, 503, run(`HttpsRequest('POST', url + '/flaky', '', {options: {retries: 5, retryDelay: 1}}).StatusCode`).Export())
+	require.EqualValues(t, 200, run(`HttpsRequest('GET', url + '/flaky', '', 'Accept:text/plain', {options: {retries: 5, retryDelay: 1}}).StatusCode`).Export())
+	require.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+	// so is the method in lower case
+	atomic.StoreInt32(&attempts, 0)
+	require.EqualValues(t, 200, run(`HttpsRequest('get', url + '/flaky', '', {options: {retries: 5, retryDelay: 1}}).StatusCode`).Export())
+	require.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+
+	require.EqualValues(t, 302, run(`HttpsRequest('GET', url + '/redirect', '', {options: {maxRedirects: 0}}).StatusCode`).Export())
+	require.Equal(t, []any{ErrCodeTooManyRedirects, int64(1)}, run(fmt.Sprintf(catch,
+		`HttpsRequest('GET', url + '/redirect', '', {options: {maxRedirects: 3}})`)).Export().([]any)[:2])
+
+	require.Equal(t, []any{ErrCodeInvalidRequest, int64(0), "INVALID_REQUEST: Invalid options: unknown option retry"},
+		run(fmt.Sprintf(catch, `HttpsRequest('GET', url, '', {options: {retry: 1}})`)).Export())
+	for _, value := range []string{`'1s'`, `'100'`, `1.5`, `NaN`, `Infinity`, `null`, `true`} {
+		require.Equal(t, []any{ErrCodeInvalidRequest, int64(0), "INVALID_REQUEST: Invalid options: option timeout is not an integer"},
+			run(fmt.Sprintf(catch, `HttpsRequest('GET', url, '', {options: {timeout: `+value+`}})`)).Export(), value)
+	}
+	require.EqualValues(t, 200, run(`HttpsRequest('GET', url, '', {options: {timeout: 1000.0}}).StatusCode`).Export())
+	for option, message := range map[string]string{
+		"timeout: 0":            "timeout is zero",
+		"timeout: 60001":        "timeout is more than 60000",
+		"connectTimeout: 60001": "connectTimeout is more than 60000",
+	} {
+		require.Equal(t, []any{ErrCodeInvalidRequest, int64(0), "INVALID_REQUEST: Invalid options: " + message},
+			run(fmt.Sprintf(catch, `HttpsRequest('GET', url, '', {options: {`+option+`}})`)).Export(), option)
+	}
+	require.Equal(t, []any{ErrCodeInvalidRequest, int64(0), "INVALID_REQUEST: Invalid header argument 4: headers must be string, array of pairs or object"},
+		run(fmt.Sprintf(catch, `HttpsRequest('GET', url, '', 1, {options: {}})`)).Export())
+
+	// a connection refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+	vm.Set("closed", "https://"+ln.Addr().String())
+	require.Equal(t, []any{ErrCodeNetwork, int64(3)}, run(fmt.Sprintf(catch,
+		`HttpsRequest('GET', closed, '', {options: {retries: 2, retryDelay: 1}})`)).Export().([]any)[:2])
+}
+
+func TestHttpRequestInterrupt(t *testing.T) {
+	server, _ := newTestHttpsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	vm := setupGojaVmForHttp()
+	vm.Set("url", server.URL)
+	// the retries would wait for 10s without the limits
+	script := `HttpsRequest('GET', url, '', {options: {retries: 10, retryDelay: 10000}})`
+
+	// all the attempts are within maxRequestTime
+	prevMaxRequestTime := maxRequestTime
+	maxRequestTime = 300 * time.Millisecond
+	defer func() { maxRequestTime = prevMaxRequestTime }()
+	start := time.Now()
+	v, err := vm.RunString(`try { ` + script + ` } catch (e) { [e.code, e.attempts] }`)
+	require.NoError(t, err)
+	require.Equal(t, []any{ErrCodeTimeout, int64(1)}, v.Export())
+	require.Less(t, time.Since(start), 2*time.Second)
+	maxRequestTime = prevMaxRequestTime
+
+	// the request stops when the script is interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	SetScriptContext(ctx)
+	defer SetScriptContext(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() {
+		cancel()
+		vm.Interrupt("time limit")
+	})
+	start = time.Now()
+	_, err = vm.RunString(`try { ` + script + ` } catch (e) {}; for (;;) {}`)
+	var interrupted *goja.InterruptedError
+	require.ErrorAs(t, err, &interrupted)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestHttpRequestBinaryAndHeaders(t *testing.T) {
+	server, _ := newTestHttpsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.Header().Set("X-Referer", r.Header.Get("Referer"))
+		w.Header().Set("X-Trace", r.Header.Get("X-Trace"))
+		w.Write(append(body, 0xff, 0x00))
+	})
+	vm := setupGojaVmForHttp()
+	vm.Set("url", server.URL)
+	_, err := vm.RunString(`
+		const body = new Uint8Array([0x80, 0x01]).buffer
+		const resp1 = HttpsRequest('POST', url, body, 'Authorization: Bearer a:b', [['Referer', 'https://a.b/c']])
+		const resp2 = HttpsRequest('POST', url, new Uint8Array([0x02]), {options: {headers: {'X-Trace': 'x:y:z'}}})
+		// an object without 'options' is a header object
+		const resp3 = HttpsRequest('GET', url, '', {'X-Trace': 'a'}, {timeout: '1'})
+		const bytes1 = Array.from(new Uint8Array(resp1.BodyBuf))
+		const bytes2 = Array.from(new Uint8Array(resp2.BodyBuf))
+	`)
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(0x80), int64(0x01), int64(0xff), int64(0)}, vm.Get("bytes1").Export())
+	require.Equal(t, []any{int64(0x02), int64(0xff), int64(0)}, vm.Get("bytes2").Export())
+	resp1 := vm.Get("resp1").Export().(HttpResponse)
+	require.Contains(t, resp1.Headers, [2]string{"X-Auth", "Bearer a:b"})
+	require.Contains(t, resp1.Headers, [2]string{"X-Referer", "https://a.b/c"})
+	resp2 := vm.Get("resp2").Export().(HttpResponse)
+	require.Contains(t, resp2.Headers, [2]string{"X-Trace", "x:y:z"})
+	resp3 := vm.Get("resp3").Export().(HttpResponse)
+	require.Contains(t, resp3.Headers, [2]string{"X-Trace", "a"})
+
+	for _, script := range []string{
+		`HttpsRequest('GET', url, '', 'no colon')`,
+		`HttpsRequest('GET', url, '', ': empty name')`,
+		`HttpsRequest('GET', url, '', [['only name']])`,
+		`HttpsRequest('GET', url, '', {options: {headers: {'Bad Name': 'v'}}})`,
+		`HttpsRequest('GET', url, 1)`,
+		`HttpsRequest('GET', url, '', {'X-Trace': 1})`,
+	} {
+		_, err = vm.RunString(script)
+		require.ErrorContains(t, err, ErrCodeInvalidRequest, script)
+	}
+}
@@ -0,0 +1,157 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/smartbch/egvm/egvm-script/types"
+)
+
+var (
+	errDestinationDenied = errors.New("destination is denied by the network policy")
+
+	// loopback, private, link-local and unspecified addresses, which are denied unless a NetPolicy
+	// sets AllowPrivateIPs
+	DefaultDeniedIPRanges = []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+	}
+)
+
+// NetPolicy is the parsed types.NetPolicy of the current job
+type NetPolicy struct {
+	allowedHosts   []hostPattern
+	deniedIPRanges []*net.IPNet
+	plainHTTPHosts []hostPattern
+}
+
+type hostPattern struct {
+	host string // lower case, with a leading "*." for the subdomains
+	port string // any port if empty
+}
+
+// the current job's policy, which is DefaultNetPolicy until InitNetPolicy
+var netPolicy = DefaultNetPolicy()
+
+// DefaultNetPolicy allows any host over https, but not the IPs in DefaultDeniedIPRanges
+func DefaultNetPolicy() *NetPolicy {
+	p, err := ParseNetPolicy(&types.NetPolicy{})
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// InitNetPolicy sets the policy of the job, or DefaultNetPolicy if it is nil
+func InitNetPolicy(policy *types.NetPolicy) error {
+	if policy == nil {
+		netPolicy = DefaultNetPolicy()
+		return nil
+	}
+	p, err := ParseNetPolicy(policy)
+	if err != nil {
+		return err
+	}
+	netPolicy = p
+	return nil
+}
+
+// ParseNetPolicy parses a policy, whose DeniedIPRanges are merged with DefaultDeniedIPRanges unless
+// it sets AllowPrivateIPs
+func ParseNetPolicy(policy *types.NetPolicy) (*NetPolicy, error) {
+	p := &NetPolicy{}
+	for _, h := range policy.AllowedHosts {
+		p.allowedHosts = append(p.allowedHosts, parseHostPattern(h))
+	}
+	for _, h := range policy.PlainHTTPHosts {
+		p.plainHTTPHosts = append(p.plainHTTPHosts, parseHostPattern(h))
+	}
+	deniedIPRanges := policy.DeniedIPRanges
+	if !policy.AllowPrivateIPs {
+		deniedIPRanges = append(append([]string{}, DefaultDeniedIPRanges...), deniedIPRanges...)
+	}
+	for _, r := range deniedIPRanges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied IP range %s: %w", r, err)
+		}
+		p.deniedIPRanges = append(p.deniedIPRanges, ipNet)
+	}
+	return p, nil
+}
+
+func parseHostPattern(s string) hostPattern {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil { // without a port
+		host, port = strings.Trim(s, "[]"), ""
+	}
+	return hostPattern{host: strings.ToLower(host), port: port}
+}
+
+func (hp hostPattern) match(host, port string) bool {
+	if hp.port != "" && hp.port != port {
+		return false
+	}
+	if strings.HasPrefix(hp.host, "*.") {
+		return strings.HasSuffix(host, hp.host[1:])
+	}
+	return hp.host == host
+}
+
+func matchHost(patterns []hostPattern, host, port string) bool {
+	for _, hp := range patterns {
+		if hp.match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL checks the scheme and host of a request, including the redirected ones
+func (p *NetPolicy) CheckURL(u *url.URL) error {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"https": "443", "http": "80"}[u.Scheme]
+	}
+	if len(p.allowedHosts) != 0 && !matchHost(p.allowedHosts, host, port) {
+		return fmt.Errorf("%w: host %s is not allowed", errDestinationDenied, u.Host)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if matchHost(p.plainHTTPHosts, host, port) {
+			return nil
+		}
+		return fmt.Errorf("%w: plain http to %s is not allowed", errDestinationDenied, u.Host)
+	default:
+		return fmt.Errorf("%w: unsupported scheme %s", errDestinationDenied, u.Scheme)
+	}
+}
+
+// CheckIP checks an IP which is about to be dialed, after the host name is resolved
+func (p *NetPolicy) CheckIP(ip net.IP) error {
+	for _, r := range p.deniedIPRanges {
+		if r.Contains(ip) {
+			return fmt.Errorf("%w: IP %s is in %s", errDestinationDenied, ip, r)
+		}
+	}
+	return nil
+}
+
+// the Control of net.Dialer, which checks the resolved address of each connection
+func (p *NetPolicy) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %s", errDestinationDenied, address)
+	}
+	return p.CheckIP(ip)
+}
@@ -0,0 +1,101 @@
+package request
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/egvm/egvm-script/types"
+)
+
+func TestNetPolicyCheck(t *testing.T) {
+	p, err := ParseNetPolicy(&types.NetPolicy{
+		AllowedHosts:   []string{"rpc.example.com", "*.example.org", "127.0.0.1:8545", "[::1]:8545"},
+		PlainHTTPHosts: []string{"127.0.0.1:8545", "::1"},
+		DeniedIPRanges: []string{"10.0.0.0/8"},
+	})
+	require.NoError(t, err)
+	for rawUrl, allowed := range map[string]bool{
+		"https://rpc.example.com/v1":   true,
+		"https://RPC.Example.com:8443": true,
+		"http://rpc.example.com":       false,
+		"https://example.com":          false,
+		"https://a.b.example.org":      true,
+		"https://example.org":          false,
+		"http://127.0.0.1:8545":        true,
+		"http://127.0.0.1:8546":        false,
+		"http://[::1]:8545":            true,
+		"ftp://rpc.example.com":        false,
+	} {
+		u, err := url.Parse(rawUrl)
+		require.NoError(t, err)
+		require.Equal(t, allowed, p.CheckURL(u) == nil, rawUrl)
+	}
+	require.ErrorIs(t, p.CheckIP(net.ParseIP("10.1.2.3")), errDestinationDenied)
+	require.NoError(t, p.CheckIP(net.ParseIP("11.1.2.3")))
+	// an explicit policy denies the default ranges, too, unless it opts out
+	require.ErrorIs(t, p.CheckIP(net.ParseIP("169.254.169.254")), errDestinationDenied)
+	require.ErrorIs(t, p.CheckIP(net.ParseIP("192.168.1.1")), errDestinationDenied)
+	p, err = ParseNetPolicy(&types.NetPolicy{DeniedIPRanges: []string{"10.0.0.0/8"}, AllowPrivateIPs: true})
+	require.NoError(t, err)
+	require.NoError(t, p.CheckIP(net.ParseIP("169.254.169.254")))
+	require.ErrorIs(t, p.CheckIP(net.ParseIP("10.1.2.3")), errDestinationDenied)
+
+	def := DefaultNetPolicy()
+	for _, ip := range []string{"127.0.0.1", "192.168.1.1", "169.254.169.254", "::1", "::ffff:10.0.0.1", "fd00::1"} {
+		require.ErrorIs(t, def.CheckIP(net.ParseIP(ip)), errDestinationDenied, ip)
+	}
+	require.NoError(t, def.CheckIP(net.ParseIP("8.8.8.8")))
+
+	_, err = ParseNetPolicy(&types.NetPolicy{DeniedIPRanges: []string{"10.0.0.0"}})
+	require.ErrorContains(t, err, "invalid denied IP range")
+}
+
+func TestHttpRequestNetPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://localhost:"+r.URL.Port()+"/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+	t.Cleanup(CloseTransport)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	vm := setupGojaVmForHttp()
+	vm.Set("url", server.URL)
+	catch := `try { HttpsRequest('POST', url + '%s', '{}'); 'ok' } catch (e) { e.code }`
+	run := func(path string) any {
+		v, err := vm.RunString(fmt.Sprintf(catch, path))
+		require.NoError(t, err)
+		return v.Export()
+	}
+
+	// by default, plain http and loopback are denied
+	require.Equal(t, ErrCodeForbidden, run(""))
+
+	// an allowed host is still denied on loopback
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{u.Host}, PlainHTTPHosts: []string{u.Host}})
+	require.Equal(t, ErrCodeForbidden, run(""))
+
+	// plain http to an explicitly allowed host
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{u.Host}, PlainHTTPHosts: []string{u.Host}, AllowPrivateIPs: true})
+	require.Equal(t, "ok", run(""))
+	// redirected to a host which is not allowed
+	require.Equal(t, ErrCodeForbidden, run("/redirect"))
+
+	// allowed, but not over plain http
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{u.Host}, AllowPrivateIPs: true})
+	require.Equal(t, ErrCodeForbidden, run(""))
+
+	// the host is allowed, but its IP is denied
+	useNetPolicy(t, &types.NetPolicy{AllowedHosts: []string{u.Host}, PlainHTTPHosts: []string{u.Host},
+		DeniedIPRanges: []string{"127.0.0.0/8"}, AllowPrivateIPs: true})
+	require.Equal(t, ErrCodeForbidden, run(""))
+}
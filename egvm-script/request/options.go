@@ -0,0 +1,214 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// The codes of HttpError, which scripts get as the 'code' of the exceptions thrown by HttpsRequest
+const (
+	ErrCodeInvalidRequest   = "INVALID_REQUEST"
+	ErrCodeTimeout          = "TIMEOUT"
+	ErrCodeNetwork          = "NETWORK"
+	ErrCodeBodyTooLarge     = "BODY_TOO_LARGE"
+	ErrCodeTooManyRedirects = "TOO_MANY_REDIRECTS"
+	ErrCodeForbidden        = "FORBIDDEN" // by the network policy of the job
+)
+
+const (
+	maxRetries    = 10
+	maxRetryDelay = 10 * time.Second
+	maxTimeout    = 60 * time.Second // of connectTimeout and timeout
+)
+
+var (
+	errTooManyRedirects = errors.New("too many redirects")
+	errBodyTooLarge     = errors.New("response body is too large")
+	errInterrupted      = errors.New("the script is interrupted")
+
+	// of all the attempts of a request and the delays between them
+	maxRequestTime = 2 * time.Minute
+
+	// the context of the running script, which is canceled when the script is interrupted
+	scriptCtx = context.Background()
+)
+
+// SetScriptContext sets the context of the script about to run, whose cancellation stops its pending
+// requests, e.g. together with vm.Interrupt, which cannot stop them
+func SetScriptContext(ctx context.Context) {
+	scriptCtx = ctx
+}
+
+// HttpError is why HttpsRequest fails, after Attempts tries
+type HttpError struct {
+	Code     string
+	Message  string
+	Attempts int
+}
+
+func (e *HttpError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// throw the error to the script as an Error with 'code' and 'attempts'
+func throwHttpError(vm *goja.Runtime, e *HttpError) {
+	obj := vm.NewGoError(e)
+	obj.Set("code", e.Code)
+	obj.Set("attempts", e.Attempts)
+	panic(obj)
+}
+
+func newHttpError(err error) *HttpError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errDestinationDenied):
+		return &HttpError{Code: ErrCodeForbidden, Message: err.Error()}
+	case errors.Is(err, errTooManyRedirects):
+		return &HttpError{Code: ErrCodeTooManyRedirects, Message: err.Error()}
+	case errors.Is(err, errBodyTooLarge):
+		return &HttpError{Code: ErrCodeBodyTooLarge, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &HttpError{Code: ErrCodeTimeout, Message: errInterrupted.Error()}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &HttpError{Code: ErrCodeTimeout, Message: err.Error()}
+	default:
+		return &HttpError{Code: ErrCodeNetwork, Message: err.Error()}
+	}
+}
+
+// RequestOptions is the 'options' of the optional last argument of HttpsRequest, whose durations
+// are in milliseconds in scripts. It can also have the headers.
+type RequestOptions struct {
+	ConnectTimeout time.Duration // to dial and finish the TLS handshake, at most maxTimeout
+	Timeout        time.Duration // of each attempt, until the whole body is read, 1ms to maxTimeout
+	MaxBodySize    int64
+	Retries        int           // of the idempotent methods, after network errors, timeouts and 429/502/503/504
+	RetryDelay     time.Duration // before the first retry, doubled for each of the next ones
+	MaxRedirects   int           // 0 returns the redirect response instead of following it
+}
+
+func DefaultRequestOptions() RequestOptions {
+	return RequestOptions{
+		ConnectTimeout: 10 * time.Second,
+		Timeout:        30 * time.Second,
+		MaxBodySize:    8 << 20,
+		RetryDelay:     200 * time.Millisecond,
+		MaxRedirects:   10,
+	}
+}
+
+// parse the options object of scripts, whose fields override the defaults
+func parseRequestOptions(vm *goja.Runtime, obj *goja.Object) (RequestOptions, error) {
+	opts := DefaultRequestOptions()
+	for _, key := range obj.Keys() {
+		if key == "headers" { // parsed by parseHeaders
+			continue
+		}
+		n, ok := optionInteger(obj.Get(key))
+		if !ok {
+			return opts, fmt.Errorf("option %s is not an integer", key)
+		}
+		if n < 0 {
+			return opts, fmt.Errorf("option %s is negative", key)
+		}
+		switch key {
+		case "connectTimeout", "timeout":
+			if n > maxTimeout.Milliseconds() {
+				return opts, fmt.Errorf("%s is more than %d", key, maxTimeout.Milliseconds())
+			}
+			if key == "connectTimeout" {
+				opts.ConnectTimeout = time.Duration(n) * time.Millisecond
+			} else if n == 0 {
+				return opts, errors.New("timeout is zero")
+			} else {
+				opts.Timeout = time.Duration(n) * time.Millisecond
+			}
+		case "maxBodySize":
+			opts.MaxBodySize = n
+		case "retries":
+			if n > maxRetries {
+				return opts, fmt.Errorf("retries is more than %d", maxRetries)
+			}
+			opts.Retries = int(n)
+		case "retryDelay":
+			opts.RetryDelay = time.Duration(n) * time.Millisecond
+		case "maxRedirects":
+			opts.MaxRedirects = int(n)
+		default:
+			return opts, fmt.Errorf("unknown option %s", key)
+		}
+	}
+	return opts, nil
+}
+
+// an option must be a number of an integer value, instead of anything ToInteger converts, e.g. '1s' to 0
+func optionInteger(v goja.Value) (int64, bool) {
+	switch n := v.Export().(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n != math.Trunc(n) || math.Abs(n) > 1<<53 { // also NaN and Infinity
+			return 0, false
+		}
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func (opts *RequestOptions) checkRedirect(req *http.Request, via []*http.Request) error {
+	if opts.MaxRedirects == 0 {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > opts.MaxRedirects {
+		return errTooManyRedirects
+	}
+	return nil
+}
+
+// the delay before the retry after the attempt, which starts from 1
+func (opts *RequestOptions) retryDelay(attempt int) time.Duration {
+	delay := opts.RetryDelay << (attempt - 1)
+	if delay > maxRetryDelay || delay < 0 {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func isIdempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+type connectTimeoutKey struct{}
+
+// the connect timeout of the request, which is shared by the requests in the job's transport
+func withConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
+func connectContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	if !ok || timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
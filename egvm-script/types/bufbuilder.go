@@ -38,5 +38,5 @@ func (b BufBuilder) ToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	if len(f.Arguments) != 0 {
 		panic(utils.IncorrectArgumentCount)
 	}
-	return vm.ToValue(vm.NewArrayBuffer([]byte(b.sb.String())))
+	return utils.NewBuffer(vm, []byte(b.sb.String()))
 }
@@ -1,5 +1,7 @@
 package types
 
+import "crypto/sha256"
+
 //go:generate msgp
 
 type LambdaJob struct {
@@ -8,6 +10,23 @@ type LambdaJob struct {
 	Config string   `msg:"config"` // script config
 	Inputs [][]byte `msg:"inputs"`
 	State  []byte   `msg:"state"` // to be resolved to orderedMap in sandbox
+	// optional, keys are derived from the script hash and this salt, see context.KeyIdentity
+	KeySalt string `msg:"key_salt"`
+	// optional, the destinations HttpsRequest can reach, see request.InitNetPolicy
+	NetPolicy *NetPolicy `msg:"net_policy"`
+}
+
+// NetPolicy restricts the destinations of the http requests of a job
+type NetPolicy struct {
+	// "host", "host:port" or "*.domain"; any host is allowed if empty
+	AllowedHosts []string `msg:"allowed_hosts"`
+	// CIDRs, e.g. "10.0.0.0/8", which are checked against the dialed IPs, besides the loopback, private
+	// and link-local ones in request.DefaultDeniedIPRanges
+	DeniedIPRanges []string `msg:"denied_ip_ranges"`
+	// the allowed hosts which can also be reached over plain http, in the same format
+	PlainHTTPHosts []string `msg:"plain_http_hosts"`
+	// do not deny request.DefaultDeniedIPRanges, e.g. to reach a local mock server in tests
+	AllowPrivateIPs bool `msg:"allow_private_ips"`
 }
 
 // todo: add error and status field
@@ -15,4 +34,10 @@ type LambdaResult struct {
 	Outputs [][]byte `msg:"outputs"`
 	State   []byte   `msg:"state"` // usually, this is the serialized result of ordered map
 	Error   string   `msg:"error"`
+	Receipt *Receipt `msg:"receipt"`
+}
+
+// ScriptHash identifies a script, e.g. in the state sealing and the receipt
+func ScriptHash(script string) [32]byte {
+	return sha256.Sum256([]byte(script))
 }
@@ -80,6 +80,30 @@ func (z *LambdaJob) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "State")
 				return
 			}
+		case "key_salt":
+			z.KeySalt, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "KeySalt")
+				return
+			}
+		case "net_policy":
+			if dc.IsNil() {
+				err = dc.ReadNil()
+				if err != nil {
+					err = msgp.WrapError(err, "NetPolicy")
+					return
+				}
+				z.NetPolicy = nil
+			} else {
+				if z.NetPolicy == nil {
+					z.NetPolicy = new(NetPolicy)
+				}
+				err = z.NetPolicy.DecodeMsg(dc)
+				if err != nil {
+					err = msgp.WrapError(err, "NetPolicy")
+					return
+				}
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -93,9 +117,9 @@ func (z *LambdaJob) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *LambdaJob) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 5
+	// map header, size 7
 	// write "script"
-	err = en.Append(0x85, 0xa6, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74)
+	err = en.Append(0x87, 0xa6, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74)
 	if err != nil {
 		return
 	}
@@ -158,15 +182,42 @@ func (z *LambdaJob) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "State")
 		return
 	}
+	// write "key_salt"
+	err = en.Append(0xa8, 0x6b, 0x65, 0x79, 0x5f, 0x73, 0x61, 0x6c, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.KeySalt)
+	if err != nil {
+		err = msgp.WrapError(err, "KeySalt")
+		return
+	}
+	// write "net_policy"
+	err = en.Append(0xaa, 0x6e, 0x65, 0x74, 0x5f, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79)
+	if err != nil {
+		return
+	}
+	if z.NetPolicy == nil {
+		err = en.WriteNil()
+		if err != nil {
+			return
+		}
+	} else {
+		err = z.NetPolicy.EncodeMsg(en)
+		if err != nil {
+			err = msgp.WrapError(err, "NetPolicy")
+			return
+		}
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *LambdaJob) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 5
+	// map header, size 7
 	// string "script"
-	o = append(o, 0x85, 0xa6, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74)
+	o = append(o, 0x87, 0xa6, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74)
 	o = msgp.AppendString(o, z.Script)
 	// string "certs"
 	o = append(o, 0xa5, 0x63, 0x65, 0x72, 0x74, 0x73)
@@ -186,6 +237,20 @@ func (z *LambdaJob) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "state"
 	o = append(o, 0xa5, 0x73, 0x74, 0x61, 0x74, 0x65)
 	o = msgp.AppendBytes(o, z.State)
+	// string "key_salt"
+	o = append(o, 0xa8, 0x6b, 0x65, 0x79, 0x5f, 0x73, 0x61, 0x6c, 0x74)
+	o = msgp.AppendString(o, z.KeySalt)
+	// string "net_policy"
+	o = append(o, 0xaa, 0x6e, 0x65, 0x74, 0x5f, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79)
+	if z.NetPolicy == nil {
+		o = msgp.AppendNil(o)
+	} else {
+		o, err = z.NetPolicy.MarshalMsg(o)
+		if err != nil {
+			err = msgp.WrapError(err, "NetPolicy")
+			return
+		}
+	}
 	return
 }
 
@@ -263,6 +328,29 @@ func (z *LambdaJob) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "State")
 				return
 			}
+		case "key_salt":
+			z.KeySalt, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeySalt")
+				return
+			}
+		case "net_policy":
+			if msgp.IsNil(bts) {
+				bts, err = msgp.ReadNilBytes(bts)
+				if err != nil {
+					return
+				}
+				z.NetPolicy = nil
+			} else {
+				if z.NetPolicy == nil {
+					z.NetPolicy = new(NetPolicy)
+				}
+				bts, err = z.NetPolicy.UnmarshalMsg(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "NetPolicy")
+					return
+				}
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -285,7 +373,12 @@ func (z *LambdaJob) Msgsize() (s int) {
 	for za0002 := range z.Inputs {
 		s += msgp.BytesPrefixSize + len(z.Inputs[za0002])
 	}
-	s += 6 + msgp.BytesPrefixSize + len(z.State)
+	s += 6 + msgp.BytesPrefixSize + len(z.State) + 9 + msgp.StringPrefixSize + len(z.KeySalt) + 11
+	if z.NetPolicy == nil {
+		s += msgp.NilSize
+	} else {
+		s += z.NetPolicy.Msgsize()
+	}
 	return
 }
 
@@ -338,6 +431,24 @@ func (z *LambdaResult) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "Error")
 				return
 			}
+		case "receipt":
+			if dc.IsNil() {
+				err = dc.ReadNil()
+				if err != nil {
+					err = msgp.WrapError(err, "Receipt")
+					return
+				}
+				z.Receipt = nil
+			} else {
+				if z.Receipt == nil {
+					z.Receipt = new(Receipt)
+				}
+				err = z.Receipt.DecodeMsg(dc)
+				if err != nil {
+					err = msgp.WrapError(err, "Receipt")
+					return
+				}
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -351,9 +462,9 @@ func (z *LambdaResult) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *LambdaResult) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 3
+	// map header, size 4
 	// write "outputs"
-	err = en.Append(0x83, 0xa7, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x73)
+	err = en.Append(0x84, 0xa7, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x73)
 	if err != nil {
 		return
 	}
@@ -389,15 +500,32 @@ func (z *LambdaResult) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "Error")
 		return
 	}
+	// write "receipt"
+	err = en.Append(0xa7, 0x72, 0x65, 0x63, 0x65, 0x69, 0x70, 0x74)
+	if err != nil {
+		return
+	}
+	if z.Receipt == nil {
+		err = en.WriteNil()
+		if err != nil {
+			return
+		}
+	} else {
+		err = z.Receipt.EncodeMsg(en)
+		if err != nil {
+			err = msgp.WrapError(err, "Receipt")
+			return
+		}
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *LambdaResult) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 3
+	// map header, size 4
 	// string "outputs"
-	o = append(o, 0x83, 0xa7, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x73)
+	o = append(o, 0x84, 0xa7, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x73)
 	o = msgp.AppendArrayHeader(o, uint32(len(z.Outputs)))
 	for za0001 := range z.Outputs {
 		o = msgp.AppendBytes(o, z.Outputs[za0001])
@@ -408,6 +536,17 @@ func (z *LambdaResult) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "error"
 	o = append(o, 0xa5, 0x65, 0x72, 0x72, 0x6f, 0x72)
 	o = msgp.AppendString(o, z.Error)
+	// string "receipt"
+	o = append(o, 0xa7, 0x72, 0x65, 0x63, 0x65, 0x69, 0x70, 0x74)
+	if z.Receipt == nil {
+		o = msgp.AppendNil(o)
+	} else {
+		o, err = z.Receipt.MarshalMsg(o)
+		if err != nil {
+			err = msgp.WrapError(err, "Receipt")
+			return
+		}
+	}
 	return
 }
 
@@ -460,6 +599,23 @@ func (z *LambdaResult) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "Error")
 				return
 			}
+		case "receipt":
+			if msgp.IsNil(bts) {
+				bts, err = msgp.ReadNilBytes(bts)
+				if err != nil {
+					return
+				}
+				z.Receipt = nil
+			} else {
+				if z.Receipt == nil {
+					z.Receipt = new(Receipt)
+				}
+				bts, err = z.Receipt.UnmarshalMsg(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Receipt")
+					return
+				}
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -478,6 +634,309 @@ func (z *LambdaResult) Msgsize() (s int) {
 	for za0001 := range z.Outputs {
 		s += msgp.BytesPrefixSize + len(z.Outputs[za0001])
 	}
-	s += 6 + msgp.BytesPrefixSize + len(z.State) + 6 + msgp.StringPrefixSize + len(z.Error)
+	s += 6 + msgp.BytesPrefixSize + len(z.State) + 6 + msgp.StringPrefixSize + len(z.Error) + 8
+	if z.Receipt == nil {
+		s += msgp.NilSize
+	} else {
+		s += z.Receipt.Msgsize()
+	}
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *NetPolicy) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "allowed_hosts":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "AllowedHosts")
+				return
+			}
+			if cap(z.AllowedHosts) >= int(zb0002) {
+				z.AllowedHosts = (z.AllowedHosts)[:zb0002]
+			} else {
+				z.AllowedHosts = make([]string, zb0002)
+			}
+			for za0001 := range z.AllowedHosts {
+				z.AllowedHosts[za0001], err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "AllowedHosts", za0001)
+					return
+				}
+			}
+		case "denied_ip_ranges":
+			var zb0003 uint32
+			zb0003, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "DeniedIPRanges")
+				return
+			}
+			if cap(z.DeniedIPRanges) >= int(zb0003) {
+				z.DeniedIPRanges = (z.DeniedIPRanges)[:zb0003]
+			} else {
+				z.DeniedIPRanges = make([]string, zb0003)
+			}
+			for za0002 := range z.DeniedIPRanges {
+				z.DeniedIPRanges[za0002], err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "DeniedIPRanges", za0002)
+					return
+				}
+			}
+		case "plain_http_hosts":
+			var zb0004 uint32
+			zb0004, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "PlainHTTPHosts")
+				return
+			}
+			if cap(z.PlainHTTPHosts) >= int(zb0004) {
+				z.PlainHTTPHosts = (z.PlainHTTPHosts)[:zb0004]
+			} else {
+				z.PlainHTTPHosts = make([]string, zb0004)
+			}
+			for za0003 := range z.PlainHTTPHosts {
+				z.PlainHTTPHosts[za0003], err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "PlainHTTPHosts", za0003)
+					return
+				}
+			}
+		case "allow_private_ips":
+			z.AllowPrivateIPs, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "AllowPrivateIPs")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *NetPolicy) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 4
+	// write "allowed_hosts"
+	err = en.Append(0x84, 0xad, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x5f, 0x68, 0x6f, 0x73, 0x74, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.AllowedHosts)))
+	if err != nil {
+		err = msgp.WrapError(err, "AllowedHosts")
+		return
+	}
+	for za0001 := range z.AllowedHosts {
+		err = en.WriteString(z.AllowedHosts[za0001])
+		if err != nil {
+			err = msgp.WrapError(err, "AllowedHosts", za0001)
+			return
+		}
+	}
+	// write "denied_ip_ranges"
+	err = en.Append(0xb0, 0x64, 0x65, 0x6e, 0x69, 0x65, 0x64, 0x5f, 0x69, 0x70, 0x5f, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.DeniedIPRanges)))
+	if err != nil {
+		err = msgp.WrapError(err, "DeniedIPRanges")
+		return
+	}
+	for za0002 := range z.DeniedIPRanges {
+		err = en.WriteString(z.DeniedIPRanges[za0002])
+		if err != nil {
+			err = msgp.WrapError(err, "DeniedIPRanges", za0002)
+			return
+		}
+	}
+	// write "plain_http_hosts"
+	err = en.Append(0xb0, 0x70, 0x6c, 0x61, 0x69, 0x6e, 0x5f, 0x68, 0x74, 0x74, 0x70, 0x5f, 0x68, 0x6f, 0x73, 0x74, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.PlainHTTPHosts)))
+	if err != nil {
+		err = msgp.WrapError(err, "PlainHTTPHosts")
+		return
+	}
+	for za0003 := range z.PlainHTTPHosts {
+		err = en.WriteString(z.PlainHTTPHosts[za0003])
+		if err != nil {
+			err = msgp.WrapError(err, "PlainHTTPHosts", za0003)
+			return
+		}
+	}
+	// write "allow_private_ips"
+	err = en.Append(0xb1, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x5f, 0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x5f, 0x69, 0x70, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.AllowPrivateIPs)
+	if err != nil {
+		err = msgp.WrapError(err, "AllowPrivateIPs")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *NetPolicy) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 4
+	// string "allowed_hosts"
+	o = append(o, 0x84, 0xad, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x5f, 0x68, 0x6f, 0x73, 0x74, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.AllowedHosts)))
+	for za0001 := range z.AllowedHosts {
+		o = msgp.AppendString(o, z.AllowedHosts[za0001])
+	}
+	// string "denied_ip_ranges"
+	o = append(o, 0xb0, 0x64, 0x65, 0x6e, 0x69, 0x65, 0x64, 0x5f, 0x69, 0x70, 0x5f, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.DeniedIPRanges)))
+	for za0002 := range z.DeniedIPRanges {
+		o = msgp.AppendString(o, z.DeniedIPRanges[za0002])
+	}
+	// string "plain_http_hosts"
+	o = append(o, 0xb0, 0x70, 0x6c, 0x61, 0x69, 0x6e, 0x5f, 0x68, 0x74, 0x74, 0x70, 0x5f, 0x68, 0x6f, 0x73, 0x74, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.PlainHTTPHosts)))
+	for za0003 := range z.PlainHTTPHosts {
+		o = msgp.AppendString(o, z.PlainHTTPHosts[za0003])
+	}
+	// string "allow_private_ips"
+	o = append(o, 0xb1, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x5f, 0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x5f, 0x69, 0x70, 0x73)
+	o = msgp.AppendBool(o, z.AllowPrivateIPs)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *NetPolicy) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "allowed_hosts":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "AllowedHosts")
+				return
+			}
+			if cap(z.AllowedHosts) >= int(zb0002) {
+				z.AllowedHosts = (z.AllowedHosts)[:zb0002]
+			} else {
+				z.AllowedHosts = make([]string, zb0002)
+			}
+			for za0001 := range z.AllowedHosts {
+				z.AllowedHosts[za0001], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "AllowedHosts", za0001)
+					return
+				}
+			}
+		case "denied_ip_ranges":
+			var zb0003 uint32
+			zb0003, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "DeniedIPRanges")
+				return
+			}
+			if cap(z.DeniedIPRanges) >= int(zb0003) {
+				z.DeniedIPRanges = (z.DeniedIPRanges)[:zb0003]
+			} else {
+				z.DeniedIPRanges = make([]string, zb0003)
+			}
+			for za0002 := range z.DeniedIPRanges {
+				z.DeniedIPRanges[za0002], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "DeniedIPRanges", za0002)
+					return
+				}
+			}
+		case "plain_http_hosts":
+			var zb0004 uint32
+			zb0004, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "PlainHTTPHosts")
+				return
+			}
+			if cap(z.PlainHTTPHosts) >= int(zb0004) {
+				z.PlainHTTPHosts = (z.PlainHTTPHosts)[:zb0004]
+			} else {
+				z.PlainHTTPHosts = make([]string, zb0004)
+			}
+			for za0003 := range z.PlainHTTPHosts {
+				z.PlainHTTPHosts[za0003], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "PlainHTTPHosts", za0003)
+					return
+				}
+			}
+		case "allow_private_ips":
+			z.AllowPrivateIPs, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "AllowPrivateIPs")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *NetPolicy) Msgsize() (s int) {
+	s = 1 + 14 + msgp.ArrayHeaderSize
+	for za0001 := range z.AllowedHosts {
+		s += msgp.StringPrefixSize + len(z.AllowedHosts[za0001])
+	}
+	s += 17 + msgp.ArrayHeaderSize
+	for za0002 := range z.DeniedIPRanges {
+		s += msgp.StringPrefixSize + len(z.DeniedIPRanges[za0002])
+	}
+	s += 17 + msgp.ArrayHeaderSize
+	for za0003 := range z.PlainHTTPHosts {
+		s += msgp.StringPrefixSize + len(z.PlainHTTPHosts[za0003])
+	}
+	s += 18 + msgp.BoolSize
 	return
 }
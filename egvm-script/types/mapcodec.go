@@ -24,6 +24,12 @@ func SerializeMaps(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 			totalSize += 2 + v.estimatedSize
 		case OrderedBufMap:
 			totalSize += 2 + v.estimatedSize
+		case *OrderedIntMap: // maps from Store
+			totalSize += 2 + v.estimatedSize
+		case *OrderedStrMap:
+			totalSize += 2 + v.estimatedSize
+		case *OrderedBufMap:
+			totalSize += 2 + v.estimatedSize
 		default:
 			panic(vm.ToValue("Unsupported type for EncodeMaps"))
 		}
@@ -42,9 +48,18 @@ func SerializeMaps(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 		case OrderedBufMap:
 			b = msgp.AppendByte(b, OrderedBufMapTag)
 			b = v.dumpTo(b)
+		case *OrderedIntMap:
+			b = msgp.AppendByte(b, OrderedIntMapTag)
+			b = v.dumpTo(b)
+		case *OrderedStrMap:
+			b = msgp.AppendByte(b, OrderedStrMapTag)
+			b = v.dumpTo(b)
+		case *OrderedBufMap:
+			b = msgp.AppendByte(b, OrderedBufMapTag)
+			b = v.dumpTo(b)
 		}
 	}
-	return vm.ToValue(vm.NewArrayBuffer(b))
+	return utils.NewBuffer(vm, b)
 }
 
 // Note: Each call deserializes only one map and returns the rest of the array buffer
@@ -54,12 +69,11 @@ func DeserializeMap(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 		panic(utils.IncorrectArgumentCount)
 	}
 
-	buf, ok := f.Arguments[0].Export().(goja.ArrayBuffer)
+	b, ok := utils.GetBytes(f.Arguments[0])
 	if !ok {
 		panic(goja.NewSymbol("The first argument must be ArrayBuffer"))
 	}
 
-	b := buf.Bytes()
 	if len(b) == 0 {
 		panic(goja.NewSymbol("Empty map bytes"))
 	}
@@ -102,7 +116,7 @@ func DeserializeMap(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	}
 
 	var result [2]any
-	result = [2]any{mv, vm.NewArrayBuffer(b)}
+	result = [2]any{mv, utils.NewBuffer(vm, b)}
 	return vm.ToValue(result)
 }
 
@@ -115,12 +129,11 @@ func NewOrderedMapReader(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 		panic(utils.IncorrectArgumentCount)
 	}
 
-	buf, ok := f.Arguments[0].Export().(goja.ArrayBuffer)
+	b, ok := utils.GetBytes(f.Arguments[0])
 	if !ok {
 		panic(goja.NewSymbol("The first argument must be ArrayBuffer"))
 	}
 
-	b := buf.Bytes()
 	if len(b) == 0 {
 		panic(goja.NewSymbol("Empty map bytes"))
 	}
@@ -27,7 +27,7 @@ func (iter OrderedBufMapIter) Next(f goja.FunctionCall, vm *goja.Runtime) goja.V
 	if err != nil {
 		result = [2]any{"", nil}
 	} else {
-		result = [2]any{k, vm.NewArrayBuffer(v)}
+		result = [2]any{k, utils.NewBuffer(vm, v)}
 	}
 	return vm.ToValue(result)
 }
@@ -41,7 +41,7 @@ func (iter OrderedBufMapIter) Prev(f goja.FunctionCall, vm *goja.Runtime) goja.V
 	if err != nil {
 		result = [2]any{"", nil}
 	} else {
-		result = [2]any{k, vm.NewArrayBuffer(v)}
+		result = [2]any{k, utils.NewBuffer(vm, v)}
 	}
 	return vm.ToValue(result)
 }
@@ -119,19 +119,19 @@ func (m *OrderedBufMap) Get(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 		panic(goja.NewSymbol("The first argument must be string"))
 	}
 	v, ok := m.tree.Get(k)
-	return vm.ToValue([2]any{vm.NewArrayBuffer(v), ok})
+	return vm.ToValue([2]any{utils.NewBuffer(vm, v), ok})
 }
 
 func (m *OrderedBufMap) Len() int {
 	return m.tree.Len()
 }
 
-func (m *OrderedBufMap) Set(k string, buf goja.ArrayBuffer) {
+func (m *OrderedBufMap) Set(k string, buf goja.Value) {
 	if len(k) == 0 {
 		panic(utils.EmptyKeyString)
 	}
 
-	v := buf.Bytes()
+	v := append([]byte{}, utils.MustGetBytes(buf, "second")...)
 	m.tree.Put(k, func(oldV []byte, exists bool) (newV []byte, write bool) {
 		if exists {
 			m.estimatedSize += len(v) - len(oldV)
@@ -0,0 +1,140 @@
+package types
+
+//go:generate msgp
+
+import (
+	"bytes"
+	"errors"
+
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// ReceiptDigestTag prefixes the digest signed by receipts, so the signature cannot be taken as
+// one over another message
+const ReceiptDigestTag = "egvm.receipt.v1"
+
+var (
+	ErrReceiptSigMismatch  = errors.New("receipt signature does not match its pubkey")
+	ErrReceiptHashMismatch = errors.New("receipt does not match the job and result")
+	ErrReceiptSigner       = errors.New("receipt is not signed by the expected key")
+)
+
+// Receipt attests that Outputs and the new State came from running a script over some inputs.
+// Signature is [R || S || V] (V is 0 or 1) over Digest() by the receipt key of the job, which the
+// script itself cannot reach, and Report is an optional attestation report whose data is
+// sha256(PubKey). A failed run has no receipt.
+type Receipt struct {
+	ScriptHash    [32]byte `msg:"script_hash"`
+	ConfigHash    [32]byte `msg:"config_hash"`
+	InputsHash    [32]byte `msg:"inputs_hash"`
+	PrevStateHash [32]byte `msg:"prev_state_hash"`
+	OutputsHash   [32]byte `msg:"outputs_hash"`
+	NewStateHash  [32]byte `msg:"new_state_hash"`
+	PubKey        []byte   `msg:"pubkey"` // compressed secp256k1 public key
+	Signature     []byte   `msg:"sig"`
+	Report        []byte   `msg:"report"`
+}
+
+// Keccak256 of a byte string, as keccak256(bytes) in solidity
+func HashBytes(bz []byte) (h [32]byte) {
+	copy(h[:], gethcrypto.Keccak256(bz))
+	return
+}
+
+// Keccak256 of the concatenated keccak256 of each buffer, as
+// keccak256(abi.encodePacked(keccak256(b0), keccak256(b1), ...)) in solidity
+func HashBufList(bufs [][]byte) (h [32]byte) {
+	hashes := make([]byte, 0, 32*len(bufs))
+	for _, b := range bufs {
+		hashes = append(hashes, gethcrypto.Keccak256(b)...)
+	}
+	copy(h[:], gethcrypto.Keccak256(hashes))
+	return
+}
+
+// NewReceipt fills the hashes of a receipt. script and config are from the job, and prevState
+// and newState are exactly the bytes in LambdaJob.State and LambdaResult.State.
+func NewReceipt(scriptHash [32]byte, config string, inputs [][]byte, prevState []byte,
+	outputs [][]byte, newState []byte) *Receipt {
+	return &Receipt{
+		ScriptHash:    scriptHash,
+		ConfigHash:    HashBytes([]byte(config)),
+		InputsHash:    HashBufList(inputs),
+		PrevStateHash: HashBytes(prevState),
+		OutputsHash:   HashBufList(outputs),
+		NewStateHash:  HashBytes(newState),
+	}
+}
+
+// Digest is keccak256(abi.encodePacked("egvm.receipt.v1", scriptHash, configHash, inputsHash,
+// prevStateHash, outputsHash, newStateHash)), which is the message signed by the receipt
+func (r *Receipt) Digest() []byte {
+	return gethcrypto.Keccak256([]byte(ReceiptDigestTag), r.ScriptHash[:], r.ConfigHash[:], r.InputsHash[:],
+		r.PrevStateHash[:], r.OutputsHash[:], r.NewStateHash[:])
+}
+
+// Verify checks the signature against PubKey. The caller must still decide whether PubKey
+// is trustworthy, e.g. by checking Report or comparing it with a known key.
+func (r *Receipt) Verify() error {
+	if len(r.Signature) != 65 || len(r.PubKey) != 33 {
+		return ErrReceiptSigMismatch
+	}
+	if !gethcrypto.VerifySignature(r.PubKey, r.Digest(), r.Signature[:64]) {
+		return ErrReceiptSigMismatch
+	}
+	return nil
+}
+
+// VerifyReceipt checks the receipt of a result against its job and the expected signer
+func VerifyReceipt(job *LambdaJob, result *LambdaResult, expectedPubKey []byte) error {
+	r := result.Receipt
+	if r == nil {
+		return errors.New("no receipt in result")
+	}
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	if len(expectedPubKey) != 0 && !bytes.Equal(expectedPubKey, r.PubKey) {
+		return ErrReceiptSigner
+	}
+	expected := NewReceipt(r.ScriptHash, job.Config, job.Inputs, job.State, result.Outputs, result.State)
+	if expected.ScriptHash != ScriptHash(job.Script) || !bytes.Equal(expected.Digest(), r.Digest()) {
+		return ErrReceiptHashMismatch
+	}
+	return nil
+}
+
+// SignerAddress returns the EVM address of PubKey, which solidity's ecrecover returns
+func (r *Receipt) SignerAddress() ([20]byte, error) {
+	pubKey, err := gethcrypto.DecompressPubkey(r.PubKey)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return gethcrypto.PubkeyToAddress(*pubKey), nil
+}
+
+// EncodeABI returns abi.encode(bytes32 scriptHash, bytes32 configHash, bytes32 inputsHash,
+// bytes32 prevStateHash, bytes32 outputsHash, bytes32 newStateHash, address signer, uint8 v,
+// bytes32 r, bytes32 s), which can be checked with ecrecover in solidity (v is 27 or 28)
+func (r *Receipt) EncodeABI() ([]byte, error) {
+	if len(r.Signature) != 65 {
+		return nil, ErrReceiptSigMismatch
+	}
+	signer, err := r.SignerAddress()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 32*10)
+	out = append(out, r.ScriptHash[:]...)
+	out = append(out, r.ConfigHash[:]...)
+	out = append(out, r.InputsHash[:]...)
+	out = append(out, r.PrevStateHash[:]...)
+	out = append(out, r.OutputsHash[:]...)
+	out = append(out, r.NewStateHash[:]...)
+	out = append(out, make([]byte, 12)...)
+	out = append(out, signer[:]...)
+	out = append(out, make([]byte, 31)...)
+	out = append(out, r.Signature[64]+27)
+	out = append(out, r.Signature[:64]...)
+	return out, nil
+}
@@ -0,0 +1,310 @@
+package types
+
+// Code generated by github.com/tinylib/msgp DO NOT EDIT.
+
+import (
+	"github.com/tinylib/msgp/msgp"
+)
+
+// DecodeMsg implements msgp.Decodable
+func (z *Receipt) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "script_hash":
+			err = dc.ReadExactBytes((z.ScriptHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "ScriptHash")
+				return
+			}
+		case "config_hash":
+			err = dc.ReadExactBytes((z.ConfigHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "ConfigHash")
+				return
+			}
+		case "inputs_hash":
+			err = dc.ReadExactBytes((z.InputsHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "InputsHash")
+				return
+			}
+		case "prev_state_hash":
+			err = dc.ReadExactBytes((z.PrevStateHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "PrevStateHash")
+				return
+			}
+		case "outputs_hash":
+			err = dc.ReadExactBytes((z.OutputsHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "OutputsHash")
+				return
+			}
+		case "new_state_hash":
+			err = dc.ReadExactBytes((z.NewStateHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "NewStateHash")
+				return
+			}
+		case "pubkey":
+			z.PubKey, err = dc.ReadBytes(z.PubKey)
+			if err != nil {
+				err = msgp.WrapError(err, "PubKey")
+				return
+			}
+		case "sig":
+			z.Signature, err = dc.ReadBytes(z.Signature)
+			if err != nil {
+				err = msgp.WrapError(err, "Signature")
+				return
+			}
+		case "report":
+			z.Report, err = dc.ReadBytes(z.Report)
+			if err != nil {
+				err = msgp.WrapError(err, "Report")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *Receipt) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 9
+	// write "script_hash"
+	err = en.Append(0x89, 0xab, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes((z.ScriptHash)[:])
+	if err != nil {
+		err = msgp.WrapError(err, "ScriptHash")
+		return
+	}
+	// write "config_hash"
+	err = en.Append(0xab, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes((z.ConfigHash)[:])
+	if err != nil {
+		err = msgp.WrapError(err, "ConfigHash")
+		return
+	}
+	// write "inputs_hash"
+	err = en.Append(0xab, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x73, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes((z.InputsHash)[:])
+	if err != nil {
+		err = msgp.WrapError(err, "InputsHash")
+		return
+	}
+	// write "prev_state_hash"
+	err = en.Append(0xaf, 0x70, 0x72, 0x65, 0x76, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x65, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes((z.PrevStateHash)[:])
+	if err != nil {
+		err = msgp.WrapError(err, "PrevStateHash")
+		return
+	}
+	// write "outputs_hash"
+	err = en.Append(0xac, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x73, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes((z.OutputsHash)[:])
+	if err != nil {
+		err = msgp.WrapError(err, "OutputsHash")
+		return
+	}
+	// write "new_state_hash"
+	err = en.Append(0xae, 0x6e, 0x65, 0x77, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x65, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes((z.NewStateHash)[:])
+	if err != nil {
+		err = msgp.WrapError(err, "NewStateHash")
+		return
+	}
+	// write "pubkey"
+	err = en.Append(0xa6, 0x70, 0x75, 0x62, 0x6b, 0x65, 0x79)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.PubKey)
+	if err != nil {
+		err = msgp.WrapError(err, "PubKey")
+		return
+	}
+	// write "sig"
+	err = en.Append(0xa3, 0x73, 0x69, 0x67)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.Signature)
+	if err != nil {
+		err = msgp.WrapError(err, "Signature")
+		return
+	}
+	// write "report"
+	err = en.Append(0xa6, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.Report)
+	if err != nil {
+		err = msgp.WrapError(err, "Report")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *Receipt) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 9
+	// string "script_hash"
+	o = append(o, 0x89, 0xab, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	o = msgp.AppendBytes(o, (z.ScriptHash)[:])
+	// string "config_hash"
+	o = append(o, 0xab, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	o = msgp.AppendBytes(o, (z.ConfigHash)[:])
+	// string "inputs_hash"
+	o = append(o, 0xab, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x73, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	o = msgp.AppendBytes(o, (z.InputsHash)[:])
+	// string "prev_state_hash"
+	o = append(o, 0xaf, 0x70, 0x72, 0x65, 0x76, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x65, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	o = msgp.AppendBytes(o, (z.PrevStateHash)[:])
+	// string "outputs_hash"
+	o = append(o, 0xac, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x73, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	o = msgp.AppendBytes(o, (z.OutputsHash)[:])
+	// string "new_state_hash"
+	o = append(o, 0xae, 0x6e, 0x65, 0x77, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x65, 0x5f, 0x68, 0x61, 0x73, 0x68)
+	o = msgp.AppendBytes(o, (z.NewStateHash)[:])
+	// string "pubkey"
+	o = append(o, 0xa6, 0x70, 0x75, 0x62, 0x6b, 0x65, 0x79)
+	o = msgp.AppendBytes(o, z.PubKey)
+	// string "sig"
+	o = append(o, 0xa3, 0x73, 0x69, 0x67)
+	o = msgp.AppendBytes(o, z.Signature)
+	// string "report"
+	o = append(o, 0xa6, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74)
+	o = msgp.AppendBytes(o, z.Report)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *Receipt) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "script_hash":
+			bts, err = msgp.ReadExactBytes(bts, (z.ScriptHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "ScriptHash")
+				return
+			}
+		case "config_hash":
+			bts, err = msgp.ReadExactBytes(bts, (z.ConfigHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "ConfigHash")
+				return
+			}
+		case "inputs_hash":
+			bts, err = msgp.ReadExactBytes(bts, (z.InputsHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "InputsHash")
+				return
+			}
+		case "prev_state_hash":
+			bts, err = msgp.ReadExactBytes(bts, (z.PrevStateHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "PrevStateHash")
+				return
+			}
+		case "outputs_hash":
+			bts, err = msgp.ReadExactBytes(bts, (z.OutputsHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "OutputsHash")
+				return
+			}
+		case "new_state_hash":
+			bts, err = msgp.ReadExactBytes(bts, (z.NewStateHash)[:])
+			if err != nil {
+				err = msgp.WrapError(err, "NewStateHash")
+				return
+			}
+		case "pubkey":
+			z.PubKey, bts, err = msgp.ReadBytesBytes(bts, z.PubKey)
+			if err != nil {
+				err = msgp.WrapError(err, "PubKey")
+				return
+			}
+		case "sig":
+			z.Signature, bts, err = msgp.ReadBytesBytes(bts, z.Signature)
+			if err != nil {
+				err = msgp.WrapError(err, "Signature")
+				return
+			}
+		case "report":
+			z.Report, bts, err = msgp.ReadBytesBytes(bts, z.Report)
+			if err != nil {
+				err = msgp.WrapError(err, "Report")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *Receipt) Msgsize() (s int) {
+	s = 1 + 12 + msgp.ArrayHeaderSize + (32 * (msgp.ByteSize)) + 12 + msgp.ArrayHeaderSize + (32 * (msgp.ByteSize)) + 12 + msgp.ArrayHeaderSize + (32 * (msgp.ByteSize)) + 16 + msgp.ArrayHeaderSize + (32 * (msgp.ByteSize)) + 13 + msgp.ArrayHeaderSize + (32 * (msgp.ByteSize)) + 15 + msgp.ArrayHeaderSize + (32 * (msgp.ByteSize)) + 7 + msgp.BytesPrefixSize + len(z.PubKey) + 4 + msgp.BytesPrefixSize + len(z.Signature) + 7 + msgp.BytesPrefixSize + len(z.Report)
+	return
+}
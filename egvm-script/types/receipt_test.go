@@ -0,0 +1,106 @@
+package types
+
+import (
+	"crypto/sha256"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func newSignedTestReceipt(t *testing.T, job *LambdaJob, result *LambdaResult) []byte {
+	seed := sha256.Sum256([]byte("receipt test"))
+	prv, err := gethcrypto.ToECDSA(seed[:])
+	require.NoError(t, err)
+	r := NewReceipt(ScriptHash(job.Script), job.Config, job.Inputs, job.State, result.Outputs, result.State)
+	r.Signature, err = gethcrypto.Sign(r.Digest(), prv)
+	require.NoError(t, err)
+	r.PubKey = gethcrypto.CompressPubkey(&prv.PublicKey)
+	result.Receipt = r
+	return r.PubKey
+}
+
+func TestVerifyReceipt(t *testing.T) {
+	job := &LambdaJob{Script: "let a = 1", Config: "cfg", Inputs: [][]byte{{1}, {2, 3}}, State: []byte{4}}
+	result := &LambdaResult{Outputs: [][]byte{{5}}, State: []byte{6}}
+	pubKey := newSignedTestReceipt(t, job, result)
+	require.NoError(t, VerifyReceipt(job, result, pubKey))
+
+	// survives msgp encoding
+	bz, err := result.MarshalMsg(nil)
+	require.NoError(t, err)
+	var decoded LambdaResult
+	_, err = decoded.UnmarshalMsg(bz)
+	require.NoError(t, err)
+	require.NoError(t, VerifyReceipt(job, &decoded, pubKey))
+
+	require.ErrorIs(t, VerifyReceipt(job, result, make([]byte, 33)), ErrReceiptSigner)
+	result.Outputs[0][0] = 7
+	require.ErrorIs(t, VerifyReceipt(job, result, pubKey), ErrReceiptHashMismatch)
+	result.Outputs[0][0] = 5
+	job.Script = "let a = 2"
+	require.ErrorIs(t, VerifyReceipt(job, result, pubKey), ErrReceiptHashMismatch)
+	result.Receipt.Signature[0] ^= 1
+	require.ErrorIs(t, result.Receipt.Verify(), ErrReceiptSigMismatch)
+}
+
+func TestReceiptEncodeABI(t *testing.T) {
+	job := &LambdaJob{Script: "let a = 1"}
+	result := &LambdaResult{}
+	newSignedTestReceipt(t, job, result)
+	r := result.Receipt
+	bz, err := r.EncodeABI()
+	require.NoError(t, err)
+	require.Len(t, bz, 320)
+
+	// recover the signer as solidity's ecrecover(digest, v, r, s) does, with the digest
+	// keccak256(abi.encodePacked("egvm.receipt.v1", the first 6 words))
+	digest := gethcrypto.Keccak256([]byte("egvm.receipt.v1"), bz[:192])
+	require.Equal(t, r.Digest(), digest)
+	sig := append(append([]byte{}, bz[256:320]...), bz[255]-27)
+	recovered, err := gethcrypto.SigToPub(digest, sig)
+	require.NoError(t, err)
+	signer, err := r.SignerAddress()
+	require.NoError(t, err)
+	require.Equal(t, signer, [20]byte(gethcrypto.PubkeyToAddress(*recovered)))
+	require.Equal(t, signer[:], bz[204:224])
+}
+
+// the digest of the solidity verifier in examples/receipt, rebuilt from its source over the words
+// of EncodeABI, must be Digest
+func TestReceiptDigestInSolidity(t *testing.T) {
+	sol, err := os.ReadFile("../../examples/receipt/EGVMReceipt.sol")
+	require.NoError(t, err)
+	var fields []string
+	for _, m := range regexp.MustCompile(`(?s)struct Receipt \{(.*?)\}`).FindSubmatch(sol)[1:] {
+		for _, f := range regexp.MustCompile(`\w+ (\w+);`).FindAllSubmatch(m, -1) {
+			fields = append(fields, string(f[1]))
+		}
+	}
+	m := regexp.MustCompile(`(?s)function digest\(.*?keccak256\(abi\.encodePacked\((.*?)\)\);`).FindSubmatch(sol)
+	require.NotNil(t, m)
+	args := strings.Split(string(m[1]), ",")
+	require.Equal(t, `"`+ReceiptDigestTag+`"`, strings.TrimSpace(args[0]))
+
+	job := &LambdaJob{Script: "let a = 1", Config: "cfg", Inputs: [][]byte{{1}}, State: []byte{2}}
+	result := &LambdaResult{Outputs: [][]byte{{3}}, State: []byte{4}}
+	newSignedTestReceipt(t, job, result)
+	bz, err := result.Receipt.EncodeABI()
+	require.NoError(t, err)
+	packed := []byte(ReceiptDigestTag)
+	for _, arg := range args[1:] {
+		name := strings.TrimPrefix(strings.TrimSpace(arg), "rc.")
+		idx := -1
+		for i, f := range fields {
+			if f == name {
+				idx = i
+			}
+		}
+		require.True(t, idx >= 0 && idx < 6, name) // one of the bytes32 hashes
+		packed = append(packed, bz[32*idx:32*idx+32]...)
+	}
+	require.Equal(t, result.Receipt.Digest(), gethcrypto.Keccak256(packed))
+}
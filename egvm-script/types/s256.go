@@ -19,8 +19,8 @@ func HexToS256(hex string) Sint256 {
 	return Sint256{x: x}
 }
 
-func BufToS256(buf goja.ArrayBuffer) Sint256 {
-	return Sint256{x: uint256.NewInt(0).SetBytes(buf.Bytes())}
+func BufToS256(buf goja.Value) Sint256 {
+	return Sint256{x: uint256.NewInt(0).SetBytes(utils.MustGetBytes(buf, "first"))}
 }
 
 func S256(v int64) Sint256 {
@@ -208,7 +208,7 @@ func (s Sint256) ToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	}
 	var dest [32]byte
 	s.x.WriteToArray32(&dest)
-	return vm.ToValue(vm.NewArrayBuffer(dest[:]))
+	return utils.NewBuffer(vm, dest[:])
 }
 
 func (s Sint256) ToHex(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
@@ -0,0 +1,218 @@
+package types
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/dop251/goja"
+	"github.com/tinylib/msgp/msgp"
+
+	"github.com/smartbch/egvm/egvm-script/utils"
+)
+
+// StoreMagic prefixes a serialized Store, so it can be told apart from a hand-made state
+const StoreMagic = "egvm.store.v1"
+
+var (
+	ErrNotStore = errors.New("state is not a serialized store")
+)
+
+// the common part of OrderedIntMap, OrderedStrMap and OrderedBufMap used by Store
+type storableMap interface {
+	loadFrom(b []byte) ([]byte, error)
+	dumpTo(b []byte) []byte
+}
+
+type storeEntry struct {
+	version uint32
+	tag     byte
+	raw     []byte      // serialized map, only valid before m is loaded
+	m       storableMap // nil until the map is accessed
+}
+
+// Store holds named, typed and versioned ordered maps. The maps are deserialized lazily on
+// their first access, and the untouched ones are serialized back as they were.
+type Store struct {
+	entries map[string]*storeEntry
+}
+
+func NewStore() *Store {
+	return &Store{entries: make(map[string]*storeEntry)}
+}
+
+// LoadStore parses bz produced by Store.Serialize. Empty bz gives an empty store.
+func LoadStore(bz []byte) (*Store, error) {
+	s := NewStore()
+	if len(bz) == 0 {
+		return s, nil
+	}
+	magic, b, err := msgp.ReadStringBytes(bz)
+	if err != nil || magic != StoreMagic {
+		return nil, ErrNotStore
+	}
+	count, b, err := msgp.ReadIntBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		var name string
+		var e storeEntry
+		name, b, err = msgp.ReadStringBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		e.version, b, err = msgp.ReadUint32Bytes(b)
+		if err != nil {
+			return nil, err
+		}
+		e.tag, b, err = msgp.ReadByteBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if e.tag > OrderedBufMapTag {
+			return nil, errors.New("invalid map tag in store")
+		}
+		e.raw, b, err = msgp.ReadBytesBytes(b, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.entries[name] = &e
+	}
+	return s, nil
+}
+
+// Serialize dumps all the maps in the order of their names
+func (s *Store) Serialize() []byte {
+	names := s.names()
+	b := msgp.AppendString(nil, StoreMagic)
+	b = msgp.AppendInt(b, len(names))
+	for _, name := range names {
+		e := s.entries[name]
+		b = msgp.AppendString(b, name)
+		b = msgp.AppendUint32(b, e.version)
+		b = msgp.AppendByte(b, e.tag)
+		if e.m == nil {
+			b = msgp.AppendBytes(b, e.raw)
+		} else {
+			b = msgp.AppendBytes(b, e.m.dumpTo(nil))
+		}
+	}
+	return b
+}
+
+func (s *Store) names() []string {
+	names := make([]string, 0, len(s.entries))
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newStorableMap(tag byte) storableMap {
+	switch tag {
+	case OrderedIntMapTag:
+		m := NewOrderedIntMap()
+		return &m
+	case OrderedStrMapTag:
+		m := NewOrderedStrMap()
+		return &m
+	default:
+		m := NewOrderedBufMap()
+		return &m
+	}
+}
+
+// arguments: name string, schemaVersion uint32 (optional), migrate function (optional)
+// When the stored map has a lower schema version than the requested one, migrate(map, oldVersion)
+// is called and then the map is marked with the requested version. Without migrate, an older map
+// is an error, since its data does not follow the requested schema.
+func (s *Store) getMap(f goja.FunctionCall, vm *goja.Runtime, tag byte) goja.Value {
+	if len(f.Arguments) < 1 || len(f.Arguments) > 3 {
+		panic(utils.IncorrectArgumentCount)
+	}
+	name, ok := f.Arguments[0].Export().(string)
+	if !ok || len(name) == 0 {
+		panic(goja.NewSymbol("The first argument must be non-empty string"))
+	}
+	version := uint32(0)
+	if len(f.Arguments) >= 2 {
+		v, ok := f.Arguments[1].Export().(int64)
+		if !ok || v < 0 || v > int64(^uint32(0)) {
+			panic(goja.NewSymbol("The second argument must be uint32"))
+		}
+		version = uint32(v)
+	}
+	var migrate goja.Callable
+	if len(f.Arguments) == 3 {
+		migrate, ok = goja.AssertFunction(f.Arguments[2])
+		if !ok {
+			panic(goja.NewSymbol("The third argument must be function"))
+		}
+	}
+
+	e, exists := s.entries[name]
+	if !exists {
+		e = &storeEntry{version: version, tag: tag, m: newStorableMap(tag)}
+		s.entries[name] = e
+		return vm.ToValue(e.m)
+	}
+	if e.tag != tag {
+		panic(goja.NewSymbol("Map type mismatch in store: " + name))
+	}
+	if e.m == nil {
+		m := newStorableMap(tag)
+		if _, err := m.loadFrom(e.raw); err != nil {
+			panic(goja.NewSymbol("Error in loading map from store: " + err.Error()))
+		}
+		e.m, e.raw = m, nil
+	}
+	if e.version > version {
+		panic(goja.NewSymbol("Stored map has a newer schema version: " + name))
+	}
+	if e.version < version {
+		if migrate == nil {
+			panic(goja.NewSymbol("No migration for the stored map of an older schema version: " + name))
+		}
+		_, err := migrate(goja.Undefined(), vm.ToValue(e.m), vm.ToValue(e.version))
+		if err != nil {
+			panic(err)
+		}
+	}
+	e.version = version
+	return vm.ToValue(e.m)
+}
+
+func (s *Store) IntMap(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	return s.getMap(f, vm, OrderedIntMapTag)
+}
+
+func (s *Store) StrMap(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	return s.getMap(f, vm, OrderedStrMapTag)
+}
+
+func (s *Store) BufMap(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
+	return s.getMap(f, vm, OrderedBufMapTag)
+}
+
+// Version returns the schema version of a map, or -1 if it does not exist
+func (s *Store) Version(name string) int64 {
+	e, ok := s.entries[name]
+	if !ok {
+		return -1
+	}
+	return int64(e.version)
+}
+
+func (s *Store) Has(name string) bool {
+	_, ok := s.entries[name]
+	return ok
+}
+
+func (s *Store) Names() []string {
+	return s.names()
+}
+
+func (s *Store) Delete(name string) {
+	delete(s.entries, name)
+}
@@ -0,0 +1,16 @@
+import {OrderedIntMap} from "./orderedintmap";
+import {OrderedStrMap} from "./orderedstrmap";
+import {OrderedBufMap} from "./orderedbufmap";
+
+// migrate is required to open a map stored with an older schemaVersion
+export type Migration<M> = (m: M, fromVersion: number) => void;
+
+export interface Store {
+    readonly IntMap: (name: string, schemaVersion?: number, migrate?: Migration<OrderedIntMap>) => OrderedIntMap;
+    readonly StrMap: (name: string, schemaVersion?: number, migrate?: Migration<OrderedStrMap>) => OrderedStrMap;
+    readonly BufMap: (name: string, schemaVersion?: number, migrate?: Migration<OrderedBufMap>) => OrderedBufMap;
+    readonly Version: (name: string) => number;
+    readonly Has: (name: string) => boolean;
+    readonly Names: () => string[];
+    readonly Delete: (name: string) => void;
+}
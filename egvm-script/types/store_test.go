@@ -0,0 +1,99 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	StoreWriteScriptTemplate = `
+		const im = store.IntMap('balances')
+		im.Set('alice', 10)
+		im.Set('bob', 20)
+		const sm = store.StrMap('names', 1)
+		sm.Set('alice', 'Alice')
+		const bm = store.BufMap('blobs')
+		bm.Set('x', new Uint8Array([1, 2, 3]))
+		const names = store.Names()
+	`
+
+	StoreReadScriptTemplate = `
+		const [v, ok] = store.IntMap('balances').Get('bob')
+		const [name] = store.StrMap('names', 1).Get('alice')
+		const version = store.Version('names')
+	`
+
+	StoreMigrateScriptTemplate = `
+		let calledWith = -1
+		const im = store.IntMap('balances', 2, (m, from) => {
+			calledWith = from
+			const [v] = m.Get('alice')
+			m.Set('alice', v * 100)
+		})
+		const [alice] = im.Get('alice')
+		const version = store.Version('balances')
+	`
+)
+
+func runStoreScript(t *testing.T, store *Store, script string) *goja.Runtime {
+	vm := goja.New()
+	vm.Set("store", store)
+	_, err := vm.RunString(script)
+	require.NoError(t, err)
+	return vm
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	store, err := LoadStore(nil)
+	require.NoError(t, err)
+	vm := runStoreScript(t, store, StoreWriteScriptTemplate)
+	require.EqualValues(t, []string{"balances", "blobs", "names"}, vm.Get("names").Export())
+
+	loaded, err := LoadStore(store.Serialize())
+	require.NoError(t, err)
+	vm = runStoreScript(t, loaded, StoreReadScriptTemplate)
+	require.True(t, vm.Get("ok").Export().(bool))
+	require.EqualValues(t, 20, vm.Get("v").Export())
+	require.EqualValues(t, "Alice", vm.Get("name").Export())
+	require.EqualValues(t, 1, vm.Get("version").Export())
+
+	// untouched maps are kept as they were
+	require.Equal(t, store.Serialize(), loaded.Serialize())
+}
+
+func TestStoreMigration(t *testing.T) {
+	store := NewStore()
+	runStoreScript(t, store, StoreWriteScriptTemplate)
+	loaded, err := LoadStore(store.Serialize())
+	require.NoError(t, err)
+
+	vm := runStoreScript(t, loaded, StoreMigrateScriptTemplate)
+	require.EqualValues(t, 0, vm.Get("calledWith").Export())
+	require.EqualValues(t, 1000, vm.Get("alice").Export())
+	require.EqualValues(t, 2, vm.Get("version").Export())
+
+	// migrated once only
+	vm = runStoreScript(t, loaded, StoreMigrateScriptTemplate)
+	require.EqualValues(t, -1, vm.Get("calledWith").Export())
+	require.EqualValues(t, 1000, vm.Get("alice").Export())
+}
+
+func TestStoreErrors(t *testing.T) {
+	_, err := LoadStore([]byte{1, 2, 3})
+	require.ErrorIs(t, err, ErrNotStore)
+
+	store := NewStore()
+	runStoreScript(t, store, StoreWriteScriptTemplate)
+	vm := goja.New()
+	vm.Set("store", store)
+	_, err = vm.RunString(`store.StrMap('balances')`)
+	require.Error(t, err)
+	_, err = vm.RunString(`store.StrMap('names', 0)`)
+	require.Error(t, err)
+	// an older version without a migration path
+	_, err = vm.RunString(`store.StrMap('names', 2)`)
+	require.Error(t, err)
+	require.EqualValues(t, 1, store.Version("names"))
+}
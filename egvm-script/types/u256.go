@@ -19,8 +19,8 @@ func HexToU256(hex string) Uint256 {
 	return Uint256{X: x}
 }
 
-func BufToU256(buf goja.ArrayBuffer) Uint256 {
-	return Uint256{X: uint256.NewInt(0).SetBytes(buf.Bytes())}
+func BufToU256(buf goja.Value) Uint256 {
+	return Uint256{X: uint256.NewInt(0).SetBytes(utils.MustGetBytes(buf, "first"))}
 }
 
 func U256(v uint64) Uint256 {
@@ -212,7 +212,7 @@ func (u Uint256) ToBuf(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
 	}
 	var dest [32]byte
 	u.X.WriteToArray32(&dest)
-	return vm.ToValue(vm.NewArrayBuffer(dest[:]))
+	return utils.NewBuffer(vm, dest[:])
 }
 
 func (u Uint256) ToHex(f goja.FunctionCall, vm *goja.Runtime) goja.Value {
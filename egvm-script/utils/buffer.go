@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	arrayBufferType = reflect.TypeOf(goja.ArrayBuffer{})
+
+	// the global object of a runtime holds this symbol when natives should return Uint8Array
+	uint8ArrayModeSymbol = goja.NewSymbol("egvm.uint8ArrayMode")
+)
+
+// viewIntrinsics are the natives of a private runtime which read the real buffer, byteOffset and
+// byteLength of a view in any runtime, and fail for the objects which only look like a view
+type viewIntrinsics struct {
+	isView                               goja.Callable
+	taBuffer, taByteOffset, taByteLength goja.Callable
+	dvBuffer, dvByteOffset, dvByteLength goja.Callable
+}
+
+// a pool rather than a lock, since a getter of the script may call the natives again
+var viewIntrinsicsPool = sync.Pool{New: func() any { return newViewIntrinsics() }}
+
+func newViewIntrinsics() *viewIntrinsics {
+	vm := goja.New()
+	v, err := vm.RunString(`(function() {
+		const ta = Object.getPrototypeOf(Uint8Array.prototype)
+		const get = (proto, name) => Object.getOwnPropertyDescriptor(proto, name).get
+		return [ArrayBuffer.isView, get(ta, 'buffer'), get(ta, 'byteOffset'), get(ta, 'byteLength'),
+			get(DataView.prototype, 'buffer'), get(DataView.prototype, 'byteOffset'), get(DataView.prototype, 'byteLength')]
+	})()`)
+	if err != nil {
+		panic(err)
+	}
+	obj := v.ToObject(vm)
+	fns := make([]goja.Callable, 7)
+	for i := range fns {
+		fns[i], _ = goja.AssertFunction(obj.Get(strconv.Itoa(i)))
+	}
+	return &viewIntrinsics{fns[0], fns[1], fns[2], fns[3], fns[4], fns[5], fns[6]}
+}
+
+// read the buffer, byteOffset and byteLength of a real TypedArray or DataView
+func (vi *viewIntrinsics) view(obj *goja.Object) (buffer *goja.Object, offset, length int64, ok bool) {
+	isView, err := vi.isView(goja.Undefined(), obj)
+	if err != nil || !isView.ToBoolean() {
+		return nil, 0, 0, false
+	}
+	for _, getters := range [][3]goja.Callable{
+		{vi.taBuffer, vi.taByteOffset, vi.taByteLength},
+		{vi.dvBuffer, vi.dvByteOffset, vi.dvByteLength},
+	} {
+		bufV, err := getters[0](obj)
+		if err != nil {
+			continue // not this kind of view
+		}
+		offsetV, err := getters[1](obj)
+		if err != nil {
+			return nil, 0, 0, false
+		}
+		lengthV, err := getters[2](obj)
+		if err != nil {
+			return nil, 0, 0, false
+		}
+		buffer, ok = bufV.(*goja.Object)
+		return buffer, offsetV.ToInteger(), lengthV.ToInteger(), ok
+	}
+	return nil, 0, 0, false
+}
+
+// GetBytes returns the bytes held by an ArrayBuffer, or the bytes viewed by a TypedArray or
+// a DataView (honoring its byteOffset and byteLength). The returned slice shares memory with
+// the javascript buffer. The objects which only have the properties of a view are rejected.
+func GetBytes(v goja.Value) ([]byte, bool) {
+	obj, ok := v.(*goja.Object)
+	if !ok {
+		return nil, false
+	}
+	if obj.ExportType() == arrayBufferType {
+		return obj.Export().(goja.ArrayBuffer).Bytes(), true
+	}
+
+	vi := viewIntrinsicsPool.Get().(*viewIntrinsics)
+	bufObj, offset, length, ok := vi.view(obj)
+	viewIntrinsicsPool.Put(vi)
+	if !ok || bufObj.ExportType() != arrayBufferType {
+		return nil, false
+	}
+	bz := bufObj.Export().(goja.ArrayBuffer).Bytes()
+	if offset < 0 || length < 0 || offset > int64(len(bz)) || length > int64(len(bz))-offset {
+		return nil, false
+	}
+	return bz[offset : offset+length], true
+}
+
+// MustGetBytes is like GetBytes but panics with a symbol named after the argument
+func MustGetBytes(v goja.Value, argName string) []byte {
+	bz, ok := GetBytes(v)
+	if !ok {
+		panic(goja.NewSymbol("The " + argName + " argument must be ArrayBuffer"))
+	}
+	return bz
+}
+
+// SetUint8ArrayMode switches the buffers returned by natives between ArrayBuffer and Uint8Array
+func SetUint8ArrayMode(vm *goja.Runtime, enable bool) {
+	err := vm.GlobalObject().SetSymbol(uint8ArrayModeSymbol, enable)
+	if err != nil {
+		panic(goja.NewSymbol("Error in setting Uint8Array mode: " + err.Error()))
+	}
+}
+
+func IsUint8ArrayMode(vm *goja.Runtime) bool {
+	v := vm.GlobalObject().GetSymbol(uint8ArrayModeSymbol)
+	return v != nil && v.ToBoolean()
+}
+
+// NewBuffer wraps bz into an ArrayBuffer, or into a Uint8Array in Uint8Array mode
+func NewBuffer(vm *goja.Runtime, bz []byte) goja.Value {
+	ab := vm.ToValue(vm.NewArrayBuffer(bz))
+	if !IsUint8ArrayMode(vm) {
+		return ab
+	}
+	u8a, err := vm.New(vm.Get("Uint8Array"), ab)
+	if err != nil {
+		panic(goja.NewSymbol("Error in creating Uint8Array: " + err.Error()))
+	}
+	return u8a
+}
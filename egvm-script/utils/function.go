@@ -22,43 +22,43 @@ func GetOneArrayBuffer(f goja.FunctionCall) []byte {
 	if len(f.Arguments) != 1 {
 		panic(IncorrectArgumentCount)
 	}
-	a, ok := f.Arguments[0].Export().(goja.ArrayBuffer)
+	a, ok := GetBytes(f.Arguments[0])
 	if !ok {
 		panic(goja.NewSymbol("The first argument must be ArrayBuffer"))
 	}
-	return a.Bytes()
+	return a
 }
 
 func GetTwoArrayBuffers(f goja.FunctionCall) ([]byte, []byte) {
 	if len(f.Arguments) != 2 {
 		panic(IncorrectArgumentCount)
 	}
-	a, ok := f.Arguments[0].Export().(goja.ArrayBuffer)
+	a, ok := GetBytes(f.Arguments[0])
 	if !ok {
 		panic(goja.NewSymbol("The first argument must be ArrayBuffer"))
 	}
-	b, ok := f.Arguments[1].Export().(goja.ArrayBuffer)
+	b, ok := GetBytes(f.Arguments[1])
 	if !ok {
 		panic(goja.NewSymbol("The second argument must be ArrayBuffer"))
 	}
-	return a.Bytes(), b.Bytes()
+	return a, b
 }
 
 func GetThreeArrayBuffers(f goja.FunctionCall) ([]byte, []byte, []byte) {
 	if len(f.Arguments) != 3 {
 		panic(IncorrectArgumentCount)
 	}
-	a, ok := f.Arguments[0].Export().(goja.ArrayBuffer)
+	a, ok := GetBytes(f.Arguments[0])
 	if !ok {
 		panic(goja.NewSymbol("The first argument must be ArrayBuffer"))
 	}
-	b, ok := f.Arguments[1].Export().(goja.ArrayBuffer)
+	b, ok := GetBytes(f.Arguments[1])
 	if !ok {
 		panic(goja.NewSymbol("The second argument must be ArrayBuffer"))
 	}
-	c, ok := f.Arguments[2].Export().(goja.ArrayBuffer)
+	c, ok := GetBytes(f.Arguments[2])
 	if !ok {
-		panic(goja.NewSymbol("The second argument must be ArrayBuffer"))
+		panic(goja.NewSymbol("The third argument must be ArrayBuffer"))
 	}
-	return a.Bytes(), b.Bytes(), c.Bytes()
+	return a, b, c
 }
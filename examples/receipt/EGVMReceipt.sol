@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: UNLICENSED
+pragma solidity ^0.8.15;
+
+// Checks the receipts produced by egvmscript, in the layout of types.Receipt.EncodeABI
+library EGVMReceipt {
+	struct Receipt {
+		bytes32 scriptHash;    // sha256 of the script
+		bytes32 configHash;    // keccak256 of the config
+		bytes32 inputsHash;    // keccak256(abi.encodePacked(keccak256(input0), keccak256(input1), ...))
+		bytes32 prevStateHash; // keccak256 of LambdaJob.State
+		bytes32 outputsHash;   // keccak256(abi.encodePacked(keccak256(output0), keccak256(output1), ...))
+		bytes32 newStateHash;  // keccak256 of LambdaResult.State
+		address signer;
+		uint8 v;
+		bytes32 r;
+		bytes32 s;
+	}
+
+	function decode(bytes memory encoded) internal pure returns (Receipt memory) {
+		return abi.decode(encoded, (Receipt));
+	}
+
+	// the same as types.Receipt.Digest, tagged with types.ReceiptDigestTag
+	function digest(Receipt memory rc) internal pure returns (bytes32) {
+		return keccak256(abi.encodePacked("egvm.receipt.v1", rc.scriptHash, rc.configHash, rc.inputsHash,
+			rc.prevStateHash, rc.outputsHash, rc.newStateHash));
+	}
+
+	function hashBufList(bytes[] memory bufs) internal pure returns (bytes32) {
+		bytes32[] memory hashes = new bytes32[](bufs.length);
+		for (uint i = 0; i < bufs.length; i++) {
+			hashes[i] = keccak256(bufs[i]);
+		}
+		return keccak256(abi.encodePacked(hashes));
+	}
+
+	// Returns true if the receipt is signed by 'expectedSigner' for the script 'scriptHash'
+	function verify(Receipt memory rc, address expectedSigner, bytes32 scriptHash) internal pure returns (bool) {
+		if (rc.signer != expectedSigner || rc.scriptHash != scriptHash) {
+			return false;
+		}
+		return ecrecover(digest(rc), rc.v, rc.r, rc.s) == expectedSigner;
+	}
+
+	// Returns true if the receipt attests 'outputs' are produced by the script
+	function verifyOutputs(Receipt memory rc, address expectedSigner, bytes32 scriptHash,
+		bytes[] memory outputs) internal pure returns (bool) {
+		return verify(rc, expectedSigner, scriptHash) && rc.outputsHash == hashBufList(outputs);
+	}
+}
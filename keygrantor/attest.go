@@ -0,0 +1,163 @@
+package keygrantor
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	"github.com/edgelesssys/ego/enclave"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	ErrMockReportSig = errors.New("mock report signature mismatch")
+)
+
+// Attester produces the evidence that some data comes from this enclave
+type Attester interface {
+	// SelfReport returns the report of this enclave, which cannot be verified remotely
+	SelfReport() (attestation.Report, error)
+	// RemoteReport returns a serialized report whose data is 'data', up to 64 bytes
+	RemoteReport(data []byte) ([]byte, error)
+	// Token returns a JWT from an attestation service, which endorses 'data' like RemoteReport
+	Token(data []byte) (string, error)
+}
+
+// Verifier checks the evidence produced by an Attester and returns the report inside it
+type Verifier interface {
+	VerifyRemoteReport(reportBytes []byte) (attestation.Report, error)
+	VerifyToken(token string) (attestation.Report, error)
+}
+
+var (
+	_ Attester = EgoAttester{}
+	_ Verifier = EgoVerifier{}
+	_ Attester = (*MockAttestation)(nil)
+	_ Verifier = (*MockAttestation)(nil)
+
+	// used by the client functions, such as GetKeyFromKeyGrantor and VerifyJWT
+	DefaultAttester Attester = EgoAttester{}
+	DefaultVerifier Verifier = EgoVerifier{}
+)
+
+// EgoAttester gets SGX reports with ego, and tokens from the Azure attestation services
+// in AttestationProviderURLs
+type EgoAttester struct{}
+
+func (EgoAttester) SelfReport() (attestation.Report, error) {
+	return enclave.GetSelfReport()
+}
+
+func (EgoAttester) RemoteReport(data []byte) ([]byte, error) {
+	return enclave.GetRemoteReport(data)
+}
+
+func (EgoAttester) Token(data []byte) (token string, err error) {
+	for _, url := range AttestationProviderURLs {
+		token, err = enclave.CreateAzureAttestationToken(data, url)
+		if err == nil {
+			return token, nil
+		}
+	}
+	return "", err
+}
+
+// EgoVerifier verifies SGX reports with ego, and tokens with the Azure attestation services
+// in AttestationProviderURLs
+type EgoVerifier struct{}
+
+func (EgoVerifier) VerifyRemoteReport(reportBytes []byte) (attestation.Report, error) {
+	return enclave.VerifyRemoteReport(reportBytes)
+}
+
+func (EgoVerifier) VerifyToken(token string) (report attestation.Report, err error) {
+	for _, url := range AttestationProviderURLs {
+		report, err = attestation.VerifyAzureAttestationToken(token, url)
+		if err == nil {
+			return report, nil
+		}
+	}
+	return attestation.Report{}, err
+}
+
+// MockAttestation acts as both Attester and Verifier without SGX. Its reports are copies of a
+// template report with the given data, signed by a local key. It is only for tests.
+type MockAttestation struct {
+	signKey *ecdsa.PrivateKey
+	report  attestation.Report
+}
+
+type mockEvidence struct {
+	Kind   string             `json:"kind"` // "report" or "token"
+	Report attestation.Report `json:"report"`
+	Sig    []byte             `json:"sig"`
+}
+
+func NewMockAttestation(signKey *ecdsa.PrivateKey, report attestation.Report) *MockAttestation {
+	return &MockAttestation{signKey: signKey, report: report}
+}
+
+func (m *MockAttestation) SelfReport() (attestation.Report, error) {
+	r := m.report
+	r.Data = nil
+	return r, nil
+}
+
+func (m *MockAttestation) sign(kind string, data []byte) ([]byte, error) {
+	if len(data) > 64 {
+		return nil, errors.New("report data is longer than 64 bytes")
+	}
+	ev := mockEvidence{Kind: kind, Report: m.report}
+	ev.Report.Data = make([]byte, 64) // padded as SGX does
+	copy(ev.Report.Data, data)
+	bz, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	ev.Sig, err = gethcrypto.Sign(gethcrypto.Keccak256(bz), m.signKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ev)
+}
+
+func (m *MockAttestation) verify(kind string, evidence []byte) (attestation.Report, error) {
+	var ev mockEvidence
+	err := json.Unmarshal(evidence, &ev)
+	if err != nil || ev.Kind != kind || len(ev.Sig) != 65 {
+		return attestation.Report{}, ErrMockReportSig
+	}
+	sig := ev.Sig
+	ev.Sig = nil
+	bz, err := json.Marshal(ev)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	pubKey := gethcrypto.CompressPubkey(&m.signKey.PublicKey)
+	if !gethcrypto.VerifySignature(pubKey, gethcrypto.Keccak256(bz), sig[:64]) {
+		return attestation.Report{}, ErrMockReportSig
+	}
+	if ev.Report.TCBStatus != tcbstatus.UpToDate { // as ego does
+		return ev.Report, attestation.ErrTCBLevelInvalid
+	}
+	return ev.Report, nil
+}
+
+func (m *MockAttestation) RemoteReport(data []byte) ([]byte, error) {
+	return m.sign("report", data)
+}
+
+func (m *MockAttestation) Token(data []byte) (string, error) {
+	bz, err := m.sign("token", data)
+	return string(bz), err
+}
+
+func (m *MockAttestation) VerifyRemoteReport(reportBytes []byte) (attestation.Report, error) {
+	return m.verify("report", reportBytes)
+}
+
+func (m *MockAttestation) VerifyToken(token string) (attestation.Report, error) {
+	return m.verify("token", []byte(token))
+}
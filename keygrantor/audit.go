@@ -0,0 +1,366 @@
+package keygrantor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+)
+
+var (
+	ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+
+	// The number of entries is anchored in the monotonic counter of this key
+	AuditCounterKey = sha256.Sum256([]byte("egvm.audit"))
+)
+
+// AuditEntry records one request for keys. The entries are chained by PrevHash, and Hash is
+// sha256(PrevHash || the JSON of the entry whose Hash is empty).
+type AuditEntry struct {
+	Seq             uint64 `json:"seq"`
+	Time            int64  `json:"time"` // unix seconds
+	Endpoint        string `json:"endpoint"`
+	UniqueID        string `json:"unique_id"` // of the requestor, in hex
+	SignerID        string `json:"signer_id"`
+	SecurityVersion uint   `json:"security_version"`
+	ClientDataHash  string `json:"client_data_hash"` // sha256 of the last 32 bytes of the report data
+	Epoch           int64  `json:"epoch"`
+	MigrateFrom     string `json:"migrate_from,omitempty"` // the old UniqueID of a migration
+	Result          string `json:"result"`                 // "granted", or why it is denied
+	PrevHash        string `json:"prev_hash"`
+	Hash            string `json:"hash"`
+}
+
+// NewAuditEntry fills an AuditEntry with the requestor in the report
+func NewAuditEntry(endpoint string, report *attestation.Report, epoch int64) *AuditEntry {
+	clientData := make([]byte, 32)
+	if len(report.Data) > 32 {
+		copy(clientData, report.Data[32:])
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	return &AuditEntry{
+		Time:            time.Now().Unix(),
+		Endpoint:        endpoint,
+		UniqueID:        hex.EncodeToString(report.UniqueID),
+		SignerID:        hex.EncodeToString(report.SignerID),
+		SecurityVersion: report.SecurityVersion,
+		ClientDataHash:  hex.EncodeToString(clientDataHash[:]),
+		Epoch:           epoch,
+	}
+}
+
+// ComputeHash returns the hash of the entry which is chained after PrevHash
+func (e *AuditEntry) ComputeHash() ([32]byte, error) {
+	prevHash, err := hex.DecodeString(e.PrevHash)
+	if err != nil || len(prevHash) != 32 {
+		return [32]byte{}, fmt.Errorf("invalid prev_hash of entry %d", e.Seq)
+	}
+	unhashed := *e
+	unhashed.Hash = ""
+	bz, err := json.Marshal(unhashed)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(append(prevHash, bz...)), nil
+}
+
+// VerifyAuditChain checks the sequence numbers and hashes of the entries from the first one, and
+// returns the hash of the last one, which is all zero for no entries
+func VerifyAuditChain(entries []*AuditEntry) ([32]byte, error) {
+	var head [32]byte
+	for i, e := range entries {
+		if e.Seq != uint64(i) || e.PrevHash != hex.EncodeToString(head[:]) {
+			return head, fmt.Errorf("%w at entry %d", ErrAuditChainBroken, i)
+		}
+		hash, err := e.ComputeHash()
+		if err != nil {
+			return head, err
+		}
+		if e.Hash != hex.EncodeToString(hash[:]) {
+			return head, fmt.Errorf("%w at entry %d", ErrAuditChainBroken, i)
+		}
+		head = hash
+	}
+	return head, nil
+}
+
+// AuditLog is an append-only file of hash-chained AuditEntry, one per line. The optional seal/unseal
+// functions encrypt each line, e.g. with ecrypto inside an enclave, so the host can neither read
+// nor forge the entries, while dropping or reordering them breaks the chain. Once anchored in a
+// monotonic counter, dropping the tail or rolling the whole file back is detected, too, as long as
+// the counter is not rolled back with it. A FileCounter on the same disk does not prevent the host
+// from restoring older copies of both files together.
+type AuditLog struct {
+	lock    sync.Mutex
+	fname   string
+	seal    func([]byte) ([]byte, error)
+	unseal  func([]byte) ([]byte, error)
+	head    [32]byte
+	count   uint64
+	counter MonotonicCounter
+}
+
+// NewAuditLog opens the audit log file, whose chain must be intact, or creates it when appending
+func NewAuditLog(fname string, seal, unseal func([]byte) ([]byte, error)) (*AuditLog, error) {
+	l := &AuditLog{fname: fname, seal: seal, unseal: unseal}
+	entries, err := l.Entries()
+	if err != nil {
+		return nil, err
+	}
+	l.head, err = VerifyAuditChain(entries)
+	if err != nil {
+		return nil, err
+	}
+	l.count = uint64(len(entries))
+	return l, nil
+}
+
+// Anchor checks that the file has no fewer entries than counted at AuditCounterKey, and then keeps
+// the counter up with every appended entry. It only detects a truncated file whose counter is intact. An entry appended without the counter, e.g. before a
+// crash, is counted here, since the host can neither forge nor reorder the entries.
+func (l *AuditLog) Anchor(counter MonotonicCounter) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.catchUpCounter(counter); err != nil {
+		return err
+	}
+	l.counter = counter
+	return nil
+}
+
+// count the entries which are appended but not counted yet, e.g. after the counter failed
+func (l *AuditLog) catchUpCounter(counter MonotonicCounter) error {
+	value, err := counter.Get(AuditCounterKey)
+	if err != nil {
+		return err
+	}
+	if value > l.count {
+		return fmt.Errorf("%w: %d entries are counted, but the file has %d", ErrAuditChainBroken, value, l.count)
+	}
+	for ; value < l.count; value++ {
+		if _, err = counter.Increase(AuditCounterKey, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append chains an entry after the last one, and returns after it is synced to the disk and counted.
+// If it fails to be counted, it is still appended, and counted with the next one.
+func (l *AuditLog) Append(entry *AuditEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry.Seq = l.count
+	entry.PrevHash = hex.EncodeToString(l.head[:])
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hex.EncodeToString(hash[:])
+	line, err := l.encodeLine(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	l.head = hash
+	l.count++
+	if l.counter == nil {
+		return nil
+	}
+	return l.catchUpCounter(l.counter)
+}
+
+// encode an entry as a line of the file, which is sealed and then hex-encoded if there is seal
+func (l *AuditLog) encodeLine(entry *AuditEntry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil || l.seal == nil {
+		return line, err
+	}
+	line, err = l.seal(line)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(line)), nil
+}
+
+// Reseal seals all the entries again, e.g. after SealMode is changed
+func (l *AuditLog) Reseal() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries, err := l.Entries()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	var out []byte
+	for _, e := range entries {
+		line, err := l.encodeLine(e)
+		if err != nil {
+			return err
+		}
+		out = append(append(out, line...), '\n')
+	}
+	tmpName := l.fname + ".tmp"
+	err = os.WriteFile(tmpName, out, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, l.fname)
+}
+
+// Entries reads and unseals all the entries in the file, without verifying the chain
+func (l *AuditLog) Entries() ([]*AuditEntry, error) {
+	fileData, err := os.ReadFile(l.fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(fileData))
+	scanner.Buffer(nil, len(fileData)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if l.unseal != nil {
+			line, err = hex.DecodeString(string(line))
+			if err == nil {
+				line, err = l.unseal(line)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to unseal audit entry %d: %w", len(entries), err)
+			}
+		}
+		var e AuditEntry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode audit entry %d: %w", len(entries), err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, scanner.Err()
+}
+
+// VerifiedEntries reads the file again and checks that its chain ends with the last appended entry,
+// and returns the entries and the hash of the last one
+func (l *AuditLog) VerifiedEntries() ([]*AuditEntry, [32]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries, err := l.Entries()
+	if err != nil {
+		return nil, [32]byte{}, err
+	}
+	head, err := VerifyAuditChain(entries)
+	if err != nil {
+		return nil, head, err
+	}
+	if uint64(len(entries)) != l.count || head != l.head {
+		return nil, head, fmt.Errorf("%w: the file does not end with the last appended entry", ErrAuditChainBroken)
+	}
+	if l.counter != nil {
+		if err = l.catchUpCounter(l.counter); err != nil {
+			return nil, head, err
+		}
+	}
+	return entries, head, nil
+}
+
+// AuditExport is the response of '/audit'
+type AuditExport struct {
+	Entries []*AuditEntry `json:"entries"`
+	Report  string        `json:"report"` // in hex, whose data is the hash of the last entry
+}
+
+// HandleAuditExport returns the entries and a report attesting the hash of the last one, so the
+// log can be verified outside the enclave. Only the attested enclaves allowed by the policy can
+// get them, encrypted to their pubkey as the keys are.
+func HandleAuditExport(audit *AuditLog, attester Attester, verifier Verifier, policy *Policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		if report, _ := handleGetKeyParam(w, r, pubkeyBz, verifier, policy, nil); report == nil {
+			return
+		}
+		entries, head, err := audit.VerifiedEntries()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		report, err := attester.RemoteReport(head[:])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		bz, _ := json.Marshal(AuditExport{Entries: entries, Report: hex.EncodeToString(report)})
+		writeEncrypted(w, pubKey, bz)
+	}
+}
+
+// HandleAuditVerify checks the chain in the file and returns the number of entries and the hash
+// of the last one
+func HandleAuditVerify(audit *AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, head, err := audit.VerifiedEntries()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("ok: %d entries, head %x", len(entries), head)))
+	}
+}
+
+// GetAuditLogFromKeyGrantor gets the entries from '/audit', which must allow this enclave, and
+// verifies their chain and the report attesting the last one. The caller should check that the
+// report is from the expected keygrantor.
+func GetAuditLogFromKeyGrantor(keyGrantorUrl string) ([]*AuditEntry, *attestation.Report, error) {
+	body, _, err := postWithAttestation(keyGrantorUrl+"/audit", "", nil, GetKeyParams{}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var export AuditExport
+	err = json.Unmarshal(body, &export)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err := VerifyAuditChain(export.Entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	reportBz, err := hex.DecodeString(export.Report)
+	if err != nil {
+		return nil, nil, err
+	}
+	report, err := DefaultVerifier.VerifyRemoteReport(reportBz)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(report.Data) < 32 || !bytes.Equal(report.Data[:32], head[:]) {
+		return nil, nil, ErrReportDataMismatch
+	}
+	return export.Entries, &report, nil
+}
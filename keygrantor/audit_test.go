@@ -0,0 +1,214 @@
+package keygrantor
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuditLog(t *testing.T, fname string) *AuditLog {
+	audit, err := NewAuditLog(fname, nil, nil)
+	require.NoError(t, err)
+	return audit
+}
+
+// a stand-in of ecrypto for the tests
+func testSeal(bz []byte) ([]byte, error) {
+	return append([]byte("sealed:"), bz...), nil
+}
+
+func testUnseal(bz []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bz, []byte("sealed:")) {
+		return nil, errors.New("not sealed")
+	}
+	return bz[len("sealed:"):], nil
+}
+
+func TestAuditLogChain(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(fname, testSeal, testUnseal)
+	require.NoError(t, err)
+	report := newTestReport("enclave")
+	for _, endpoint := range []string{"/getkey", "/xprv", "/getkey"} {
+		require.NoError(t, audit.Append(NewAuditEntry(endpoint, &report, 0)))
+	}
+	entries, head, err := audit.VerifiedEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, "/xprv", entries[1].Endpoint)
+	require.Equal(t, entries[1].Hash, entries[2].PrevHash)
+	chainHead, err := VerifyAuditChain(entries)
+	require.NoError(t, err)
+	require.Equal(t, head, chainHead)
+
+	// the entries are sealed, and the chain continues after reopening
+	bz, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	require.NotContains(t, string(bz), "/xprv")
+	audit, err = NewAuditLog(fname, testSeal, testUnseal)
+	require.NoError(t, err)
+	require.NoError(t, audit.Append(NewAuditEntry("/getkey", &report, 1)))
+	entries, _, err = audit.VerifiedEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// the host drops the last entry
+	lines := strings.SplitAfter(string(bz), "\n")
+	require.NoError(t, os.WriteFile(fname, []byte(strings.Join(lines[:2], "")), 0600))
+	_, _, err = audit.VerifiedEntries()
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+
+	// the host drops an entry in the middle
+	require.NoError(t, os.WriteFile(fname, []byte(lines[0]+lines[2]), 0600))
+	_, err = NewAuditLog(fname, testSeal, testUnseal)
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+
+	// a modified entry
+	entries[1].Result = "denied"
+	_, err = VerifyAuditChain(entries)
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+}
+
+func TestAuditLogAnchor(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "audit.log")
+	counter, err := NewFileCounter(filepath.Join(t.TempDir(), "counter.txt"), nil, nil)
+	require.NoError(t, err)
+	report := newTestReport("enclave")
+
+	// an existing log is counted when it is anchored for the first time
+	audit := newTestAuditLog(t, fname)
+	require.NoError(t, audit.Append(NewAuditEntry("/getkey", &report, 0)))
+	require.NoError(t, audit.Anchor(counter))
+	require.NoError(t, audit.Append(NewAuditEntry("/xprv", &report, 0)))
+	value, err := counter.Get(AuditCounterKey)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, value)
+	_, _, err = audit.VerifiedEntries()
+	require.NoError(t, err)
+
+	// the host drops the tail while keygrantor is stopped
+	bz, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(string(bz), "\n")
+	require.NoError(t, os.WriteFile(fname, []byte(lines[0]), 0600))
+	audit = newTestAuditLog(t, fname)
+	require.ErrorIs(t, audit.Anchor(counter), ErrAuditChainBroken)
+
+	// or rolls the whole file back
+	require.NoError(t, os.Remove(fname))
+	audit = newTestAuditLog(t, fname)
+	require.ErrorIs(t, audit.Anchor(counter), ErrAuditChainBroken)
+
+	// an entry appended before the counter, e.g. before a crash, is counted
+	require.NoError(t, os.WriteFile(fname, bz, 0600))
+	audit = newTestAuditLog(t, fname)
+	require.NoError(t, audit.Anchor(counter))
+	require.NoError(t, audit.Append(NewAuditEntry("/getkey", &report, 0)))
+	audit.counter = nil
+	require.NoError(t, audit.Append(NewAuditEntry("/getkey", &report, 0)))
+	audit = newTestAuditLog(t, fname)
+	require.NoError(t, audit.Anchor(counter))
+	value, err = counter.Get(AuditCounterKey)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, value)
+}
+
+// failingCounter fails to increase while fail is set
+type failingCounter struct {
+	MonotonicCounter
+	fail bool
+}
+
+func (c *failingCounter) Increase(key [32]byte, expected uint64) (uint64, error) {
+	if c.fail {
+		return 0, errors.New("counter is unavailable")
+	}
+	return c.MonotonicCounter.Increase(key, expected)
+}
+
+func TestAuditLogCounterFailure(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "audit.log")
+	fc, err := NewFileCounter(filepath.Join(t.TempDir(), "counter.txt"), nil, nil)
+	require.NoError(t, err)
+	counter := &failingCounter{MonotonicCounter: fc}
+	report := newTestReport("enclave")
+	audit := newTestAuditLog(t, fname)
+	require.NoError(t, audit.Anchor(counter))
+
+	// the entry is appended, but not counted
+	counter.fail = true
+	require.Error(t, audit.Append(NewAuditEntry("/getkey", &report, 0)))
+	value, err := fc.Get(AuditCounterKey)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, value)
+
+	// and counted with the next one
+	counter.fail = false
+	require.NoError(t, audit.Append(NewAuditEntry("/getkey", &report, 0)))
+	value, err = fc.Get(AuditCounterKey)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, value)
+	entries, _, err := audit.VerifiedEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NoError(t, newTestAuditLog(t, fname).Anchor(fc))
+}
+
+func TestServerAudit(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	kr, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	_, err = kr.Append(newTestMasterKey(t, "epoch 0"))
+	require.NoError(t, err)
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+	audit := newTestAuditLog(t, filepath.Join(t.TempDir(), "audit.log"))
+	counter, err := NewFileCounter(filepath.Join(t.TempDir(), "counter.txt"), nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, audit.Anchor(counter))
+	mux := http.NewServeMux()
+	s := &Server{Keys: kr, Attester: mock, Verifier: mock, Policy: policy, Audit: audit}
+	require.NoError(t, s.RegisterHandlers(mux))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	clientData := []byte("client data")
+
+	// denied by the policy for SecurityVersion 1
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData)
+	require.Error(t, err)
+	report := newTestReport("client enclave")
+	report.SecurityVersion = 2
+	DefaultAttester = NewMockAttestation(mock.signKey, report)
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData)
+	require.NoError(t, err)
+
+	// the policy does not list '/audit'
+	_, _, err = GetAuditLogFromKeyGrantor(server.URL)
+	require.ErrorContains(t, err, ErrPolicyEndpoint.Error())
+	resp, err := http.Get(server.URL + "/audit")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	policy.Endpoints["/audit"] = policy.Endpoints["/getkey"]
+	entries, keygrantorReport, err := GetAuditLogFromKeyGrantor(server.URL)
+	require.NoError(t, err)
+	require.Equal(t, []byte("client enclave"), keygrantorReport.UniqueID)
+	require.Len(t, entries, 2)
+	require.Equal(t, "denied: "+ErrPolicySecurityVersion.Error(), entries[0].Result)
+	require.EqualValues(t, 1, entries[0].SecurityVersion)
+	require.Equal(t, "granted", entries[1].Result)
+	require.Equal(t, "/getkey", entries[1].Endpoint)
+
+	resp, err = http.Get(server.URL + "/audit/verify")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
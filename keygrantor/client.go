@@ -0,0 +1,152 @@
+package keygrantor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/tyler-smith/go-bip32"
+)
+
+var (
+	ErrXpubChanged = errors.New("keygrantor's xpub of the epoch changed")
+)
+
+// KeyGrantorClient gets keys from a keygrantor attested against the expected identity. The xpub of
+// each epoch is trusted only after '/report' attests it, and every granted key must descend from
+// the attested xpub by the public derivation.
+type KeyGrantorClient struct {
+	Url      string
+	SignerID []byte // the expected SignerID of keygrantor, not checked if empty
+	UniqueID []byte // the expected UniqueID of keygrantor, not checked if empty
+
+	lock  sync.Mutex
+	xpubs map[int64]*bip32.Key // the attested xpubs by epoch
+}
+
+func NewKeyGrantorClient(keyGrantorUrl string, signerID, uniqueID []byte) *KeyGrantorClient {
+	return &KeyGrantorClient{
+		Url:      keyGrantorUrl,
+		SignerID: signerID,
+		UniqueID: uniqueID,
+		xpubs:    make(map[int64]*bip32.Key),
+	}
+}
+
+// AttestedXpub returns the xpub of an epoch, which can be LatestEpoch, after checking keygrantor's
+// report on it. The xpubs of the old epochs are cached.
+func (c *KeyGrantorClient) AttestedXpub(epoch int64) (*bip32.Key, int64, error) {
+	c.lock.Lock()
+	cached := c.xpubs[epoch]
+	c.lock.Unlock()
+	if cached != nil {
+		return cached, epoch, nil
+	}
+	xpub, resEpoch, err := getEpochXpubFromKeyGrantor(c.Url, epoch, c.CheckIdentity)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.lock.Lock()
+	cached = c.xpubs[resEpoch]
+	c.lock.Unlock()
+	if cached != nil { // the latest epoch is already attested
+		if cached.B58Serialize() != xpub.B58Serialize() {
+			return nil, 0, ErrXpubChanged
+		}
+		return cached, resEpoch, nil
+	}
+	_, err = getXpubReport(c.Url, xpub.B58Serialize(), resEpoch, c.CheckIdentity)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to attest xpub: %w", err)
+	}
+	c.lock.Lock()
+	c.xpubs[resEpoch] = xpub
+	c.lock.Unlock()
+	return xpub, resEpoch, nil
+}
+
+// CheckIdentity checks the identity of keygrantor in its report against the expected one
+func (c *KeyGrantorClient) CheckIdentity(report *attestation.Report) error {
+	return checkIdentity(report, c.SignerID, c.UniqueID)
+}
+
+// check the identity in a report against signerID and uniqueID, which are not checked if empty.
+// A debug enclave is never trusted, since the host can read and change its memory.
+func checkIdentity(report *attestation.Report, signerID, uniqueID []byte) error {
+	if report.Debug {
+		return ErrInDebugMode
+	}
+	if len(signerID) != 0 && !bytes.Equal(signerID, report.SignerID) {
+		return ErrSignerIDMismatch
+	}
+	if len(uniqueID) != 0 && !bytes.Equal(uniqueID, report.UniqueID) {
+		return ErrUniqueIDMismatch
+	}
+	return nil
+}
+
+// GetKey gets the key for clientData like GetKeyFromKeyGrantorWithOptions, and checks that its
+// public part is derived from the attested xpub of its epoch as keygrantor should derive it
+func (c *KeyGrantorClient) GetKey(clientData []byte, opts KeyOptions) (*bip32.Key, int64, error) {
+	key, epoch, err := getKeyFromKeyGrantor(c.Url, clientData, opts, c.CheckIdentity)
+	if err != nil {
+		return nil, 0, err
+	}
+	xpub, _, err := c.AttestedXpub(epoch)
+	if err != nil {
+		return nil, 0, err
+	}
+	expected := xpub
+	if len(clientData) != 0 {
+		selfReport, err := DefaultAttester.SelfReport()
+		if err != nil {
+			return nil, 0, err
+		}
+		selfReport.Data = make([]byte, 64)
+		copy(selfReport.Data[32:], clientData)
+		hash, err := DerivationHash(&selfReport, opts.Mode, opts.MinSVN)
+		if err != nil {
+			return nil, 0, err
+		}
+		expected = DeriveKey(xpub, hash)
+	}
+	if key.PublicKey().B58Serialize() != expected.B58Serialize() {
+		return nil, 0, ErrDerivedKeyMismatch
+	}
+	return key, epoch, nil
+}
+
+// MigrateKey gets the key of an old version like MigrateKeyFromKeyGrantor, and checks that its public
+// part is derived from the attested xpub of its epoch as '/getkey' derived it for the old version
+func (c *KeyGrantorClient) MigrateKey(oldUniqueID, clientData []byte, epoch int64) (*bip32.Key, int64, error) {
+	key, resEpoch, err := migrateKeyFromKeyGrantor(c.Url, oldUniqueID, clientData, epoch, c.CheckIdentity)
+	if err != nil {
+		return nil, 0, err
+	}
+	expected, err := c.DerivePubKey(oldUniqueID, clientData, resEpoch)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hex.EncodeToString(key.PublicKey().Key) != expected.PubKey {
+		return nil, 0, ErrDerivedKeyMismatch
+	}
+	return key, resEpoch, nil
+}
+
+// DerivePubKey computes the public key which '/getkey' derives for uniqueID and clientData from the
+// attested xpub of an epoch, which can be LatestEpoch
+func (c *KeyGrantorClient) DerivePubKey(uniqueID, clientData []byte, epoch int64) (*DerivedPubKey, error) {
+	xpub, resEpoch, err := c.AttestedXpub(epoch)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := DerivePubKey(xpub, uniqueID, clientData)
+	if err != nil {
+		return nil, err
+	}
+	pubKey.Epoch = resEpoch
+	return pubKey, nil
+}
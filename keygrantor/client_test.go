@@ -0,0 +1,76 @@
+package keygrantor
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyGrantorClient(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	server, _ := newTestServer(t, mock, "epoch 0", "epoch 1")
+	clientData := sha256.Sum256([]byte("client data"))
+
+	client := NewKeyGrantorClient(server.URL, []byte("signer"), []byte("client enclave"))
+	key, epoch, err := client.GetKey(clientData[:], KeyOptions{Epoch: LatestEpoch})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+	hash := sha256.Sum256(append([]byte("client enclave"), clientData[:]...))
+	require.Equal(t, DeriveKey(newTestMasterKey(t, "epoch 1"), hash).B58Serialize(), key.B58Serialize())
+	_, epoch, err = client.GetKey(clientData[:], KeyOptions{Epoch: 0, Mode: KeyModeSigner})
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	require.Len(t, client.xpubs, 2)
+	master, _, err := client.GetKey(nil, KeyOptions{Epoch: LatestEpoch})
+	require.NoError(t, err)
+	require.Equal(t, newTestMasterKey(t, "epoch 1").B58Serialize(), master.B58Serialize())
+
+	// not the expected keygrantor
+	client = NewKeyGrantorClient(server.URL, []byte("other signer"), nil)
+	_, _, err = client.GetKey(clientData[:], KeyOptions{Epoch: LatestEpoch})
+	require.ErrorIs(t, err, ErrSignerIDMismatch)
+	client = NewKeyGrantorClient(server.URL, nil, []byte("other enclave"))
+	_, _, err = client.AttestedXpub(0)
+	require.ErrorIs(t, err, ErrUniqueIDMismatch)
+
+	// a debug keygrantor is never trusted
+	report := newTestReport("client enclave")
+	report.Debug = true
+	server, _ = newTestServer(t, NewMockAttestation(mock.signKey, report), "epoch 0")
+	client = NewKeyGrantorClient(server.URL, []byte("signer"), nil)
+	_, _, err = client.AttestedXpub(LatestEpoch)
+	require.ErrorIs(t, err, ErrInDebugMode)
+}
+
+func TestKeyGrantorClientKeyMismatch(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	newServerMux := func(key string) *http.ServeMux {
+		kr, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+		require.NoError(t, err)
+		_, err = kr.Append(newTestMasterKey(t, key))
+		require.NoError(t, err)
+		mux := http.NewServeMux()
+		require.NoError(t, (&Server{Keys: kr, Attester: mock, Verifier: mock}).RegisterHandlers(mux))
+		return mux
+	}
+	// the keys granted by '/getkey' do not descend from the xpub attested by '/report'
+	attestedMux, grantingMux := newServerMux("attested"), newServerMux("granting")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/getkey" {
+			grantingMux.ServeHTTP(w, r)
+		} else {
+			attestedMux.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewKeyGrantorClient(server.URL, nil, nil)
+	_, err := GetKeyFromKeyGrantor(server.URL, []byte("client data"))
+	require.NoError(t, err)
+	_, _, err = client.GetKey([]byte("client data"), KeyOptions{Epoch: LatestEpoch})
+	require.ErrorIs(t, err, ErrDerivedKeyMismatch)
+}
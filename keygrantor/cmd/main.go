@@ -1,199 +1,189 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
 
-	ecies "github.com/ecies/go/v2"
-	"github.com/edgelesssys/ego/attestation"
-	"github.com/edgelesssys/ego/enclave"
-	"github.com/tyler-smith/go-bip32"
-
 	"github.com/smartbch/egvm/keygrantor"
 )
 
 var (
-	ExtPrivKey *bip32.Key
-	ExtPubKey  *bip32.Key
+	// the master keys of all the epochs
+	Keys *keygrantor.KeyRing
+
+	KeyFile     = "/data/key.txt" // the single master key before key rotation, imported as epoch 0
+	KeyRingFile = "/data/keyring.txt"
+	ShareFile   = "/data/share.txt" // the master key share in the threshold mode
+	CounterFile = "/data/counter.txt"
+	AuditFile   = "/data/audit.log"
 
-	KeyFile = "/data/key.txt"
+	Counter keygrantor.MonotonicCounter
+	// the sealed and hash-chained log of all key grants
+	Audit *keygrantor.AuditLog
+	// nil means keygrantor.DefaultEndpointPolicy for all the endpoints
+	Policy *keygrantor.Policy
+
+	// the self-signed certificate attested by '/report', nil for plain HTTP
+	TLSCert   []byte
+	TLSConfig *tls.Config
 )
 
 func main() {
 	keySrc := flag.String("xprvsrc", "", "the server from which we can sync xprv key")
 	listenAddrP := flag.String("listen", "0.0.0.0:8084", "listen address")
+	rotate := flag.Bool("rotate", false, "generate a new master key as a new epoch, the old epochs are kept")
+	split := flag.String("split", "", "run as the dealer of the threshold mode with 't,N', which generates a master key "+
+		"and hands its N shares to the peers, t of which can serve derived keys")
+	shareSrc := flag.String("sharesrc", "", "the dealer from which we get a master key share for the threshold mode")
+	shareIndex := flag.Uint("shareindex", 0, "the index (1~N) of the master key share got from the dealer")
+	usePolicy := flag.Bool("policy", false, "load the attestation policy embedded at "+keygrantor.EmbeddedPolicyFile+" by the 'files' of enclave.json")
+	flag.StringVar(&KeyFile, "keyfile", KeyFile, "the sealed single master key file before key rotation")
+	flag.StringVar(&KeyRingFile, "keyring", KeyRingFile, "the sealed master keys file")
+	flag.StringVar(&keygrantor.SealMode, "seal", keygrantor.SealModeUnique, "how the files are sealed: 'unique' for this build "+
+		"only, or 'product' for the upgrades signed by the same key, too")
+	useTLS := flag.Bool("tls", true, "serve over TLS with a self-signed certificate, whose hash is attested by '/report'")
+	plainHTTP := flag.Bool("plainhttp", false, "allow the 'http://' urls of other keygrantors without attesting the connection, for dev and test only")
+	importSrc := flag.String("importsrc", "", "the old keygrantor from whose '/exportkeys' an upgraded one imports the master keys")
 	flag.Parse()
-	var fileExists bool
-	ExtPrivKey, fileExists = keygrantor.RecoverKeyFromFile(KeyFile)
-	if !fileExists {
-		if keySrc == nil || len(*keySrc) == 0 {
-			ExtPrivKey = keygrantor.GetRandomExtPrivKey()
-		} else {
-			var err error
-			ExtPrivKey, err = keygrantor.GetKeyFromKeyGrantor(*keySrc, nil)
-			if err != nil {
-				panic(err)
-			}
+	listenAddr := *listenAddrP
+	keygrantor.AllowPlainHTTP = *plainHTTP
+	if err := keygrantor.CheckSealMode(keygrantor.SealMode); err != nil {
+		panic(err)
+	}
+	if *useTLS {
+		var err error
+		TLSCert, TLSConfig, err = keygrantor.NewSelfSignedTLSConfig("keygrantor")
+		if err != nil {
+			panic(err)
 		}
-		keygrantor.SealKeyToFile(KeyFile, ExtPrivKey)
 	}
-	ExtPubKey = ExtPrivKey.PublicKey()
-	listenAddr := *listenAddrP
-	go createAndStartHttpServer(listenAddr)
-	select {}
-}
-
-func createAndStartHttpServer(listenAddr string) {
-	// Return the extended public key
-	http.HandleFunc("/xpub", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(ExtPubKey.B58Serialize()))
-	})
-
-	// Get remote attestion report to endorse the extended public key
-	http.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
-		hash := sha256.Sum256([]byte(ExtPubKey.B58Serialize()))
-		report, err := enclave.GetRemoteReport(hash[:])
+	// seal the files again in case the seal mode is changed
+	for _, fname := range []string{KeyRingFile, ShareFile, CounterFile} {
+		if err := keygrantor.ResealFile(fname); err != nil {
+			panic(fmt.Sprintf("failed to reseal %s: %s", fname, err))
+		}
+	}
+	if *usePolicy {
+		var err error
+		Policy, err = keygrantor.LoadEmbeddedPolicy()
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
+			panic(err)
 		}
-		w.Write([]byte(hex.EncodeToString(report)))
-	})
-
-	// Peer keygrantors get ExtPrivKey through '/xprv'
-	http.HandleFunc("/xprv", func(w http.ResponseWriter, r *http.Request) {
-		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
-		if pubKey == nil {
-			return
+	}
+	if len(*split) != 0 {
+		runDealer(*split, listenAddr)
+		return
+	}
+	var err error
+	Counter, err = keygrantor.NewFileCounter(CounterFile, keygrantor.Seal, keygrantor.Unseal)
+	if err != nil {
+		panic(err)
+	}
+	Audit, err = keygrantor.NewAuditLog(AuditFile, keygrantor.Seal, keygrantor.Unseal)
+	if err != nil {
+		panic(err)
+	}
+	if err = Audit.Reseal(); err != nil {
+		panic(err)
+	}
+	// refuse to start if the host has dropped the tail of the log or rolled it back, unless it has also
+	// rolled back the counter, which is a file on the same disk
+	if err = Audit.Anchor(Counter); err != nil {
+		panic(err)
+	}
+	share, fileExists, err := keygrantor.RecoverShareFromFile(ShareFile)
+	if err != nil {
+		panic(err)
+	}
+	if !fileExists && len(*shareSrc) != 0 {
+		share, err = keygrantor.GetShareFromDealer(*shareSrc, uint32(*shareIndex))
+		if err != nil {
+			panic(err)
 		}
-		report := handleGetKeyParam(w, r, pubkeyBz)
-		if report == nil {
-			return
+		err = keygrantor.SealShareToFile(ShareFile, share)
+		if err != nil {
+			panic(err)
 		}
-		selfReport := keygrantor.GetSelfReportAndCheck()
-		err := keygrantor.VerifyPeerReport(*report, selfReport)
+	}
+	if share != nil {
+		go createAndStartThresholdHttpServer(listenAddr, share)
+		select {}
+	}
+	Keys, err = keygrantor.NewKeyRing(KeyRingFile, keygrantor.Seal, keygrantor.Unseal)
+	if err != nil {
+		panic(err)
+	}
+	if Keys.Len() == 0 && len(*importSrc) != 0 {
+		err = keygrantor.ImportKeyRing(Keys, *importSrc)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("report check failed: " + err.Error()))
-			return
+			panic(err)
+		}
+		fmt.Printf("imported %d epochs from %s\n", Keys.Len(), *importSrc)
+	}
+	if Keys.Len() == 0 {
+		if oldKey, fileExists := keygrantor.RecoverKeyFromFile(KeyFile); fileExists {
+			_, err = Keys.Append(oldKey)
+		} else if len(*keySrc) == 0 {
+			_, err = Keys.Append(keygrantor.GetRandomExtPrivKey())
 		}
-		derivedKeyBz, _ := ExtPrivKey.Serialize()
-		bz, err := ecies.Encrypt(pubKey, derivedKeyBz)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("failed to encrypted xprv"))
-			return
+			panic(err)
 		}
-		w.Write([]byte(hex.EncodeToString(bz)))
-	})
-
-	// For requestors to get derived key
-	http.HandleFunc("/getkey", func(w http.ResponseWriter, r *http.Request) {
-		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
-		if pubKey == nil {
-			return
+	}
+	if len(*keySrc) != 0 {
+		// get the epochs we do not have yet, e.g. after the upstream rotated its key
+		err = keygrantor.SyncKeyRing(Keys, *keySrc)
+		if err != nil {
+			panic(err)
 		}
-		report := handleGetKeyParam(w, r, pubkeyBz)
-		if report == nil {
-			return
+	}
+	if *rotate {
+		epoch, err := Keys.Append(keygrantor.GetRandomExtPrivKey())
+		if err != nil {
+			panic(err)
 		}
-		handleKeyDerive(w, report, pubKey)
-	})
-
-	server := http.Server{Addr: listenAddr, ReadTimeout: 3 * time.Second, WriteTimeout: 5 * time.Second}
-	fmt.Println("listening ...")
-	log.Fatal(server.ListenAndServe())
+		fmt.Printf("rotated to epoch %d\n", epoch)
+	}
+	go createAndStartHttpServer(listenAddr)
+	select {}
 }
 
-// Parse query parameter 'pubkey' to get ecies.PublicKey for encrypting the returned key
-func handleRequesterPubkey(w http.ResponseWriter, r *http.Request) (*ecies.PublicKey, []byte) {
-	pubkeys := r.URL.Query()["pubkey"]
-	if len(pubkeys) == 0 || len(pubkeys[0]) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("missing pubkey parameter"))
-		return nil, nil
-	}
-	requesterPubkeyBz, err := hex.DecodeString(pubkeys[0])
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("pubkey hex string decode error"))
-		return nil, nil
+func createAndStartHttpServer(listenAddr string) {
+	mux := http.NewServeMux()
+	server := &keygrantor.Server{
+		Keys:     Keys,
+		Counter:  Counter,
+		Attester: keygrantor.EgoAttester{},
+		Verifier: keygrantor.EgoVerifier{},
+		Policy:   Policy,
+		Audit:    Audit,
+		TLSCert:  TLSCert,
 	}
-	requesterPubKey, err := ecies.NewPublicKeyFromBytes(requesterPubkeyBz) // requester embeds its pubkey here
+	err := server.RegisterHandlers(mux)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("pubkey decode err: " + err.Error()))
-		return nil, nil
+		panic(err)
 	}
-	return requesterPubKey, requesterPubkeyBz
+	listenAndServe(listenAddr, mux)
 }
 
-// Decode GetKeyParams from http requet's body and then check the attestion report and the JWT
-func handleGetKeyParam(w http.ResponseWriter, r *http.Request, pubkeyBz []byte) *attestation.Report {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("failed to read request body"))
-		return nil
-	}
-	var params keygrantor.GetKeyParams
-	err = json.Unmarshal(body, &params)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("failed to unmarshal request body"))
-		return nil
-	}
-	reportBz, err := hex.DecodeString(params.Report)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("report decode error"))
-		return nil
-	}
-	report, err := enclave.VerifyRemoteReport(reportBz)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("report check failed: " + err.Error()))
-		return nil
-	}
-	if len(report.Data) != 64 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("report data must 64bytes long"))
-		return nil
-	}
-	pubkeyHash := sha256.Sum256(pubkeyBz)
-	if !bytes.Equal(pubkeyHash[:], report.Data[:32]) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("pubkey not match the pubkey hash"))
-		return nil
-	}
-	err = keygrantor.VerifyJWT(params.JWT, report)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("jwt token verify failed: " + err.Error()))
-		return nil
-	}
-	return &report
+func listenAndServe(listenAddr string, mux *http.ServeMux) {
+	log.Fatal(serve(newHttpServer(listenAddr, mux)))
 }
 
-// Derive a xprv key from ExtPrivKey and the requestor's UniqueID and clientData
-func handleKeyDerive(w http.ResponseWriter, report *attestation.Report, requesterPubKey *ecies.PublicKey) {
-	// concat uniqueid and client-specific data, then hash it for more flexible key deriving
-	derivedKey := keygrantor.DeriveKey(ExtPrivKey, sha256.Sum256(append(report.UniqueID, report.Data[32:]...)))
-	derivedKeyBz, _ := derivedKey.Serialize()
-	bz, err := ecies.Encrypt(requesterPubKey, derivedKeyBz)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("failed to encrypted derivedKey"))
-		return
+func newHttpServer(listenAddr string, mux *http.ServeMux) *http.Server {
+	return &http.Server{Addr: listenAddr, Handler: mux, ReadTimeout: 3 * time.Second, WriteTimeout: 5 * time.Second,
+		TLSConfig: TLSConfig}
+}
+
+// serve over TLS if TLSConfig is set, until the server is shut down
+func serve(server *http.Server) error {
+	fmt.Println("listening ...")
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
 	}
-	w.Write([]byte(hex.EncodeToString(bz)))
+	return server.ListenAndServe()
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smartbch/egvm/keygrantor"
+)
+
+// Generate a master key which is never saved, split it and hand each share to one peer through
+// '/xshare'. The master key only lives in this process, which returns after dealing.
+func runDealer(split string, listenAddr string) {
+	params := strings.Split(split, ",")
+	if len(params) != 2 {
+		panic("split must be 't,N'")
+	}
+	threshold, err := strconv.Atoi(params[0])
+	if err != nil {
+		panic(err)
+	}
+	total, err := strconv.Atoi(params[1])
+	if err != nil {
+		panic(err)
+	}
+	dealer, err := keygrantor.NewDealer(keygrantor.GetRandomExtPrivKey(), threshold, total,
+		keygrantor.RandReader{}, keygrantor.EgoAttester{}, keygrantor.EgoVerifier{})
+	if err != nil {
+		panic(err)
+	}
+	dealer.Policy = Policy
+	dealer.TLSCert = TLSCert
+	fmt.Printf("dealing %d shares of %s with threshold %d\n", total, dealer.Xpub(), threshold)
+	mux := http.NewServeMux()
+	dealer.RegisterHandlers(mux)
+	server := newHttpServer(listenAddr, mux)
+	go func() {
+		if err := serve(server); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	// stop once all the shares are dealt, so no share is served again
+	<-dealer.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("all shares are dealt")
+}
+
+// In the threshold mode, this keygrantor only serves the shares of derived keys
+func createAndStartThresholdHttpServer(listenAddr string, share *keygrantor.MasterKeyShare) {
+	mux := http.NewServeMux()
+	server := &keygrantor.ThresholdServer{
+		Share:    share,
+		Attester: keygrantor.EgoAttester{},
+		Verifier: keygrantor.EgoVerifier{},
+		Policy:   Policy,
+		Audit:    Audit,
+		TLSCert:  TLSCert,
+	}
+	server.RegisterHandlers(mux)
+	fmt.Printf("threshold mode, share %d of %d, threshold %d\n", share.Index, share.Total, share.Threshold)
+	listenAndServe(listenAddr, mux)
+}
@@ -0,0 +1,393 @@
+package keygrantor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip32"
+)
+
+var (
+	ErrCounterMismatch     = errors.New("counter does not match the expected value")
+	ErrCounterSigMismatch  = errors.New("counter response signature mismatch")
+	ErrCounterRespMismatch = errors.New("counter response does not match the request")
+
+	// The counter responses are signed with a key derived from the master key at this hash,
+	// so clients can get the signer's pubkey from the attested xpub
+	CounterKeyHash = sha256.Sum256([]byte("egvm.counter"))
+)
+
+// MonotonicCounter keeps a counter for each key, which can only move forward
+type MonotonicCounter interface {
+	// Get returns the current value, which is zero for an unknown key
+	Get(key [32]byte) (uint64, error)
+	// Increase adds one to the counter if its current value equals 'expected', and returns the new value
+	Increase(key [32]byte, expected uint64) (uint64, error)
+}
+
+// FileCounter is a MonotonicCounter persisted in a local file. The optional seal/unseal functions
+// can encrypt the file, e.g. with ecrypto inside an enclave. It only moves forward while the file does:
+// the host can restore an older copy of the file, so it does not protect against the host it runs on.
+type FileCounter struct {
+	lock   sync.Mutex
+	fname  string
+	seal   func([]byte) ([]byte, error)
+	unseal func([]byte) ([]byte, error)
+	values map[string]uint64
+}
+
+var _ MonotonicCounter = (*FileCounter)(nil)
+
+func NewFileCounter(fname string, seal, unseal func([]byte) ([]byte, error)) (*FileCounter, error) {
+	fc := &FileCounter{fname: fname, seal: seal, unseal: unseal, values: make(map[string]uint64)}
+	fileData, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return fc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if unseal != nil {
+		fileData, err = unseal(fileData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unseal counter file: %w", err)
+		}
+	}
+	err = json.Unmarshal(fileData, &fc.values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode counter file: %w", err)
+	}
+	return fc, nil
+}
+
+func (fc *FileCounter) Get(key [32]byte) (uint64, error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.values[hex.EncodeToString(key[:])], nil
+}
+
+func (fc *FileCounter) Increase(key [32]byte, expected uint64) (uint64, error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	k := hex.EncodeToString(key[:])
+	if fc.values[k] != expected {
+		return 0, ErrCounterMismatch
+	}
+	fc.values[k] = expected + 1
+	err := fc.save()
+	if err != nil {
+		fc.values[k] = expected
+		return 0, err
+	}
+	return expected + 1, nil
+}
+
+// write to a temporary file and then rename it, so a crash never leaves a half-written file
+func (fc *FileCounter) save() error {
+	bz, err := json.Marshal(fc.values)
+	if err != nil {
+		return err
+	}
+	if fc.seal != nil {
+		bz, err = fc.seal(bz)
+		if err != nil {
+			return err
+		}
+	}
+	tmpName := fc.fname + ".tmp"
+	err = os.WriteFile(tmpName, bz, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fc.fname)
+}
+
+// CounterResponse is returned by keygrantor's counter endpoints
+type CounterResponse struct {
+	Key   string `json:"key"`
+	Value uint64 `json:"value"`
+	Nonce string `json:"nonce"`
+	Sig   string `json:"sig"`
+}
+
+func counterRespHash(key [32]byte, value uint64, nonce []byte) []byte {
+	var valueBz [8]byte
+	binary.BigEndian.PutUint64(valueBz[:], value)
+	h := sha256.New()
+	h.Write(key[:])
+	h.Write(valueBz[:])
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// Sign a counter value with a nonce chosen by the client, so the response cannot be replayed
+func SignCounterResponse(signKey *bip32.Key, key [32]byte, value uint64, nonce []byte) (*CounterResponse, error) {
+	prv, err := gethcrypto.ToECDSA(signKey.Key)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := gethcrypto.Sign(counterRespHash(key, value, nonce), prv)
+	if err != nil {
+		return nil, err
+	}
+	return &CounterResponse{
+		Key:   hex.EncodeToString(key[:]),
+		Value: value,
+		Nonce: hex.EncodeToString(nonce),
+		Sig:   hex.EncodeToString(sig),
+	}, nil
+}
+
+// Verify a counter response against the request's key and nonce, and the signer's pubkey
+func VerifyCounterResponse(signerPubKey []byte, key [32]byte, nonce []byte, resp *CounterResponse) error {
+	if resp.Key != hex.EncodeToString(key[:]) || resp.Nonce != hex.EncodeToString(nonce) {
+		return ErrCounterRespMismatch
+	}
+	sig, err := hex.DecodeString(resp.Sig)
+	if err != nil || len(sig) != 65 {
+		return ErrCounterSigMismatch
+	}
+	if !gethcrypto.VerifySignature(signerPubKey, counterRespHash(key, resp.Value, nonce), sig[:64]) {
+		return ErrCounterSigMismatch
+	}
+	return nil
+}
+
+// Parse query parameter 'nonce', which the requester's report must attest
+func parseCounterNonce(r *http.Request) ([]byte, error) {
+	nonce, err := hex.DecodeString(r.URL.Query().Get("nonce"))
+	if err != nil || len(nonce) == 0 || len(nonce) > 64 {
+		return nil, errors.New("nonce must be 1~64 bytes in hex")
+	}
+	return nonce, nil
+}
+
+// Check the requester's report like '/getkey' does, with sha256(nonce) in place of sha256(pubkey),
+// and return the key of its counter. The counters are scoped to the requester: the name chosen by
+// the requester, in the last 32 bytes of the report data, is hashed with its identity by
+// DerivationHash, as the derived keys are.
+func handleCounterRequest(w http.ResponseWriter, r *http.Request, verifier Verifier, policy *Policy) (key [32]byte, nonce []byte, ok bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("only POST is allowed"))
+		return key, nil, false
+	}
+	nonce, err := parseCounterNonce(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return key, nil, false
+	}
+	report, params := handleGetKeyParam(w, r, nonce, verifier, policy, nil)
+	if report == nil {
+		return key, nil, false
+	}
+	key, err = DerivationHash(report, params.Mode, params.MinSVN)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return key, nil, false
+	}
+	return key, nonce, true
+}
+
+func writeCounterResponse(w http.ResponseWriter, signKey *bip32.Key, key [32]byte, value uint64, nonce []byte) {
+	resp, err := SignCounterResponse(signKey, key, value, nonce)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("failed to sign counter: " + err.Error()))
+		return
+	}
+	bz, _ := json.Marshal(resp)
+	w.Write(bz)
+}
+
+// Handle '/counter?nonce=' which returns the signed current value of the requester's counter. The
+// value can be rolled back with the counter's storage, e.g. the file of a FileCounter on this host.
+func HandleCounterGet(counter MonotonicCounter, signKey *bip32.Key, verifier Verifier, policy *Policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, nonce, ok := handleCounterRequest(w, r, verifier, policy)
+		if !ok {
+			return
+		}
+		value, err := counter.Get(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("failed to get counter: " + err.Error()))
+			return
+		}
+		writeCounterResponse(w, signKey, key, value, nonce)
+	}
+}
+
+// Handle '/counter/increase?expected=&nonce=' which returns the signed new value of the
+// requester's counter
+func HandleCounterIncrease(counter MonotonicCounter, signKey *bip32.Key, verifier Verifier, policy *Policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected, err := strconv.ParseUint(r.URL.Query().Get("expected"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid expected parameter"))
+			return
+		}
+		key, nonce, ok := handleCounterRequest(w, r, verifier, policy)
+		if !ok {
+			return
+		}
+		value, err := counter.Increase(key, expected)
+		if errors.Is(err, ErrCounterMismatch) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("failed to increase counter: " + err.Error()))
+			return
+		}
+		writeCounterResponse(w, signKey, key, value, nonce)
+	}
+}
+
+// HttpCounter is the client of keygrantor's counter endpoints, which attests each request with
+// DefaultAttester. Its keys are names within the counters of this enclave, which keygrantor binds
+// to the enclave's identity by Mode and MinSVN as it binds the derived keys. Every response is
+// checked against the signer's pubkey derived from the keygrantor's xpub.
+type HttpCounter struct {
+	Mode        string      // KeyModeUnique if empty
+	MinSVN      uint        // only for KeyModeSigner
+	ReportCheck ReportCheck // checks keygrantor's identity over https, if not nil
+
+	url          string
+	signerPubKey []byte
+}
+
+var _ MonotonicCounter = (*HttpCounter)(nil)
+
+func NewHttpCounter(keyGrantorUrl string, xpub *bip32.Key) *HttpCounter {
+	return &HttpCounter{
+		url:          keyGrantorUrl,
+		signerPubKey: DeriveKey(xpub.PublicKey(), CounterKeyHash).Key,
+	}
+}
+
+func (hc *HttpCounter) Get(key [32]byte) (uint64, error) {
+	return hc.request("/counter", "", key)
+}
+
+func (hc *HttpCounter) Increase(key [32]byte, expected uint64) (uint64, error) {
+	return hc.request("/counter/increase", "&expected="+strconv.FormatUint(expected, 10), key)
+}
+
+func (hc *HttpCounter) request(path, query string, key [32]byte) (uint64, error) {
+	nonce := GenerateRandomBytes(32)
+	nonceHash := sha256.Sum256(nonce)
+	data := append(nonceHash[:], key[:]...)
+	reportBz, err := DefaultAttester.RemoteReport(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remote report: %w", err)
+	}
+	token, err := DefaultAttester.Token(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create attestation report: %w", err)
+	}
+	// the key of the counter as keygrantor scopes it to this enclave
+	selfReport, err := DefaultAttester.SelfReport()
+	if err != nil {
+		return 0, err
+	}
+	selfReport.Data = data
+	scopedKey, err := DerivationHash(&selfReport, hc.Mode, hc.MinSVN)
+	if err != nil {
+		return 0, err
+	}
+	params := GetKeyParams{Report: hex.EncodeToString(reportBz), JWT: token, Mode: hc.Mode, MinSVN: hc.MinSVN}
+	jsonReq, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	url := hc.url + path + "?nonce=" + hex.EncodeToString(nonce) + query
+	client, err := keyGrantorClient(hc.url, hc.ReportCheck)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(jsonReq))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return 0, ErrCounterMismatch
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to access counter, http status:%s, content:%s", resp.Status, string(body))
+	}
+	var counterResp CounterResponse
+	err = json.Unmarshal(body, &counterResp)
+	if err != nil {
+		return 0, err
+	}
+	err = VerifyCounterResponse(hc.signerPubKey, scopedKey, nonce, &counterResp)
+	if err != nil {
+		return 0, err
+	}
+	return counterResp.Value, nil
+}
+
+// Get the extended public key of the latest epoch served at '/xpub'
+func GetXpubFromKeyGrantor(keyGrantorUrl string) (*bip32.Key, error) {
+	xpub, _, err := GetEpochXpubFromKeyGrantor(keyGrantorUrl, LatestEpoch)
+	return xpub, err
+}
+
+// Get the extended public key of an epoch, which can be LatestEpoch, and the epoch of the key
+func GetEpochXpubFromKeyGrantor(keyGrantorUrl string, epoch int64) (*bip32.Key, int64, error) {
+	return getEpochXpubFromKeyGrantor(keyGrantorUrl, epoch, nil)
+}
+
+func getEpochXpubFromKeyGrantor(keyGrantorUrl string, epoch int64, check ReportCheck) (*bip32.Key, int64, error) {
+	url := keyGrantorUrl + "/xpub"
+	if epoch != LatestEpoch {
+		url += "?epoch=" + strconv.FormatInt(epoch, 10)
+	}
+	client, err := keyGrantorClient(url, check)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to get xpub, http status:%s, content:%s", resp.Status, string(body))
+	}
+	resEpoch, err := parseEpochHeader(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse key epoch: %w", err)
+	}
+	xpub, err := bip32.B58Deserialize(string(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	return xpub, resEpoch, nil
+}
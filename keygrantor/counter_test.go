@@ -0,0 +1,96 @@
+package keygrantor
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tyler-smith/go-bip32"
+)
+
+func TestFileCounter(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "counter.txt")
+	fc, err := NewFileCounter(fname, nil, nil)
+	require.NoError(t, err)
+	key := sha256.Sum256([]byte("script"))
+
+	v, err := fc.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, v)
+	v, err = fc.Increase(key, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v)
+	_, err = fc.Increase(key, 0)
+	require.ErrorIs(t, err, ErrCounterMismatch)
+
+	// reload from file
+	fc, err = NewFileCounter(fname, nil, nil)
+	require.NoError(t, err)
+	v, err = fc.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v)
+}
+
+func TestHttpCounter(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	seed := sha256.Sum256([]byte("counter test"))
+	masterKey, err := bip32.NewMasterKey(seed[:])
+	require.NoError(t, err)
+	fc, err := NewFileCounter(filepath.Join(t.TempDir(), "counter.txt"), nil, nil)
+	require.NoError(t, err)
+
+	signKey := DeriveKey(masterKey, CounterKeyHash)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/counter", HandleCounterGet(fc, signKey, mock, nil))
+	mux.HandleFunc("/counter/increase", HandleCounterIncrease(fc, signKey, mock, nil))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	key := sha256.Sum256([]byte("script"))
+	hc := NewHttpCounter(server.URL, masterKey.PublicKey())
+	v, err := hc.Increase(key, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v)
+	v, err = hc.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v)
+	_, err = hc.Increase(key, 0)
+	require.ErrorIs(t, err, ErrCounterMismatch)
+
+	// the counter is scoped to the enclave, not to the bare key
+	v, err = fc.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, v)
+	DefaultAttester = NewMockAttestation(mock.signKey, newTestReport("another enclave"))
+	v, err = hc.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, v)
+
+	// the requests without an attested report are rejected
+	resp, err := http.Post(server.URL+"/counter/increase?expected=1&nonce=01", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(server.URL + "/counter?nonce=01")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// so are the debug enclaves, by the default policy
+	debugReport := newTestReport("client enclave")
+	debugReport.Debug = true
+	DefaultAttester = NewMockAttestation(mock.signKey, debugReport)
+	_, err = hc.Get(key)
+	require.ErrorContains(t, err, "403")
+
+	// responses signed by another keygrantor are rejected
+	DefaultAttester = mock
+	otherSeed := sha256.Sum256([]byte("other keygrantor"))
+	otherKey, err := bip32.NewMasterKey(otherSeed[:])
+	require.NoError(t, err)
+	_, err = NewHttpCounter(server.URL, otherKey.PublicKey()).Get(key)
+	require.ErrorIs(t, err, ErrCounterSigMismatch)
+}
@@ -0,0 +1,274 @@
+package keygrantor
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/tyler-smith/go-bip32"
+)
+
+// LatestEpoch asks for the key of the current epoch
+const LatestEpoch = -1
+
+// KeyEpochHeader carries the epoch of the key in the responses of '/xpub', '/xprv' and '/getkey'.
+// The keys of '/xprv', '/getkey' and '/migratekey' carry their epoch in the encrypted payload, too,
+// which is the one trusted.
+const KeyEpochHeader = "X-Key-Epoch"
+
+var (
+	ErrUnknownEpoch      = errors.New("unknown key epoch")
+	ErrKeyRingDiverged   = errors.New("key ring differs from the upstream keygrantor's")
+	ErrInvalidKeyPayload = errors.New("invalid key payload")
+)
+
+// KeyRing holds the master keys of all the epochs. The last one is current and is used for new
+// keys, while the old ones are kept so that the data protected by them can still be decrypted.
+// The optional seal/unseal functions can encrypt the file, e.g. with ecrypto inside an enclave.
+type KeyRing struct {
+	lock   sync.RWMutex
+	fname  string
+	seal   func([]byte) ([]byte, error)
+	unseal func([]byte) ([]byte, error)
+	keys   []*bip32.Key // index is the epoch
+}
+
+func NewKeyRing(fname string, seal, unseal func([]byte) ([]byte, error)) (*KeyRing, error) {
+	kr := &KeyRing{fname: fname, seal: seal, unseal: unseal}
+	fileData, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return kr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if unseal != nil {
+		fileData, err = unseal(fileData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unseal key ring file: %w", err)
+		}
+	}
+	var xprvs []string
+	err = json.Unmarshal(fileData, &xprvs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key ring file: %w", err)
+	}
+	for _, xprv := range xprvs {
+		key, err := bip32.B58Deserialize(xprv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize xprv in key ring: %w", err)
+		}
+		kr.keys = append(kr.keys, key)
+	}
+	return kr, nil
+}
+
+// Len returns the number of epochs
+func (kr *KeyRing) Len() int {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return len(kr.keys)
+}
+
+// Current returns the key of the latest epoch
+func (kr *KeyRing) Current() (int64, *bip32.Key, error) {
+	return kr.Get(LatestEpoch)
+}
+
+// Get returns the key of an epoch, or of the latest one if epoch is LatestEpoch
+func (kr *KeyRing) Get(epoch int64) (int64, *bip32.Key, error) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	if epoch == LatestEpoch {
+		epoch = int64(len(kr.keys)) - 1
+	}
+	if epoch < 0 || epoch >= int64(len(kr.keys)) {
+		return 0, nil, ErrUnknownEpoch
+	}
+	return epoch, kr.keys[epoch], nil
+}
+
+// Append adds the key as a new epoch and returns its epoch
+func (kr *KeyRing) Append(key *bip32.Key) (int64, error) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	kr.keys = append(kr.keys, key)
+	err := kr.save()
+	if err != nil {
+		kr.keys = kr.keys[:len(kr.keys)-1]
+		return 0, err
+	}
+	return int64(len(kr.keys)) - 1, nil
+}
+
+// Xprvs returns the serialized keys of all the epochs
+func (kr *KeyRing) Xprvs() []string {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.xprvs()
+}
+
+func (kr *KeyRing) xprvs() []string {
+	xprvs := make([]string, len(kr.keys))
+	for i, key := range kr.keys {
+		xprvs[i] = key.B58Serialize()
+	}
+	return xprvs
+}
+
+// write to a temporary file and then rename it, so a crash never leaves a half-written file
+func (kr *KeyRing) save() error {
+	bz, err := json.Marshal(kr.xprvs())
+	if err != nil {
+		return err
+	}
+	if kr.seal != nil {
+		bz, err = kr.seal(bz)
+		if err != nil {
+			return err
+		}
+	}
+	tmpName := kr.fname + ".tmp"
+	err = os.WriteFile(tmpName, bz, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, kr.fname)
+}
+
+// ParseEpochQuery parses the optional 'epoch' query parameter, which is LatestEpoch when missing
+func ParseEpochQuery(r *http.Request) (int64, error) {
+	s := r.URL.Query().Get("epoch")
+	if len(s) == 0 {
+		return LatestEpoch, nil
+	}
+	epoch, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || epoch < 0 {
+		return 0, errors.New("epoch must be a non-negative integer")
+	}
+	return epoch, nil
+}
+
+// The encrypted payload of a key: uint64BE(epoch) || serialized key
+func encodeEpochKey(epoch int64, key *bip32.Key) []byte {
+	keyBz, _ := key.Serialize()
+	bz := make([]byte, 8, 8+len(keyBz))
+	binary.BigEndian.PutUint64(bz, uint64(epoch))
+	return append(bz, keyBz...)
+}
+
+func decodeEpochKey(bz []byte) (int64, *bip32.Key, error) {
+	if len(bz) <= 8 || int64(binary.BigEndian.Uint64(bz)) < 0 {
+		return 0, nil, ErrInvalidKeyPayload
+	}
+	key, err := bip32.Deserialize(bz[8:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to deserialize the key from server: %w", err)
+	}
+	return int64(binary.BigEndian.Uint64(bz)), key, nil
+}
+
+func parseEpochHeader(resp *http.Response) (int64, error) {
+	s := resp.Header.Get(KeyEpochHeader)
+	if len(s) == 0 { // servers before key rotation only have epoch 0
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// SyncKeyRing fetches the epochs missing in the key ring from an upstream keygrantor's '/xprv',
+// after checking that the epochs already in the key ring are the same as the upstream's
+func SyncKeyRing(kr *KeyRing, keyGrantorUrl string) error {
+	check, err := samePeerCheck()
+	if err != nil {
+		return err
+	}
+	getEpochKey := func(epoch int64) (*bip32.Key, int64, error) {
+		return getKeyFromKeyGrantor(keyGrantorUrl, nil, KeyOptions{Epoch: epoch}, check)
+	}
+	latestKey, latestEpoch, err := getEpochKey(LatestEpoch)
+	if err != nil {
+		return err
+	}
+	if int64(kr.Len()) > latestEpoch+1 {
+		return fmt.Errorf("%w: %d epochs but the upstream has %d", ErrKeyRingDiverged, kr.Len(), latestEpoch+1)
+	}
+	for epoch := int64(0); epoch < int64(kr.Len()); epoch++ {
+		upstreamKey := latestKey
+		if epoch != latestEpoch {
+			upstreamKey, _, err = getEpochKey(epoch)
+			if err != nil {
+				return err
+			}
+		}
+		_, key, _ := kr.Get(epoch)
+		if key.B58Serialize() != upstreamKey.B58Serialize() {
+			return fmt.Errorf("%w: epoch %d", ErrKeyRingDiverged, epoch)
+		}
+	}
+	for epoch := int64(kr.Len()); epoch <= latestEpoch; epoch++ {
+		key := latestKey
+		if epoch != latestEpoch {
+			key, _, err = getEpochKey(epoch)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = kr.Append(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportKeyRing fetches all the epochs from the '/exportkeys' of an old keygrantor, whose policy
+// allows this enclave, into an empty key ring. This enclave must be an upgrade of the old keygrantor,
+// and the old keygrantor's '/report' must endorse the latest key.
+func ImportKeyRing(kr *KeyRing, keyGrantorUrl string) error {
+	if kr.Len() != 0 {
+		return errors.New("key ring is not empty")
+	}
+	selfReport, err := DefaultAttester.SelfReport()
+	if err != nil {
+		return err
+	}
+	check := func(report *attestation.Report) error {
+		return VerifyUpgradeReport(*report, selfReport)
+	}
+	bz, _, err := postWithAttestation(keyGrantorUrl+"/exportkeys", "", nil, GetKeyParams{}, check)
+	if err != nil {
+		return err
+	}
+	var xprvs []string
+	err = json.Unmarshal(bz, &xprvs)
+	if err != nil {
+		return err
+	}
+	var keys []*bip32.Key
+	for _, xprv := range xprvs {
+		key, err := bip32.B58Deserialize(xprv)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize the exported xprv: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errors.New("no key exported")
+	}
+	_, err = getXpubReport(keyGrantorUrl, keys[len(keys)-1].PublicKey().B58Serialize(), LatestEpoch, check)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err = kr.Append(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
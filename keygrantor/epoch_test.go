@@ -0,0 +1,104 @@
+package keygrantor
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tyler-smith/go-bip32"
+)
+
+func newTestMasterKey(t *testing.T, seed string) *bip32.Key {
+	seedHash := sha256.Sum256([]byte(seed))
+	key, err := bip32.NewMasterKey(seedHash[:])
+	require.NoError(t, err)
+	return key
+}
+
+func TestKeyRing(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "keyring.txt")
+	kr, err := NewKeyRing(fname, nil, nil)
+	require.NoError(t, err)
+	_, _, err = kr.Current()
+	require.ErrorIs(t, err, ErrUnknownEpoch)
+
+	k0, k1 := newTestMasterKey(t, "epoch 0"), newTestMasterKey(t, "epoch 1")
+	epoch, err := kr.Append(k0)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	epoch, err = kr.Append(k1)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+
+	// reload from file, the old epoch is kept
+	kr, err = NewKeyRing(fname, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, kr.Len())
+	epoch, key, err := kr.Current()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+	require.Equal(t, k1.B58Serialize(), key.B58Serialize())
+	epoch, key, err = kr.Get(0)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	require.Equal(t, k0.B58Serialize(), key.B58Serialize())
+	_, _, err = kr.Get(2)
+	require.ErrorIs(t, err, ErrUnknownEpoch)
+}
+
+func TestParseEpochQuery(t *testing.T) {
+	epoch, err := ParseEpochQuery(httptest.NewRequest("GET", "/xpub", nil))
+	require.NoError(t, err)
+	require.EqualValues(t, LatestEpoch, epoch)
+	epoch, err = ParseEpochQuery(httptest.NewRequest("GET", "/xpub?epoch=3", nil))
+	require.NoError(t, err)
+	require.EqualValues(t, 3, epoch)
+	_, err = ParseEpochQuery(httptest.NewRequest("GET", "/xpub?epoch=-1", nil))
+	require.Error(t, err)
+}
+
+func TestGetEpochXpubFromKeyGrantor(t *testing.T) {
+	kr, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	_, err = kr.Append(newTestMasterKey(t, "epoch 0"))
+	require.NoError(t, err)
+	_, err = kr.Append(newTestMasterKey(t, "epoch 1"))
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		epoch, err := ParseEpochQuery(r)
+		require.NoError(t, err)
+		epoch, key, err := kr.Get(epoch)
+		require.NoError(t, err)
+		w.Header().Set(KeyEpochHeader, strconv.FormatInt(epoch, 10))
+		w.Write([]byte(key.PublicKey().B58Serialize()))
+	}))
+	defer server.Close()
+
+	xpub, epoch, err := GetEpochXpubFromKeyGrantor(server.URL, LatestEpoch)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+	require.Equal(t, newTestMasterKey(t, "epoch 1").PublicKey().B58Serialize(), xpub.B58Serialize())
+	xpub, epoch, err = GetEpochXpubFromKeyGrantor(server.URL, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	require.Equal(t, newTestMasterKey(t, "epoch 0").PublicKey().B58Serialize(), xpub.B58Serialize())
+}
+
+func TestEpochKeyPayload(t *testing.T) {
+	key := newTestMasterKey(t, "epoch 3")
+	epoch, decoded, err := decodeEpochKey(encodeEpochKey(3, key))
+	require.NoError(t, err)
+	require.EqualValues(t, 3, epoch)
+	require.Equal(t, key.B58Serialize(), decoded.B58Serialize())
+
+	keyBz, err := key.Serialize()
+	require.NoError(t, err)
+	_, _, err = decodeEpochKey(keyBz[:8])
+	require.ErrorIs(t, err, ErrInvalidKeyPayload)
+	_, _, err = decodeEpochKey(append(make([]byte, 7), keyBz...))
+	require.Error(t, err)
+}
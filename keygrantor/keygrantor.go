@@ -3,6 +3,7 @@ package keygrantor
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -11,13 +12,11 @@ import (
 	"math/big"
 	"net/http"
 	"os"
-	"time"
+	"strconv"
 
 	ecies "github.com/ecies/go/v2"
 	"github.com/edgelesssys/ego/attestation"
 	"github.com/edgelesssys/ego/attestation/tcbstatus"
-	"github.com/edgelesssys/ego/ecrypto"
-	"github.com/edgelesssys/ego/enclave"
 	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 	"github.com/tyler-smith/go-bip32"
 )
@@ -33,6 +32,10 @@ var (
 	ErrProductIDMismatch  = errors.New("ProductID Mismatch")
 	ErrReportDataMismatch = errors.New("ReportData Mismatch")
 
+	ErrUnknownKeyMode        = errors.New("unknown key mode")
+	ErrSecurityVersionTooLow = errors.New("SecurityVersion is lower than the requested MinSVN")
+	ErrSecurityDowngrade     = errors.New("SecurityVersion is lower than the old version's")
+
 	AttestationProviderURLs = []string{
 		"https://sharedeus2.eus2.attest.azure.net",
 		"https://sharedcus.cus.attest.azure.net",
@@ -45,6 +48,64 @@ var (
 type GetKeyParams struct {
 	Report string `json:"Report"`
 	JWT    string `json:"JWT"`
+	// how the derived key is bound to the requestor, KeyModeUnique if empty
+	Mode string `json:"Mode,omitempty"`
+	// in KeyModeSigner, only the enclaves whose SecurityVersion >= MinSVN can get the key
+	MinSVN uint `json:"MinSVN,omitempty"`
+	// only for '/migratekey': the old UniqueID in hex, whose derived key is requested
+	MigrateFrom string `json:"MigrateFrom,omitempty"`
+}
+
+const (
+	// The key is bound to the UniqueID (MRENCLAVE), so it changes with every build of the enclave
+	KeyModeUnique = "unique"
+	// The key is bound to the SignerID (MRSIGNER), ProductID and a minimum SecurityVersion, so it
+	// stays the same across the upgrades signed by the same signer, while the enclaves of lower
+	// SecurityVersion, e.g. the vulnerable old ones, cannot get it
+	KeyModeSigner = "signer"
+
+	keyModeSignerTag = "egvm.signer.v1"
+)
+
+// KeyOptions are the optional parameters of getting a key from keygrantor
+type KeyOptions struct {
+	Epoch  int64  // LatestEpoch for the latest one
+	Mode   string // KeyModeUnique if empty
+	MinSVN uint   // only for KeyModeSigner
+}
+
+// DerivationHash returns the hash which keygrantor derives the key of a requestor with:
+//
+//	KeyModeUnique: sha256(UniqueID || clientData)
+//	KeyModeSigner: sha256("egvm.signer.v1" || SignerID || ProductID || uint64BE(MinSVN) || clientData)
+//
+// where clientData is the last 32 bytes of the report data
+func DerivationHash(report *attestation.Report, mode string, minSVN uint) ([32]byte, error) {
+	clientData := make([]byte, 32)
+	if len(report.Data) > 32 {
+		copy(clientData, report.Data[32:])
+	}
+	switch mode {
+	case "", KeyModeUnique:
+		return sha256.Sum256(append(append([]byte{}, report.UniqueID...), clientData...)), nil
+	case KeyModeSigner:
+		if report.SecurityVersion < minSVN {
+			return [32]byte{}, ErrSecurityVersionTooLow
+		}
+		var svnBz [8]byte
+		binary.BigEndian.PutUint64(svnBz[:], uint64(minSVN))
+		h := sha256.New()
+		h.Write([]byte(keyModeSignerTag))
+		h.Write(report.SignerID)
+		h.Write(report.ProductID)
+		h.Write(svnBz[:])
+		h.Write(clientData)
+		var out [32]byte
+		copy(out[:], h.Sum(nil))
+		return out, nil
+	default:
+		return [32]byte{}, ErrUnknownKeyMode
+	}
 }
 
 // Use Intel CPU's true random number generator to get random data
@@ -103,14 +164,14 @@ func DeriveKey(key *bip32.Key, hash [32]byte) *bip32.Key {
 	return key
 }
 
-// Encrypt the extended private key with a key derived from a measurement of the enclave, and
-// then save the encrypted key to file
+// Encrypt the extended private key with a key derived from a measurement of the enclave, which
+// is chosen by SealMode, and then save the encrypted key to file
 func SealKeyToFile(fname string, extPrivKey *bip32.Key) {
 	bz, err := extPrivKey.Serialize()
 	if err != nil {
 		panic(err)
 	}
-	out, err := ecrypto.SealWithUniqueKey(bz, nil)
+	out, err := Seal(bz)
 	if err != nil {
 		panic(err)
 	}
@@ -130,7 +191,7 @@ func RecoverKeyFromFile(fname string) (extPrivKey *bip32.Key, fileExists bool) {
 		}
 		panic(err)
 	}
-	rawData, err := ecrypto.Unseal(fileData, nil)
+	rawData, err := Unseal(fileData)
 	if err != nil {
 		fmt.Printf("unseal file data failed, %s\n", err.Error())
 		panic(err)
@@ -145,26 +206,31 @@ func RecoverKeyFromFile(fname string) (extPrivKey *bip32.Key, fileExists bool) {
 
 // Get SelfReport and check it against RemoteReport of the same enclave
 func GetSelfReportAndCheck() attestation.Report {
-	selfReport, err := enclave.GetSelfReport()
+	selfReport, err := CheckSelfReport(DefaultAttester, DefaultVerifier)
 	if err != nil {
 		panic(err)
 	}
-	if selfReport.Debug {
-		panic(ErrInDebugMode)
-	}
-	reportBytes, err := enclave.GetRemoteReport([]byte{0x01})
+	return selfReport
+}
+
+// The same as GetSelfReportAndCheck, but with the given Attester and Verifier and returns the error
+func CheckSelfReport(attester Attester, verifier Verifier) (attestation.Report, error) {
+	selfReport, err := attester.SelfReport()
 	if err != nil {
-		panic(err)
+		return selfReport, err
+	}
+	if selfReport.Debug {
+		return selfReport, ErrInDebugMode
 	}
-	report, err := enclave.VerifyRemoteReport(reportBytes)
+	reportBytes, err := attester.RemoteReport([]byte{0x01})
 	if err != nil {
-		panic(err)
+		return selfReport, err
 	}
-	err = VerifyPeerReport(report, selfReport)
+	report, err := verifier.VerifyRemoteReport(reportBytes)
 	if err != nil {
-		panic(err)
+		return selfReport, err
 	}
-	return selfReport
+	return selfReport, VerifyPeerReport(report, selfReport)
 }
 
 // Verify report against selfReport to ensure they are from the same enclave.
@@ -187,10 +253,75 @@ func VerifyPeerReport(report, selfReport attestation.Report) error {
 	return nil
 }
 
+// samePeerCheck returns a ReportCheck which only accepts the keygrantors of the same UniqueID and
+// SignerID as this enclave
+func samePeerCheck() (ReportCheck, error) {
+	selfReport, err := DefaultAttester.SelfReport()
+	if err != nil {
+		return nil, err
+	}
+	return func(report *attestation.Report) error {
+		return checkIdentity(report, selfReport.SignerID, selfReport.UniqueID)
+	}, nil
+}
+
+// Verify that the enclave of newReport is an upgrade of the one of oldReport: neither is in debug
+// mode, they have the same SignerID and ProductID, and the SecurityVersion does not go down.
+func VerifyUpgradeReport(oldReport, newReport attestation.Report) error {
+	if oldReport.Debug || newReport.Debug {
+		return ErrInDebugMode
+	}
+	if !bytes.Equal(oldReport.SignerID, newReport.SignerID) {
+		return ErrSignerIDMismatch
+	}
+	if !bytes.Equal(oldReport.ProductID, newReport.ProductID) {
+		return ErrProductIDMismatch
+	}
+	if newReport.SecurityVersion < oldReport.SecurityVersion {
+		return ErrSecurityDowngrade
+	}
+	return nil
+}
+
 // Send a http post request using json payload
 func HttpPost(url string, jsonReq []byte) ([]byte, error) {
-	client := http.Client{Timeout: 3 * time.Second}
+	body, _, err := httpPost(url, jsonReq, nil)
+	return body, err
+}
+
+func httpPost(url string, jsonReq []byte, check ReportCheck) ([]byte, *http.Response, error) {
+	client, err := keyGrantorClient(url, check)
+	if err != nil {
+		return nil, nil, err
+	}
 	resp, err := client.Post(url, "application/json", bytes.NewReader(jsonReq))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to get key, http status:%s, content:%s", resp.Status, string(body))
+	}
+	return body, resp, nil
+}
+
+// Get the report from a keygrantor's '/report' on the xpub of an epoch, which can be LatestEpoch,
+// and check that it endorses xpub and passes check, if not nil. Over https, check is run before the
+// certificate is trusted, too.
+func getXpubReport(keyGrantorUrl, xpub string, epoch int64, check ReportCheck) (*attestation.Report, error) {
+	client, err := keyGrantorClient(keyGrantorUrl, check)
+	if err != nil {
+		return nil, err
+	}
+	url := keyGrantorUrl + "/report"
+	if epoch != LatestEpoch {
+		url += "?epoch=" + strconv.FormatInt(epoch, 10)
+	}
+	resp, err := client.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -200,9 +331,26 @@ func HttpPost(url string, jsonReq []byte) ([]byte, error) {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get key, http status:%s, content:%s", resp.Status, string(body))
+		return nil, fmt.Errorf("failed to get report, http status:%s, content:%s", resp.Status, string(body))
 	}
-	return body, nil
+	reportBz, err := hex.DecodeString(string(body))
+	if err != nil {
+		return nil, err
+	}
+	report, err := DefaultVerifier.VerifyRemoteReport(reportBz)
+	if err != nil {
+		return nil, err
+	}
+	xpubHash := sha256.Sum256([]byte(xpub))
+	if len(report.Data) < 32 || !bytes.Equal(report.Data[:32], xpubHash[:]) {
+		return nil, ErrReportDataMismatch
+	}
+	if check != nil {
+		if err = check(&report); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
 }
 
 // Return true if it's a valid secp256k1 private key
@@ -223,67 +371,143 @@ func GenerateEciesPrivateKey() *ecies.PrivateKey {
 
 // A downstream peer gets the main xprv key from the upstream peer with empty clientDatazero
 // An enclave gets its derived key from the upstream peer with non-empty clientData
+// Over https, the keygrantor's certificate must be attested by its '/report'
 func GetKeyFromKeyGrantor(keyGrantorUrl string, clientData []byte) (*bip32.Key, error) {
+	key, _, err := GetEpochKeyFromKeyGrantor(keyGrantorUrl, clientData, LatestEpoch)
+	return key, err
+}
+
+// The same as GetKeyFromKeyGrantor, but gets the key of a given epoch, which can be LatestEpoch.
+// The epoch of the returned key is returned, too.
+func GetEpochKeyFromKeyGrantor(keyGrantorUrl string, clientData []byte, epoch int64) (*bip32.Key, int64, error) {
+	return GetKeyFromKeyGrantorWithOptions(keyGrantorUrl, clientData, KeyOptions{Epoch: epoch})
+}
+
+// The same as GetKeyFromKeyGrantor, but with the epoch and key mode in options. The epoch of
+// the returned key is returned, too.
+func GetKeyFromKeyGrantorWithOptions(keyGrantorUrl string, clientData []byte, opts KeyOptions) (*bip32.Key, int64, error) {
+	return getKeyFromKeyGrantor(keyGrantorUrl, clientData, opts, nil)
+}
+
+// Over https, check is run on keygrantor's report before its certificate is trusted
+func getKeyFromKeyGrantor(keyGrantorUrl string, clientData []byte, opts KeyOptions, check ReportCheck) (*bip32.Key, int64, error) {
+	epoch := opts.Epoch
+	path := "/getkey"
+	if len(clientData) == 0 { // clientData is all zero
+		path = "/xprv"
+	}
+	query := ""
+	if epoch != LatestEpoch {
+		query = "epoch=" + strconv.FormatInt(epoch, 10)
+	}
+	params := GetKeyParams{Mode: opts.Mode, MinSVN: opts.MinSVN}
+	payload, _, err := postWithAttestation(keyGrantorUrl+path, query, clientData, params, check)
+	if err != nil {
+		return nil, 0, err
+	}
+	resEpoch, outKey, err := decodeEpochKey(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if epoch != LatestEpoch && resEpoch != epoch {
+		return nil, 0, fmt.Errorf("key epoch mismatch, want %d got %d", epoch, resEpoch)
+	}
+	return outKey, resEpoch, nil
+}
+
+// MigrateKeyFromKeyGrantor gets the key which an old version of this enclave, whose UniqueID is
+// oldUniqueID, got from '/getkey' with clientData, if keygrantor's policy allows the migration.
+func MigrateKeyFromKeyGrantor(keyGrantorUrl string, oldUniqueID, clientData []byte, epoch int64) (*bip32.Key, int64, error) {
+	return migrateKeyFromKeyGrantor(keyGrantorUrl, oldUniqueID, clientData, epoch, nil)
+}
+
+func migrateKeyFromKeyGrantor(keyGrantorUrl string, oldUniqueID, clientData []byte, epoch int64, check ReportCheck) (*bip32.Key, int64, error) {
+	query := ""
+	if epoch != LatestEpoch {
+		query = "epoch=" + strconv.FormatInt(epoch, 10)
+	}
+	params := GetKeyParams{MigrateFrom: hex.EncodeToString(oldUniqueID)}
+	payload, _, err := postWithAttestation(keyGrantorUrl+"/migratekey", query, clientData, params, check)
+	if err != nil {
+		return nil, 0, err
+	}
+	resEpoch, outKey, err := decodeEpochKey(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if epoch != LatestEpoch && resEpoch != epoch {
+		return nil, 0, fmt.Errorf("key epoch mismatch, want %d got %d", epoch, resEpoch)
+	}
+	return outKey, resEpoch, nil
+}
+
+// Post GetKeyParams to endpoint, whose report and JWT attest sha256(pubkey)||clientData, where pubkey
+// is a new ECIES key sent in the 'pubkey' query parameter. The response is decrypted with that key.
+// Over https, check is run on keygrantor's report before its certificate is trusted.
+func postWithAttestation(endpoint, query string, clientData []byte, params GetKeyParams, check ReportCheck) ([]byte, *http.Response, error) {
 	privKey := GenerateEciesPrivateKey()
 	pubkey := privKey.PublicKey.Bytes(true)
 	pubkeyHash := sha256.Sum256(pubkey)
 	data := append(pubkeyHash[:], clientData[:]...)
-	report, err := enclave.GetRemoteReport(data)
+	report, err := DefaultAttester.RemoteReport(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get remote report: %w", err)
-	}
-	var token string
-	for _, url := range AttestationProviderURLs {
-		token, err = enclave.CreateAzureAttestationToken(data, url)
-		if err == nil {
-			break
-		}
+		return nil, nil, fmt.Errorf("failed to get remote report: %w", err)
 	}
+	token, err := DefaultAttester.Token(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create attestation report: %w", err)
+		return nil, nil, fmt.Errorf("failed to create attestation report: %w", err)
 	}
-	url := "%s/getkey?pubkey=%s"
-	if len(clientData) == 0 { // clientData is all zero
-		url = "%s/xprv?pubkey=%s"
-	}
-	url = fmt.Sprintf(url, keyGrantorUrl, hex.EncodeToString(pubkey))
-	params := GetKeyParams{
-		Report: hex.EncodeToString(report),
-		JWT:    token,
+	url := endpoint + "?pubkey=" + hex.EncodeToString(pubkey)
+	if len(query) != 0 {
+		url += "&" + query
 	}
+	params.Report = hex.EncodeToString(report)
+	params.JWT = token
 	jsonReq, err := json.Marshal(params)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	res, err := HttpPost(url, jsonReq)
+	res, resp, err := httpPost(url, jsonReq, check)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get key: %w", err)
+		return nil, nil, fmt.Errorf("failed to get key: %w", err)
 	}
 	if res == nil {
-		return nil, fmt.Errorf("failed to get key: no resust data")
+		return nil, nil, fmt.Errorf("failed to get key: no resust data")
 	}
 	resBz, err := hex.DecodeString(string(res))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode key: %w", err)
+		return nil, nil, fmt.Errorf("failed to decode key: %w", err)
 	}
-	keyBz, err := ecies.Decrypt(privKey, resBz)
+	plaintext, err := ecies.Decrypt(privKey, resBz)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt message from server: %w", err)
+		return nil, nil, fmt.Errorf("failed to decrypt message from server: %w", err)
 	}
-	outKey, err := bip32.Deserialize(keyBz)
+	return plaintext, resp, nil
+}
+
+// Verify JWT and ensures it's from the same enclave that generates 'report'
+func VerifyJWT(token string, report attestation.Report) error {
+	tokenReport, err := DefaultVerifier.VerifyToken(token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize the key from server: %w", err)
+		return err
 	}
-	return outKey, nil
+	return VerifyPeerReport(tokenReport, report)
 }
 
-// Verify JWT and ensures it's from the same enclave that generates 'report'
-func VerifyJWT(token string, report attestation.Report) (err error) {
-	for _, url := range AttestationProviderURLs {
-		tokenReport, err := attestation.VerifyAzureAttestationToken(token, url)
-		if err == nil {
-			return VerifyPeerReport(tokenReport, report)
-		}
+// The same as VerifyJWT, but leaves the debug mode and the TCB status to the policy
+func verifyJWT(verifier Verifier, token string, report attestation.Report) error {
+	tokenReport, err := verifier.VerifyToken(token)
+	if err != nil && !errors.Is(err, attestation.ErrTCBLevelInvalid) {
+		return err
 	}
-	return
+	if tokenReport.Debug != report.Debug || !bytes.Equal(tokenReport.UniqueID, report.UniqueID) {
+		return ErrUniqueIDMismatch
+	}
+	if !bytes.Equal(tokenReport.SignerID, report.SignerID) {
+		return ErrSignerIDMismatch
+	}
+	if !bytes.Equal(tokenReport.ProductID, report.ProductID) {
+		return ErrProductIDMismatch
+	}
+	return nil
 }
@@ -0,0 +1,214 @@
+package keygrantor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+)
+
+var (
+	ErrPolicyEndpoint        = errors.New("endpoint is not allowed by the policy")
+	ErrPolicySignerID        = errors.New("SignerID is not allowed by the policy")
+	ErrPolicyProductID       = errors.New("ProductID is not allowed by the policy")
+	ErrPolicySecurityVersion = errors.New("SecurityVersion is lower than the policy's minimum")
+	ErrPolicyDebug           = errors.New("debug enclave is not allowed by the policy")
+	ErrPolicyTCBStatus       = errors.New("TCB status is not allowed by the policy")
+	ErrPolicyMigration       = errors.New("migration from the UniqueID is not allowed by the policy")
+)
+
+// EndpointPolicy lists the enclaves which can access an endpoint. An empty list allows any value.
+type EndpointPolicy struct {
+	SignerIDs          []string `json:"signer_ids"`  // in hex
+	ProductIDs         []uint64 `json:"product_ids"` // as the productID in enclave.json
+	MinSecurityVersion uint     `json:"min_security_version"`
+	AllowDebug         bool     `json:"allow_debug"`
+	// the names such as "UpToDate" and "SWHardeningNeeded", only "UpToDate" is allowed if empty
+	TCBStatuses []string `json:"tcb_statuses"`
+	// only for '/migratekey': the old UniqueIDs (in hex) whose keys can be migrated, none if empty
+	MigrateFrom []string `json:"migrate_from"`
+
+	signerIDs   [][]byte
+	tcbStatuses []tcbstatus.Status
+	migrateFrom [][]byte
+}
+
+// Policy maps the endpoints, such as "/getkey", to their EndpointPolicy. The endpoints missing
+// in the map are denied.
+type Policy struct {
+	Endpoints map[string]*EndpointPolicy `json:"endpoints"`
+}
+
+// EmbeddedPolicyFile is the only path a policy is loaded from. It must be embedded in the enclave
+// by the 'files' of enclave.json, so it is measured into the UniqueID, and is out of the mounts
+// of the host.
+const EmbeddedPolicyFile = "/policy.json"
+
+// The endpoints which hand keys or the audit log to other enclaves are denied when there is no policy
+var explicitPolicyEndpoints = map[string]bool{"/migratekey": true, "/exportkeys": true, "/audit": true}
+
+// The endpoints which hand out the master keys never allow debug enclaves, whatever the policy says.
+// The server also requires the same SignerID on them.
+var masterKeyEndpoints = map[string]bool{"/xprv": true, "/exportkeys": true}
+
+// DefaultEndpointPolicy is used when there is no policy. It allows any non-debug enclave with an
+// up-to-date TCB, as keygrantor did before policies were introduced.
+var DefaultEndpointPolicy = &EndpointPolicy{tcbStatuses: []tcbstatus.Status{tcbstatus.UpToDate}}
+
+func parseTCBStatus(name string) (tcbstatus.Status, error) {
+	for s := tcbstatus.UpToDate; s <= tcbstatus.Unknown; s++ {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown TCB status: %s", name)
+}
+
+// LoadEmbeddedPolicy reads the policy embedded at EmbeddedPolicyFile
+func LoadEmbeddedPolicy() (*Policy, error) {
+	bz, err := os.ReadFile(EmbeddedPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(bz)
+}
+
+// ParsePolicy parses a policy in JSON, and checks the SignerIDs and TCB statuses in it
+func ParsePolicy(bz []byte) (*Policy, error) {
+	var p Policy
+	err := json.Unmarshal(bz, &p)
+	if err != nil {
+		return nil, err
+	}
+	for endpoint, ep := range p.Endpoints {
+		if ep == nil {
+			return nil, fmt.Errorf("empty policy for %s", endpoint)
+		}
+		if ep.AllowDebug && masterKeyEndpoints[endpoint] {
+			return nil, fmt.Errorf("debug enclaves cannot be allowed for %s", endpoint)
+		}
+		for _, s := range ep.SignerIDs {
+			signerID, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SignerID for %s: %s", endpoint, s)
+			}
+			ep.signerIDs = append(ep.signerIDs, signerID)
+		}
+		for _, s := range ep.MigrateFrom {
+			uniqueID, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UniqueID to migrate from for %s: %s", endpoint, s)
+			}
+			ep.migrateFrom = append(ep.migrateFrom, uniqueID)
+		}
+		if len(ep.TCBStatuses) == 0 {
+			ep.tcbStatuses = []tcbstatus.Status{tcbstatus.UpToDate}
+		}
+		for _, name := range ep.TCBStatuses {
+			status, err := parseTCBStatus(name)
+			if err != nil {
+				return nil, err
+			}
+			ep.tcbStatuses = append(ep.tcbStatuses, status)
+		}
+	}
+	return &p, nil
+}
+
+// ProductIDNumber converts the little-endian ProductID in a report to the number in enclave.json
+func ProductIDNumber(productID []byte) uint64 {
+	n := uint64(0)
+	for i := len(productID) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(productID[i])
+	}
+	return n
+}
+
+// Check returns nil if the enclave of the report is allowed to access the endpoint
+func (ep *EndpointPolicy) Check(report *attestation.Report) error {
+	if len(ep.signerIDs) != 0 {
+		found := false
+		for _, signerID := range ep.signerIDs {
+			found = found || bytes.Equal(signerID, report.SignerID)
+		}
+		if !found {
+			return ErrPolicySignerID
+		}
+	}
+	if len(ep.ProductIDs) != 0 {
+		found := false
+		for _, productID := range ep.ProductIDs {
+			found = found || productID == ProductIDNumber(report.ProductID)
+		}
+		if !found {
+			return ErrPolicyProductID
+		}
+	}
+	if report.SecurityVersion < ep.MinSecurityVersion {
+		return ErrPolicySecurityVersion
+	}
+	if report.Debug && !ep.AllowDebug {
+		return ErrPolicyDebug
+	}
+	for _, status := range ep.tcbStatuses {
+		if status == report.TCBStatus {
+			return nil
+		}
+	}
+	return ErrPolicyTCBStatus
+}
+
+// Check returns nil if the enclave of the report is allowed to access the endpoint. A nil
+// policy uses DefaultEndpointPolicy for all the endpoints except '/migratekey', '/exportkeys' and
+// '/audit', which are denied. Every decision is logged.
+func (p *Policy) Check(endpoint string, report *attestation.Report) error {
+	ep := DefaultEndpointPolicy
+	if p != nil {
+		ep = p.Endpoints[endpoint]
+	} else if explicitPolicyEndpoints[endpoint] {
+		ep = nil
+	}
+	err := ErrPolicyEndpoint
+	if ep != nil {
+		err = ep.Check(report)
+	}
+	if err == nil && report.Debug && masterKeyEndpoints[endpoint] {
+		err = ErrPolicyDebug
+	}
+	decision := "allow"
+	if err != nil {
+		decision = "deny: " + err.Error()
+	}
+	log.Printf("policy %s uniqueID=%x signerID=%x productID=%d svn=%d debug=%v tcb=%s: %s\n",
+		endpoint, report.UniqueID, report.SignerID, ProductIDNumber(report.ProductID),
+		report.SecurityVersion, report.Debug, report.TCBStatus, decision)
+	return err
+}
+
+// CheckMigration returns nil if the endpoint's MigrateFrom lists oldUniqueID, and should be used
+// after Check. Unlike Check, it denies everything when there is no policy, because keys are only
+// migrated between the versions explicitly listed. Every decision is logged.
+func (p *Policy) CheckMigration(endpoint string, report *attestation.Report, oldUniqueID []byte) error {
+	err := ErrPolicyEndpoint
+	if p != nil && p.Endpoints[endpoint] != nil {
+		err = ErrPolicyMigration
+		for _, uniqueID := range p.Endpoints[endpoint].migrateFrom {
+			if bytes.Equal(uniqueID, oldUniqueID) {
+				err = nil
+			}
+		}
+	}
+	decision := "allow"
+	if err != nil {
+		decision = "deny: " + err.Error()
+	}
+	log.Printf("policy %s uniqueID=%x signerID=%x svn=%d from=%x: %s\n",
+		endpoint, report.UniqueID, report.SignerID, report.SecurityVersion, oldUniqueID, decision)
+	return err
+}
@@ -0,0 +1,128 @@
+package keygrantor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `{
+	"endpoints": {
+		"/getkey": {
+			"signer_ids": ["7369676e6572"],
+			"product_ids": [1],
+			"min_security_version": 2,
+			"tcb_statuses": ["UpToDate", "SWHardeningNeeded"]
+		},
+		"/xprv": {
+			"signer_ids": ["7369676e6572"]
+		}
+	}
+}`
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	report := newTestReport("enclave")
+	report.SecurityVersion = 2
+	require.NoError(t, p.Check("/getkey", &report))
+	require.ErrorIs(t, p.Check("/getkeyshare", &report), ErrPolicyEndpoint)
+
+	r := report
+	r.SignerID = []byte("other")
+	require.ErrorIs(t, p.Check("/getkey", &r), ErrPolicySignerID)
+	r = report
+	r.ProductID = []byte{2, 0}
+	require.ErrorIs(t, p.Check("/getkey", &r), ErrPolicyProductID)
+	r = report
+	r.SecurityVersion = 1
+	require.ErrorIs(t, p.Check("/getkey", &r), ErrPolicySecurityVersion)
+	r = report
+	r.Debug = true
+	require.ErrorIs(t, p.Check("/getkey", &r), ErrPolicyDebug)
+	r = report
+	r.TCBStatus = tcbstatus.SWHardeningNeeded
+	require.NoError(t, p.Check("/getkey", &r))
+	require.ErrorIs(t, p.Check("/xprv", &r), ErrPolicyTCBStatus)
+	r.TCBStatus = tcbstatus.Revoked
+	require.ErrorIs(t, p.Check("/getkey", &r), ErrPolicyTCBStatus)
+
+	// no policy
+	var nilPolicy *Policy
+	require.NoError(t, nilPolicy.Check("/getkey", &report))
+	r = report
+	r.Debug = true
+	require.ErrorIs(t, nilPolicy.Check("/getkey", &r), ErrPolicyDebug)
+	require.ErrorIs(t, nilPolicy.Check("/migratekey", &report), ErrPolicyEndpoint)
+	require.ErrorIs(t, nilPolicy.Check("/exportkeys", &report), ErrPolicyEndpoint)
+	require.ErrorIs(t, nilPolicy.Check("/audit", &report), ErrPolicyEndpoint)
+
+	// the master keys never go to debug enclaves
+	p, err = ParsePolicy([]byte(`{"endpoints": {"/getkey": {"allow_debug": true}, "/xprv": {}}}`))
+	require.NoError(t, err)
+	r = report
+	r.Debug = true
+	require.NoError(t, p.Check("/getkey", &r))
+	p.Endpoints["/xprv"].AllowDebug = true
+	require.ErrorIs(t, p.Check("/xprv", &r), ErrPolicyDebug)
+	_, err = ParsePolicy([]byte(`{"endpoints": {"/xprv": {"allow_debug": true}}}`))
+	require.Error(t, err)
+	_, err = ParsePolicy([]byte(`{"endpoints": {"/exportkeys": {"allow_debug": true}}}`))
+	require.Error(t, err)
+
+	_, err = ParsePolicy([]byte(`{"endpoints": {"/getkey": {"tcb_statuses": ["Fine"]}}}`))
+	require.Error(t, err)
+	_, err = ParsePolicy([]byte(`{"endpoints": {"/getkey": {"signer_ids": ["xyz"]}}}`))
+	require.Error(t, err)
+	_, err = ParsePolicy([]byte(`{"endpoints": {"/migratekey": {"migrate_from": ["xyz"]}}}`))
+	require.Error(t, err)
+}
+
+func TestPolicyCheckMigration(t *testing.T) {
+	report := newTestReport("new enclave")
+	var nilPolicy *Policy
+	require.ErrorIs(t, nilPolicy.CheckMigration("/migratekey", &report, []byte("old enclave")), ErrPolicyEndpoint)
+
+	p, err := ParsePolicy([]byte(`{"endpoints": {"/migratekey": {"migrate_from": ["6f6c6420656e636c617665"]}}}`))
+	require.NoError(t, err)
+	require.NoError(t, p.CheckMigration("/migratekey", &report, []byte("old enclave")))
+	require.ErrorIs(t, p.CheckMigration("/migratekey", &report, []byte("other enclave")), ErrPolicyMigration)
+	require.ErrorIs(t, p.CheckMigration("/getkey", &report, []byte("old enclave")), ErrPolicyEndpoint)
+}
+
+func TestServerWithPolicy(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+	kr, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	_, err = kr.Append(newTestMasterKey(t, "epoch 0"))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	require.NoError(t, (&Server{Keys: kr, Attester: mock, Verifier: mock, Policy: policy}).RegisterHandlers(mux))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	clientData := []byte("client data")
+
+	// SecurityVersion 1 is too low
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData)
+	require.ErrorContains(t, err, ErrPolicySecurityVersion.Error())
+
+	report := newTestReport("client enclave")
+	report.SecurityVersion = 2
+	report.TCBStatus = tcbstatus.SWHardeningNeeded
+	signed := NewMockAttestation(mock.signKey, report)
+	DefaultAttester = signed
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData)
+	require.NoError(t, err)
+
+	report.SignerID = []byte("other")
+	DefaultAttester = NewMockAttestation(mock.signKey, report)
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData)
+	require.ErrorContains(t, err, ErrPolicySignerID.Error())
+}
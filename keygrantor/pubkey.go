@@ -0,0 +1,84 @@
+package keygrantor
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/edgelesssys/ego/attestation"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchutil"
+	"github.com/tyler-smith/go-bip32"
+)
+
+var (
+	ErrClientDataTooLong = errors.New("client data is longer than 32 bytes")
+)
+
+// DerivedPubKey is the public part of a key which '/getkey' derives, and its addresses
+type DerivedPubKey struct {
+	PubKey      string `json:"pubkey"`       // compressed, in hex
+	EvmAddress  string `json:"evm_address"`  // with the EIP-55 checksum
+	CashAddress string `json:"cash_address"` // of P2PKH, with the "bitcoincash:" prefix
+	Epoch       int64  `json:"epoch"`
+}
+
+// DerivePubKey computes the public key which '/getkey' derives in KeyModeUnique for the enclave of
+// uniqueID with clientData, from the xpub alone, e.g. to know an address before the enclave runs
+func DerivePubKey(xpub *bip32.Key, uniqueID, clientData []byte) (*DerivedPubKey, error) {
+	if len(clientData) > 32 {
+		return nil, ErrClientDataTooLong
+	}
+	report := attestation.Report{UniqueID: uniqueID, Data: make([]byte, 64)}
+	copy(report.Data[32:], clientData)
+	hash, err := DerivationHash(&report, KeyModeUnique, 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewDerivedPubKey(DeriveKey(xpub.PublicKey(), hash))
+}
+
+// NewDerivedPubKey returns the public key of key and its addresses
+func NewDerivedPubKey(key *bip32.Key) (*DerivedPubKey, error) {
+	pubKey, err := bchec.ParsePubKey(key.PublicKey().Key, bchec.S256())
+	if err != nil {
+		return nil, err
+	}
+	cashAddr, err := bchutil.NewAddressPubKeyHash(bchutil.Hash160(pubKey.SerializeCompressed()), &chaincfg.MainNetParams)
+	if err != nil {
+		return nil, err
+	}
+	return &DerivedPubKey{
+		PubKey:      hex.EncodeToString(pubKey.SerializeCompressed()),
+		EvmAddress:  gethcrypto.PubkeyToAddress(*pubKey.ToECDSA()).Hex(),
+		CashAddress: chaincfg.MainNetParams.CashAddressPrefix + ":" + cashAddr.EncodeAddress(),
+	}, nil
+}
+
+// Return the public key derived from xpub for the 'uniqueid' and 'data' query parameters in hex
+func handleGetPubKey(w http.ResponseWriter, r *http.Request, xpub *bip32.Key, epoch int64) {
+	uniqueID, err := hex.DecodeString(r.URL.Query().Get("uniqueid"))
+	if err != nil || len(uniqueID) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid uniqueid parameter"))
+		return
+	}
+	data, err := hex.DecodeString(r.URL.Query().Get("data"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid data parameter"))
+		return
+	}
+	pubKey, err := DerivePubKey(xpub, uniqueID, data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	pubKey.Epoch = epoch
+	bz, _ := json.Marshal(pubKey)
+	w.Write(bz)
+}
@@ -0,0 +1,59 @@
+package keygrantor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerivePubKey(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	server, _ := newTestServer(t, mock, "epoch 0", "epoch 1")
+	clientData := sha256.Sum256([]byte("client data"))
+	key, err := GetKeyFromKeyGrantor(server.URL, clientData[:])
+	require.NoError(t, err)
+
+	xpub := newTestMasterKey(t, "epoch 1").PublicKey()
+	pubKey, err := DerivePubKey(xpub, []byte("client enclave"), clientData[:])
+	require.NoError(t, err)
+	expected, err := NewDerivedPubKey(key)
+	require.NoError(t, err)
+	require.Equal(t, expected, pubKey)
+	privKey, err := gethcrypto.ToECDSA(key.Key)
+	require.NoError(t, err)
+	require.Equal(t, gethcrypto.PubkeyToAddress(privKey.PublicKey).Hex(), pubKey.EvmAddress)
+	require.True(t, strings.HasPrefix(pubKey.CashAddress, "bitcoincash:q"), pubKey.CashAddress)
+
+	// '/getpubkey' computes the same
+	resp, err := http.Get(server.URL + "/getpubkey?uniqueid=" + hex.EncodeToString([]byte("client enclave")) +
+		"&data=" + hex.EncodeToString(clientData[:]))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	var served DerivedPubKey
+	require.NoError(t, json.Unmarshal(body, &served))
+	pubKey.Epoch = 1
+	require.Equal(t, *pubKey, served)
+
+	// and so does the client with the attested xpub of epoch 0
+	pubKey, err = NewKeyGrantorClient(server.URL, nil, nil).DerivePubKey([]byte("client enclave"), clientData[:], 0)
+	require.NoError(t, err)
+	key, _, err = GetEpochKeyFromKeyGrantor(server.URL, clientData[:], 0)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(key.PublicKey().Key), pubKey.PubKey)
+
+	_, err = DerivePubKey(xpub, []byte("client enclave"), make([]byte, 33))
+	require.ErrorIs(t, err, ErrClientDataTooLong)
+	resp, err = http.Get(server.URL + "/getpubkey?data=00")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
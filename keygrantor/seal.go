@@ -0,0 +1,74 @@
+package keygrantor
+
+import (
+	"errors"
+	"os"
+
+	"github.com/edgelesssys/ego/ecrypto"
+)
+
+const (
+	// Sealed with a key derived from the UniqueID, which only the same build of the enclave can unseal
+	SealModeUnique = "unique"
+	// Sealed with a key derived from the SignerID and ProductID, which the upgrades signed by the
+	// same key can unseal, too
+	SealModeProduct = "product"
+)
+
+var (
+	ErrUnknownSealMode = errors.New("unknown seal mode")
+)
+
+// SealMode decides how Seal, SealKeyToFile and SealShareToFile seal the data
+var SealMode = SealModeUnique
+
+// CheckSealMode returns an error if mode is neither SealModeUnique nor SealModeProduct
+func CheckSealMode(mode string) error {
+	if mode != SealModeUnique && mode != SealModeProduct {
+		return ErrUnknownSealMode
+	}
+	return nil
+}
+
+// Seal encrypts the data with a key derived from a measurement of the enclave, chosen by SealMode
+func Seal(bz []byte) ([]byte, error) {
+	switch SealMode {
+	case SealModeUnique:
+		return ecrypto.SealWithUniqueKey(bz, nil)
+	case SealModeProduct:
+		return ecrypto.SealWithProductKey(bz, nil)
+	default:
+		return nil, ErrUnknownSealMode
+	}
+}
+
+// Unseal decrypts the data sealed in either mode
+func Unseal(bz []byte) ([]byte, error) {
+	return ecrypto.Unseal(bz, nil)
+}
+
+// ResealFile seals a sealed file again in the current SealMode, e.g. before switching to
+// SealModeProduct for upgrades. A missing file is skipped.
+func ResealFile(fname string) error {
+	fileData, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rawData, err := Unseal(fileData)
+	if err != nil {
+		return err
+	}
+	out, err := Seal(rawData)
+	if err != nil {
+		return err
+	}
+	tmpName := fname + ".tmp"
+	err = os.WriteFile(tmpName, out, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fname)
+}
@@ -0,0 +1,516 @@
+package keygrantor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	ecies "github.com/ecies/go/v2"
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/tyler-smith/go-bip32"
+)
+
+// Server serves the keys in a KeyRing to the attested enclaves
+type Server struct {
+	Keys     *KeyRing
+	Counter  MonotonicCounter // optional, serves '/counter' to the attested enclaves when set
+	Attester Attester
+	Verifier Verifier
+	Policy   *Policy   // decides which enclaves can access '/getkey', '/xprv', '/migratekey' and '/counter'
+	Audit    *AuditLog // records the grants, '/migratekey' is disabled without it
+	TLSCert  []byte    // DER of the TLS certificate served with, whose hash '/report' attests
+}
+
+// RegisterHandlers registers '/xpub', '/report', '/getpubkey', '/xprv', '/getkey', '/migratekey',
+// '/exportkeys', and the counter and audit endpoints
+func (s *Server) RegisterHandlers(mux *http.ServeMux) error {
+	_, currKey, err := s.Keys.Current()
+	if err != nil {
+		return err
+	}
+
+	// Return the extended public key of the latest epoch, or of the one given by '?epoch='
+	mux.HandleFunc("/xpub", func(w http.ResponseWriter, r *http.Request) {
+		_, key := s.handleEpoch(w, r)
+		if key == nil {
+			return
+		}
+		w.Write([]byte(key.PublicKey().B58Serialize()))
+	})
+
+	// Get remote attestion report to endorse the extended public key of the latest epoch, or of the
+	// one given by '?epoch='
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		_, key := s.handleEpoch(w, r)
+		if key == nil {
+			return
+		}
+		handleXpubReport(s.Attester, key.PublicKey().B58Serialize(), s.TLSCert)(w, r)
+	})
+
+	// Compute the public key which '/getkey' derives for '?uniqueid=&data=', without any attestation
+	mux.HandleFunc("/getpubkey", func(w http.ResponseWriter, r *http.Request) {
+		epoch, key := s.handleEpoch(w, r)
+		if key == nil {
+			return
+		}
+		handleGetPubKey(w, r, key.PublicKey(), epoch)
+	})
+
+	// Peer keygrantors get the master key through '/xprv'
+	mux.HandleFunc("/xprv", func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		epoch, masterKey := s.handleEpoch(w, r)
+		if masterKey == nil {
+			return
+		}
+		report, _ := handleGetKeyParam(w, r, pubkeyBz, s.Verifier, s.Policy, s.Audit)
+		if report == nil {
+			return
+		}
+		entry := NewAuditEntry(r.URL.Path, report, epoch)
+		if err := checkPeerReport(report, s.Attester, s.Verifier); err != nil {
+			denyAndAudit(w, s.Audit, entry, http.StatusBadRequest, err)
+			return
+		}
+		if !handleAuditGrant(w, s.Audit, entry) {
+			return
+		}
+		writeEncrypted(w, pubKey, encodeEpochKey(epoch, masterKey))
+	})
+
+	// For requestors to get derived key
+	mux.HandleFunc("/getkey", func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		epoch, masterKey := s.handleEpoch(w, r)
+		if masterKey == nil {
+			return
+		}
+		report, params := handleGetKeyParam(w, r, pubkeyBz, s.Verifier, s.Policy, s.Audit)
+		if report == nil {
+			return
+		}
+		entry := NewAuditEntry(r.URL.Path, report, epoch)
+		// hash uniqueid (or signerid) and client-specific data for more flexible key deriving
+		hash, err := DerivationHash(report, params.Mode, params.MinSVN)
+		if err != nil {
+			denyAndAudit(w, s.Audit, entry, http.StatusBadRequest, err)
+			return
+		}
+		if !handleAuditGrant(w, s.Audit, entry) {
+			return
+		}
+		writeEncrypted(w, pubKey, encodeEpochKey(epoch, DeriveKey(masterKey, hash)))
+	})
+
+	// For a new version of an enclave to get the key derived for an old version's UniqueID, which
+	// must be listed in the policy. The old version is not involved, so every migration is audited.
+	mux.HandleFunc("/migratekey", func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		epoch, masterKey := s.handleEpoch(w, r)
+		if masterKey == nil {
+			return
+		}
+		report, params := handleGetKeyParam(w, r, pubkeyBz, s.Verifier, s.Policy, s.Audit)
+		if report == nil {
+			return
+		}
+		oldUniqueID, err := hex.DecodeString(params.MigrateFrom)
+		if err != nil || len(oldUniqueID) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid MigrateFrom"))
+			return
+		}
+		if s.Audit == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("migration is disabled without an audit log"))
+			return
+		}
+		entry := NewAuditEntry(r.URL.Path, report, epoch)
+		entry.MigrateFrom = params.MigrateFrom
+		err = s.Policy.CheckMigration(r.URL.Path, report, oldUniqueID)
+		if err != nil {
+			denyAndAudit(w, s.Audit, entry, http.StatusForbidden, err)
+			return
+		}
+		if !handleAuditGrant(w, s.Audit, entry) {
+			return
+		}
+		// the same as '/getkey' derives for the old version in KeyModeUnique
+		oldReport := *report
+		oldReport.UniqueID = oldUniqueID
+		hash, _ := DerivationHash(&oldReport, KeyModeUnique, 0)
+		writeEncrypted(w, pubKey, encodeEpochKey(epoch, DeriveKey(masterKey, hash)))
+	})
+
+	// For an upgraded keygrantor allowed by the policy, e.g. one of a higher SecurityVersion signed by
+	// the same key, to get the master keys of all the epochs, which cannot be unsealed after upgrades
+	mux.HandleFunc("/exportkeys", func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		report, _ := handleGetKeyParam(w, r, pubkeyBz, s.Verifier, s.Policy, s.Audit)
+		if report == nil {
+			return
+		}
+		epoch, _, _ := s.Keys.Current()
+		entry := NewAuditEntry(r.URL.Path, report, epoch)
+		if err := checkUpgradeReport(report, s.Attester); err != nil {
+			denyAndAudit(w, s.Audit, entry, http.StatusForbidden, err)
+			return
+		}
+		if !handleAuditGrant(w, s.Audit, entry) {
+			return
+		}
+		xprvsBz, _ := json.Marshal(s.Keys.Xprvs())
+		writeEncrypted(w, pubKey, xprvsBz)
+	})
+
+	if s.Audit != nil {
+		mux.HandleFunc("/audit", HandleAuditExport(s.Audit, s.Attester, s.Verifier, s.Policy))
+		mux.HandleFunc("/audit/verify", HandleAuditVerify(s.Audit))
+	}
+
+	// Monotonic counters for rollback protection, signed by a key derived from the current master key.
+	// They are as safe as s.Counter: a FileCounter can be rolled back by keygrantor's host.
+	if s.Counter != nil {
+		counterSignKey := DeriveKey(currKey, CounterKeyHash)
+		mux.HandleFunc("/counter", HandleCounterGet(s.Counter, counterSignKey, s.Verifier, s.Policy))
+		mux.HandleFunc("/counter/increase", HandleCounterIncrease(s.Counter, counterSignKey, s.Verifier, s.Policy))
+	}
+	return nil
+}
+
+// Parse query parameter 'epoch' to get the master key of that epoch, and put the epoch in the header
+func (s *Server) handleEpoch(w http.ResponseWriter, r *http.Request) (int64, *bip32.Key) {
+	epoch, err := ParseEpochQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return 0, nil
+	}
+	epoch, key, err := s.Keys.Get(epoch)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return 0, nil
+	}
+	w.Header().Set(KeyEpochHeader, strconv.FormatInt(epoch, 10))
+	return epoch, key
+}
+
+// ThresholdServer serves the shares of derived keys in the threshold mode
+type ThresholdServer struct {
+	Share    *MasterKeyShare
+	Attester Attester
+	Verifier Verifier
+	Policy   *Policy   // decides which enclaves can access '/getkeyshare'
+	Audit    *AuditLog // optional, records the grants
+	TLSCert  []byte    // DER of the TLS certificate served with, whose hash '/report' attests
+}
+
+// RegisterHandlers registers '/xpub', '/report', '/getpubkey', '/getkeyshare' and the audit endpoints
+func (s *ThresholdServer) RegisterHandlers(mux *http.ServeMux) {
+	if s.Audit != nil {
+		mux.HandleFunc("/audit", HandleAuditExport(s.Audit, s.Attester, s.Verifier, s.Policy))
+		mux.HandleFunc("/audit/verify", HandleAuditVerify(s.Audit))
+	}
+	mux.HandleFunc("/xpub", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s.Share.Xpub))
+	})
+	mux.HandleFunc("/report", handleXpubReport(s.Attester, s.Share.Xpub, s.TLSCert))
+	mux.HandleFunc("/getpubkey", func(w http.ResponseWriter, r *http.Request) {
+		xpub, err := bip32.B58Deserialize(s.Share.Xpub)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		handleGetPubKey(w, r, xpub, 0)
+	})
+
+	// For requestors to get a share of their derived key, which is the same as the one '/getkey' derives
+	mux.HandleFunc("/getkeyshare", func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		report, params := handleGetKeyParam(w, r, pubkeyBz, s.Verifier, s.Policy, s.Audit)
+		if report == nil {
+			return
+		}
+		entry := NewAuditEntry(r.URL.Path, report, 0)
+		hash, err := DerivationHash(report, params.Mode, params.MinSVN)
+		if err != nil {
+			denyAndAudit(w, s.Audit, entry, http.StatusBadRequest, err)
+			return
+		}
+		if !handleAuditGrant(w, s.Audit, entry) {
+			return
+		}
+		derived, err := s.Share.DeriveShare(hash)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("failed to derive share: " + err.Error()))
+			return
+		}
+		derivedBz, _ := json.Marshal(derived)
+		writeEncrypted(w, pubKey, derivedBz)
+	})
+}
+
+// Dealer hands each share of a master key to one peer keygrantor of the threshold mode. The master
+// key itself is not kept.
+type Dealer struct {
+	Policy  *Policy // decides which enclaves can access '/xshare'
+	TLSCert []byte  // DER of the TLS certificate served with, whose hash '/report' attests
+
+	lock     sync.Mutex
+	xpub     string
+	shares   []*MasterKeyShare // set to nil once dealt
+	dealt    int
+	done     chan struct{} // closed once all the shares are dealt
+	attester Attester
+	verifier Verifier
+}
+
+func NewDealer(master *bip32.Key, threshold, total int, rand io.Reader, attester Attester, verifier Verifier) (*Dealer, error) {
+	shares, err := SplitMasterKey(master, threshold, total, rand)
+	if err != nil {
+		return nil, err
+	}
+	return &Dealer{
+		xpub:     master.PublicKey().B58Serialize(),
+		shares:   shares,
+		done:     make(chan struct{}),
+		attester: attester,
+		verifier: verifier,
+	}, nil
+}
+
+func (d *Dealer) Xpub() string {
+	return d.xpub
+}
+
+// Done returns a channel which is closed when all the shares are dealt, so the dealer can stop
+func (d *Dealer) Done() <-chan struct{} {
+	return d.done
+}
+
+// RegisterHandlers registers '/xpub', '/report' and '/xshare?pubkey=&index=', which gives each
+// share only once
+func (d *Dealer) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/xpub", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(d.xpub))
+	})
+	mux.HandleFunc("/report", handleXpubReport(d.attester, d.xpub, d.TLSCert))
+	mux.HandleFunc("/xshare", func(w http.ResponseWriter, r *http.Request) {
+		pubKey, pubkeyBz := handleRequesterPubkey(w, r)
+		if pubKey == nil {
+			return
+		}
+		index, err := strconv.Atoi(r.URL.Query().Get("index"))
+		if err != nil || index < 1 || index > len(d.shares) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid index parameter"))
+			return
+		}
+		report, _ := handleGetKeyParam(w, r, pubkeyBz, d.verifier, d.Policy, nil)
+		if report == nil {
+			return
+		}
+		if err := checkPeerReport(report, d.attester, d.verifier); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		share := d.shares[index-1]
+		if share == nil {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte("share already dealt"))
+			return
+		}
+		shareBz, _ := json.Marshal(share)
+		if !writeEncrypted(w, pubKey, shareBz) {
+			return
+		}
+		d.shares[index-1] = nil
+		d.dealt++
+		fmt.Printf("share %d dealt, %d left\n", index, len(d.shares)-d.dealt)
+		if d.dealt == len(d.shares) {
+			close(d.done)
+		}
+	})
+}
+
+// Record the grant in the audit log, if any. No key is granted without a trace, so the request
+// fails if the entry cannot be written.
+func handleAuditGrant(w http.ResponseWriter, audit *AuditLog, entry *AuditEntry) bool {
+	if audit == nil {
+		return true
+	}
+	entry.Result = "granted"
+	err := audit.Append(entry)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("failed to write audit log: " + err.Error()))
+		return false
+	}
+	return true
+}
+
+// Record the denial in the audit log, if any, and write it as the response
+func denyAndAudit(w http.ResponseWriter, audit *AuditLog, entry *AuditEntry, statusCode int, reason error) {
+	if audit != nil {
+		entry.Result = "denied: " + reason.Error()
+		if err := audit.Append(entry); err != nil {
+			log.Printf("failed to write audit log: %s\n", err)
+		}
+	}
+	w.WriteHeader(statusCode)
+	w.Write([]byte(reason.Error()))
+}
+
+// Return the remote attestion report whose data is sha256(xpub), followed by sha256(cert) over TLS
+func handleXpubReport(attester Attester, xpub string, cert []byte) http.HandlerFunc {
+	reportData := xpubReportData(xpub, cert)
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := attester.RemoteReport(reportData)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte(hex.EncodeToString(report)))
+	}
+}
+
+// Parse query parameter 'pubkey' to get ecies.PublicKey for encrypting the returned key
+func handleRequesterPubkey(w http.ResponseWriter, r *http.Request) (*ecies.PublicKey, []byte) {
+	pubkeys := r.URL.Query()["pubkey"]
+	if len(pubkeys) == 0 || len(pubkeys[0]) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing pubkey parameter"))
+		return nil, nil
+	}
+	requesterPubkeyBz, err := hex.DecodeString(pubkeys[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("pubkey hex string decode error"))
+		return nil, nil
+	}
+	requesterPubKey, err := ecies.NewPublicKeyFromBytes(requesterPubkeyBz) // requester embeds its pubkey here
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("pubkey decode err: " + err.Error()))
+		return nil, nil
+	}
+	return requesterPubKey, requesterPubkeyBz
+}
+
+// Decode GetKeyParams from http requet's body and then check the attestion report and the JWT,
+// and whether the policy allows the enclave to access this endpoint
+func handleGetKeyParam(w http.ResponseWriter, r *http.Request, pubkeyBz []byte, verifier Verifier, policy *Policy, audit *AuditLog) (*attestation.Report, *GetKeyParams) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("failed to read request body"))
+		return nil, nil
+	}
+	var params GetKeyParams
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("failed to unmarshal request body"))
+		return nil, nil
+	}
+	reportBz, err := hex.DecodeString(params.Report)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("report decode error"))
+		return nil, nil
+	}
+	report, err := verifier.VerifyRemoteReport(reportBz)
+	if err != nil && !errors.Is(err, attestation.ErrTCBLevelInvalid) { // the policy decides which TCB status is allowed
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("report check failed: " + err.Error()))
+		return nil, nil
+	}
+	if len(report.Data) != 64 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("report data must 64bytes long"))
+		return nil, nil
+	}
+	pubkeyHash := sha256.Sum256(pubkeyBz)
+	if !bytes.Equal(pubkeyHash[:], report.Data[:32]) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("pubkey not match the pubkey hash"))
+		return nil, nil
+	}
+	err = verifyJWT(verifier, params.JWT, report)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("jwt token verify failed: " + err.Error()))
+		return nil, nil
+	}
+	err = policy.Check(r.URL.Path, &report)
+	if err != nil {
+		epoch, _ := strconv.ParseInt(w.Header().Get(KeyEpochHeader), 10, 64) // set by handleEpoch, if any
+		denyAndAudit(w, audit, NewAuditEntry(r.URL.Path, &report, epoch), http.StatusForbidden, err)
+		return nil, nil
+	}
+	return &report, &params
+}
+
+// Only the same enclave as this one can get the master key or its shares
+func checkPeerReport(report *attestation.Report, attester Attester, verifier Verifier) error {
+	selfReport, err := CheckSelfReport(attester, verifier)
+	if err == nil {
+		err = VerifyPeerReport(*report, selfReport)
+	}
+	if err != nil {
+		return fmt.Errorf("report check failed: %w", err)
+	}
+	return nil
+}
+
+// Whatever the policy allows, only an upgrade of this enclave can get the master keys of all the epochs
+func checkUpgradeReport(report *attestation.Report, attester Attester) error {
+	selfReport, err := attester.SelfReport()
+	if err != nil {
+		return fmt.Errorf("report check failed: %w", err)
+	}
+	return VerifyUpgradeReport(selfReport, *report)
+}
+
+// Encrypt the secret with the requestor's pubkey and write it in hex
+func writeEncrypted(w http.ResponseWriter, pubKey *ecies.PublicKey, secret []byte) bool {
+	bz, err := ecies.Encrypt(pubKey, secret)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("failed to encrypt the response"))
+		return false
+	}
+	w.Write([]byte(hex.EncodeToString(bz)))
+	return true
+}
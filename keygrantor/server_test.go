@@ -0,0 +1,384 @@
+package keygrantor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReport(uniqueID string) attestation.Report {
+	return attestation.Report{
+		SecurityVersion: 1,
+		UniqueID:        []byte(uniqueID),
+		SignerID:        []byte("signer"),
+		ProductID:       []byte{1},
+		TCBStatus:       tcbstatus.UpToDate,
+	}
+}
+
+// use a mock attestation in the client functions, which are run by an enclave with uniqueID
+func useMockAttestation(t *testing.T, uniqueID string) *MockAttestation {
+	signKey, err := gethcrypto.ToECDSA(gethcrypto.Keccak256([]byte("mock attestation")))
+	require.NoError(t, err)
+	mock := NewMockAttestation(signKey, newTestReport(uniqueID))
+	DefaultAttester, DefaultVerifier = mock, mock
+	t.Cleanup(func() {
+		DefaultAttester, DefaultVerifier = EgoAttester{}, EgoVerifier{}
+	})
+	return mock
+}
+
+func newTestServer(t *testing.T, verifier *MockAttestation, keys ...string) (*httptest.Server, *KeyRing) {
+	kr, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	for _, k := range keys {
+		_, err = kr.Append(newTestMasterKey(t, k))
+		require.NoError(t, err)
+	}
+	mux := http.NewServeMux()
+	s := &Server{Keys: kr, Attester: verifier, Verifier: verifier}
+	require.NoError(t, s.RegisterHandlers(mux))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, kr
+}
+
+func TestMockAttestation(t *testing.T) {
+	mock := useMockAttestation(t, "enclave")
+	reportBz, err := mock.RemoteReport([]byte("data"))
+	require.NoError(t, err)
+	report, err := mock.VerifyRemoteReport(reportBz)
+	require.NoError(t, err)
+	require.Len(t, report.Data, 64)
+	require.Equal(t, []byte("data"), report.Data[:4])
+	_, err = mock.VerifyToken(string(reportBz))
+	require.ErrorIs(t, err, ErrMockReportSig)
+
+	otherKey, err := gethcrypto.GenerateKey()
+	require.NoError(t, err)
+	other := NewMockAttestation(otherKey, newTestReport("enclave"))
+	_, err = other.VerifyRemoteReport(reportBz)
+	require.ErrorIs(t, err, ErrMockReportSig)
+}
+
+func TestServerGetKey(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	server, _ := newTestServer(t, mock, "epoch 0", "epoch 1")
+	clientData := sha256.Sum256([]byte("client data"))
+	hash := sha256.Sum256(append([]byte("client enclave"), clientData[:]...))
+
+	key, epoch, err := GetEpochKeyFromKeyGrantor(server.URL, clientData[:], LatestEpoch)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, epoch)
+	require.Equal(t, DeriveKey(newTestMasterKey(t, "epoch 1"), hash).B58Serialize(), key.B58Serialize())
+
+	key, epoch, err = GetEpochKeyFromKeyGrantor(server.URL, clientData[:], 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	require.Equal(t, DeriveKey(newTestMasterKey(t, "epoch 0"), hash).B58Serialize(), key.B58Serialize())
+
+	_, _, err = GetEpochKeyFromKeyGrantor(server.URL, clientData[:], 2)
+	require.Error(t, err)
+
+	// the reports signed by others are rejected
+	otherKey, err := gethcrypto.GenerateKey()
+	require.NoError(t, err)
+	other := NewMockAttestation(otherKey, newTestReport("client enclave"))
+	DefaultAttester = other
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData[:])
+	require.ErrorContains(t, err, "report check failed")
+}
+
+func TestServerXprvAndReport(t *testing.T) {
+	mock := useMockAttestation(t, "keygrantor")
+	server, _ := newTestServer(t, mock, "epoch 0", "epoch 1")
+
+	// a peer of the same enclave syncs all the epochs
+	peerKeys, err := NewKeyRing(filepath.Join(t.TempDir(), "peer.txt"), nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, SyncKeyRing(peerKeys, server.URL))
+	require.Equal(t, 2, peerKeys.Len())
+	_, key, err := peerKeys.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, newTestMasterKey(t, "epoch 0").B58Serialize(), key.B58Serialize())
+	require.NoError(t, SyncKeyRing(peerKeys, server.URL))
+	require.Equal(t, 2, peerKeys.Len())
+
+	// a key ring whose existing epochs differ from the upstream's is not synced
+	divergedKeys, err := NewKeyRing(filepath.Join(t.TempDir(), "diverged.txt"), nil, nil)
+	require.NoError(t, err)
+	_, err = divergedKeys.Append(newTestMasterKey(t, "another epoch 0"))
+	require.NoError(t, err)
+	require.ErrorIs(t, SyncKeyRing(divergedKeys, server.URL), ErrKeyRingDiverged)
+	require.Equal(t, 1, divergedKeys.Len())
+
+	// '/report' endorses the xpub
+	resp, err := http.Get(server.URL + "/report")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	reportBz, err := hex.DecodeString(string(body))
+	require.NoError(t, err)
+	report, err := mock.VerifyRemoteReport(reportBz)
+	require.NoError(t, err)
+	xpubHash := sha256.Sum256([]byte(newTestMasterKey(t, "epoch 1").PublicKey().B58Serialize()))
+	require.Equal(t, xpubHash[:], report.Data[:32])
+
+	// another enclave cannot get the master key
+	useMockAttestation(t, "another enclave")
+	DefaultVerifier = mock
+	_, err = GetKeyFromKeyGrantor(server.URL, nil)
+	require.ErrorContains(t, err, ErrUniqueIDMismatch.Error())
+}
+
+func TestThresholdServersAndDealer(t *testing.T) {
+	mock := useMockAttestation(t, "keygrantor")
+	master := newTestMasterKey(t, "threshold")
+	dealer, err := NewDealer(master, 2, 3, rand.Reader, mock, mock)
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	dealer.RegisterHandlers(mux)
+	dealerServer := httptest.NewServer(mux)
+	defer dealerServer.Close()
+
+	var urls []string
+	for i := uint32(1); i <= 3; i++ {
+		share, err := GetShareFromDealer(dealerServer.URL, i)
+		require.NoError(t, err)
+		mux := http.NewServeMux()
+		(&ThresholdServer{Share: share, Attester: mock, Verifier: mock}).RegisterHandlers(mux)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+	select {
+	case <-dealer.Done():
+	default:
+		t.Fatal("the dealer is not done")
+	}
+	_, err = GetShareFromDealer(dealerServer.URL, 1)
+	require.ErrorContains(t, err, "share already dealt")
+
+	// the first keygrantor is down, but the other two are enough
+	urls[0] = "http://127.0.0.1:1"
+	clientData := sha256.Sum256([]byte("client data"))
+	client := NewThresholdClient(urls, master.PublicKey(), 2, []byte("signer"), nil)
+	key, err := client.GetKey(clientData[:], KeyOptions{})
+	require.NoError(t, err)
+	hash := sha256.Sum256(append([]byte("keygrantor"), clientData[:]...))
+	require.Equal(t, DeriveKey(master, hash).B58Serialize(), key.B58Serialize())
+
+	_, err = NewThresholdClient(urls[:2], master.PublicKey(), 2, nil, nil).GetKey(clientData[:], KeyOptions{})
+	require.ErrorIs(t, err, ErrNotEnoughShares)
+
+	// the signer mode is supported by the keygrantors in the threshold mode, too
+	key, err = client.GetKey(clientData[:], KeyOptions{Mode: KeyModeSigner, MinSVN: 1})
+	require.NoError(t, err)
+	selfReport, err := mock.SelfReport()
+	require.NoError(t, err)
+	selfReport.Data = append(make([]byte, 32), clientData[:]...)
+	hash, err = DerivationHash(&selfReport, KeyModeSigner, 1)
+	require.NoError(t, err)
+	require.Equal(t, DeriveKey(master, hash).B58Serialize(), key.B58Serialize())
+
+	// the keygrantors are attested against the pinned xpub and the expected identity
+	_, err = NewThresholdClient(urls, newTestMasterKey(t, "other").PublicKey(), 2, nil, nil).GetKey(clientData[:], KeyOptions{})
+	require.ErrorContains(t, err, ErrReportDataMismatch.Error())
+	_, err = NewThresholdClient(urls, master.PublicKey(), 2, []byte("another signer"), nil).GetKey(clientData[:], KeyOptions{})
+	require.ErrorContains(t, err, ErrSignerIDMismatch.Error())
+	_, err = NewThresholdClient(urls, master.PublicKey(), 3, nil, nil).GetKey(clientData[:], KeyOptions{})
+	require.ErrorContains(t, err, ErrThresholdMismatch.Error())
+}
+
+func TestServerGetKeySignerMode(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave v1")
+	server, _ := newTestServer(t, mock, "epoch 0")
+	clientData := sha256.Sum256([]byte("client data"))
+	opts := KeyOptions{Epoch: LatestEpoch, Mode: KeyModeSigner, MinSVN: 1}
+
+	keyV1, _, err := GetKeyFromKeyGrantorWithOptions(server.URL, clientData[:], opts)
+	require.NoError(t, err)
+	uniqueKey, err := GetKeyFromKeyGrantor(server.URL, clientData[:])
+	require.NoError(t, err)
+	require.NotEqual(t, uniqueKey.B58Serialize(), keyV1.B58Serialize())
+
+	// an upgrade signed by the same signer gets the same key
+	useMockAttestation(t, "client enclave v2")
+	keyV2, _, err := GetKeyFromKeyGrantorWithOptions(server.URL, clientData[:], opts)
+	require.NoError(t, err)
+	require.Equal(t, keyV1.B58Serialize(), keyV2.B58Serialize())
+
+	// MinSVN is a part of the derivation, and gates the enclaves of lower SecurityVersion
+	opts.MinSVN = 0
+	keySVN0, _, err := GetKeyFromKeyGrantorWithOptions(server.URL, clientData[:], opts)
+	require.NoError(t, err)
+	require.NotEqual(t, keyV1.B58Serialize(), keySVN0.B58Serialize())
+	opts.MinSVN = 2
+	_, _, err = GetKeyFromKeyGrantorWithOptions(server.URL, clientData[:], opts)
+	require.ErrorContains(t, err, ErrSecurityVersionTooLow.Error())
+
+	opts.Mode = "unknown"
+	_, _, err = GetKeyFromKeyGrantorWithOptions(server.URL, clientData[:], opts)
+	require.ErrorContains(t, err, ErrUnknownKeyMode.Error())
+}
+
+func TestDerivationHash(t *testing.T) {
+	report := newTestReport("enclave")
+	report.Data = make([]byte, 64)
+	copy(report.Data[32:], "client data")
+	hash, err := DerivationHash(&report, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, sha256.Sum256(append([]byte("enclave"), report.Data[32:]...)), hash)
+
+	signerHash, err := DerivationHash(&report, KeyModeSigner, 1)
+	require.NoError(t, err)
+	report.UniqueID = []byte("upgraded enclave")
+	report.SecurityVersion = 2
+	upgradedHash, err := DerivationHash(&report, KeyModeSigner, 1)
+	require.NoError(t, err)
+	require.Equal(t, signerHash, upgradedHash)
+
+	report.ProductID = []byte{2}
+	otherProductHash, err := DerivationHash(&report, KeyModeSigner, 1)
+	require.NoError(t, err)
+	require.NotEqual(t, signerHash, otherProductHash)
+
+	_, err = DerivationHash(&report, KeyModeSigner, 3)
+	require.ErrorIs(t, err, ErrSecurityVersionTooLow)
+}
+
+func TestServerMigrateKey(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave v1")
+	server, kr := newTestServer(t, mock, "epoch 0")
+	clientData := sha256.Sum256([]byte("client data"))
+	oldKey, err := GetKeyFromKeyGrantor(server.URL, clientData[:])
+	require.NoError(t, err)
+
+	// no policy
+	useMockAttestation(t, "client enclave v2")
+	_, _, err = MigrateKeyFromKeyGrantor(server.URL, []byte("client enclave v1"), clientData[:], LatestEpoch)
+	require.ErrorContains(t, err, ErrPolicyEndpoint.Error())
+
+	// no audit log
+	policy, err := ParsePolicy([]byte(`{"endpoints": {"/migratekey": {
+		"signer_ids": ["7369676e6572"],
+		"migrate_from": ["636c69656e7420656e636c617665207631"]
+	}}}`))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	s := &Server{Keys: kr, Attester: mock, Verifier: mock, Policy: policy}
+	require.NoError(t, s.RegisterHandlers(mux))
+	server = httptest.NewServer(mux)
+	defer server.Close()
+	_, _, err = MigrateKeyFromKeyGrantor(server.URL, []byte("client enclave v1"), clientData[:], LatestEpoch)
+	require.ErrorContains(t, err, "without an audit log")
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	mux = http.NewServeMux()
+	s.Audit = newTestAuditLog(t, auditFile)
+	require.NoError(t, s.RegisterHandlers(mux))
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	key, epoch, err := MigrateKeyFromKeyGrantor(server.URL, []byte("client enclave v1"), clientData[:], LatestEpoch)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, epoch)
+	require.Equal(t, oldKey.B58Serialize(), key.B58Serialize())
+
+	// the UniqueIDs not listed cannot be migrated from
+	_, _, err = MigrateKeyFromKeyGrantor(server.URL, []byte("client enclave v0"), clientData[:], LatestEpoch)
+	require.ErrorContains(t, err, ErrPolicyMigration.Error())
+
+	bz, err := os.ReadFile(auditFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bz)), "\n")
+	require.Len(t, lines, 2)
+	var entry AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, "/migratekey", entry.Endpoint)
+	require.Equal(t, hex.EncodeToString([]byte("client enclave v2")), entry.UniqueID)
+	require.Equal(t, hex.EncodeToString([]byte("client enclave v1")), entry.MigrateFrom)
+	require.Equal(t, "granted", entry.Result)
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	require.Equal(t, "denied: "+ErrPolicyMigration.Error(), entry.Result)
+}
+
+func TestServerExportKeys(t *testing.T) {
+	mock := useMockAttestation(t, "keygrantor v1")
+	server, _ := newTestServer(t, mock, "epoch 0", "epoch 1")
+	newKeys, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+
+	// denied without a policy
+	useMockAttestation(t, "keygrantor v2")
+	require.ErrorContains(t, ImportKeyRing(newKeys, server.URL), ErrPolicyEndpoint.Error())
+	require.Equal(t, 0, newKeys.Len())
+
+	_, oldKeys := newTestServer(t, mock, "epoch 0", "epoch 1")
+	policy, err := ParsePolicy([]byte(`{"endpoints": {"/exportkeys": {"signer_ids": ["7369676e6572"]}}}`))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	require.NoError(t, (&Server{Keys: oldKeys, Attester: mock, Verifier: mock, Policy: policy}).RegisterHandlers(mux))
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	require.NoError(t, ImportKeyRing(newKeys, server.URL))
+	require.Equal(t, oldKeys.Xprvs(), newKeys.Xprvs())
+	require.Error(t, ImportKeyRing(newKeys, server.URL))
+
+	// the importer must be a non-debug enclave with the same SignerID, whatever the policy allows
+	policy.Endpoints["/exportkeys"].signerIDs = nil
+	policy.Endpoints["/exportkeys"].AllowDebug = true
+	newKeys, err = NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	report := newTestReport("keygrantor v2")
+	report.SignerID = []byte("other signer")
+	DefaultAttester = NewMockAttestation(mock.signKey, report)
+	require.ErrorContains(t, ImportKeyRing(newKeys, server.URL), ErrSignerIDMismatch.Error())
+	report = newTestReport("keygrantor v2")
+	report.Debug = true
+	DefaultAttester = NewMockAttestation(mock.signKey, report)
+	require.ErrorContains(t, ImportKeyRing(newKeys, server.URL), ErrPolicyDebug.Error())
+	report = newTestReport("keygrantor v2")
+	report.ProductID = []byte{2}
+	DefaultAttester = NewMockAttestation(mock.signKey, report)
+	require.ErrorContains(t, ImportKeyRing(newKeys, server.URL), ErrProductIDMismatch.Error())
+	report = newTestReport("keygrantor v0")
+	report.SecurityVersion = 0
+	DefaultAttester = NewMockAttestation(mock.signKey, report)
+	require.ErrorContains(t, ImportKeyRing(newKeys, server.URL), ErrSecurityDowngrade.Error())
+	require.Equal(t, 0, newKeys.Len())
+}
+
+func TestVerifyUpgradeReport(t *testing.T) {
+	oldReport := newTestReport("v1")
+	newReport := newTestReport("v2")
+	newReport.SecurityVersion = 2
+	require.NoError(t, VerifyUpgradeReport(oldReport, newReport))
+	require.ErrorIs(t, VerifyUpgradeReport(newReport, oldReport), ErrSecurityDowngrade)
+
+	r := oldReport
+	r.Debug = true
+	require.ErrorIs(t, VerifyUpgradeReport(r, newReport), ErrInDebugMode)
+	require.ErrorIs(t, VerifyUpgradeReport(oldReport, r), ErrInDebugMode)
+	r = newReport
+	r.SignerID = []byte("other signer")
+	require.ErrorIs(t, VerifyUpgradeReport(oldReport, r), ErrSignerIDMismatch)
+	r = newReport
+	r.ProductID = []byte{2}
+	require.ErrorIs(t, VerifyUpgradeReport(oldReport, r), ErrProductIDMismatch)
+}
@@ -0,0 +1,114 @@
+package keygrantor
+
+import (
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+)
+
+var (
+	ErrInvalidThreshold = errors.New("threshold must be in [1, total] and total must be in [1, 255]")
+	ErrNotEnoughShares  = errors.New("not enough shares")
+	ErrDuplicateShare   = errors.New("duplicate share index")
+)
+
+// SecretShare is one point (Index, Value) of a Shamir polynomial over the secp256k1 group order,
+// so the shares of a private key can be shifted by a public offset as the key itself can be
+type SecretShare struct {
+	Index uint32 // x, starts from 1
+	Value []byte // y, 32 bytes
+}
+
+func groupOrder() *big.Int {
+	return secp256k1.S256().N
+}
+
+func randScalar(rand io.Reader) (*big.Int, error) {
+	buf := make([]byte, 32)
+	for {
+		if _, err := io.ReadFull(rand, buf); err != nil {
+			return nil, err
+		}
+		k := new(big.Int).SetBytes(buf)
+		if k.Cmp(groupOrder()) < 0 {
+			return k, nil
+		}
+	}
+}
+
+func scalarBytes(k *big.Int) []byte {
+	out := make([]byte, 32)
+	return k.FillBytes(out)
+}
+
+// SplitSecret splits a 32-byte secret into 'total' shares, any 'threshold' of which can recover it
+func SplitSecret(secret []byte, threshold, total int, rand io.Reader) ([]SecretShare, error) {
+	if threshold < 1 || threshold > total || total > 255 {
+		return nil, ErrInvalidThreshold
+	}
+	n := groupOrder()
+	coeffs := make([]*big.Int, threshold)
+	coeffs[0] = new(big.Int).SetBytes(secret)
+	if len(secret) != 32 || coeffs[0].Cmp(n) >= 0 {
+		return nil, errors.New("secret must be a 32-byte scalar")
+	}
+	for i := 1; i < threshold; i++ {
+		c, err := randScalar(rand)
+		if err != nil {
+			return nil, err
+		}
+		coeffs[i] = c
+	}
+	shares := make([]SecretShare, total)
+	for i := range shares {
+		x := big.NewInt(int64(i + 1))
+		// Horner's method
+		y := new(big.Int)
+		for j := threshold - 1; j >= 0; j-- {
+			y.Mul(y, x)
+			y.Add(y, coeffs[j])
+			y.Mod(y, n)
+		}
+		shares[i] = SecretShare{Index: uint32(i + 1), Value: scalarBytes(y)}
+	}
+	return shares, nil
+}
+
+// CombineShares recovers the secret from at least 'threshold' shares with Lagrange interpolation
+// at x=0. With fewer shares it returns a wrong secret silently, so the caller must check it.
+func CombineShares(shares []SecretShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrNotEnoughShares
+	}
+	seen := make(map[uint32]bool, len(shares))
+	for _, s := range shares {
+		if s.Index == 0 || seen[s.Index] {
+			return nil, ErrDuplicateShare
+		}
+		seen[s.Index] = true
+	}
+	n := groupOrder()
+	secret := new(big.Int)
+	for i, si := range shares {
+		num, den := big.NewInt(1), big.NewInt(1)
+		xi := big.NewInt(int64(si.Index))
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			xj := big.NewInt(int64(sj.Index))
+			num.Mul(num, xj)
+			num.Mod(num, n)
+			den.Mul(den, new(big.Int).Sub(xj, xi))
+			den.Mod(den, n)
+		}
+		term := new(big.Int).SetBytes(si.Value)
+		term.Mul(term, num)
+		term.Mul(term, new(big.Int).ModInverse(den, n))
+		secret.Add(secret, term)
+		secret.Mod(secret, n)
+	}
+	return scalarBytes(secret), nil
+}
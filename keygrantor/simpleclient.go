@@ -1,6 +1,8 @@
 package keygrantor
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -8,37 +10,65 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	secp256k1 "github.com/decred/dcrd/dcrec/secp256k1/v4"
-	"github.com/edgelesssys/ego/enclave"
+	"github.com/edgelesssys/ego/attestation"
 	"github.com/tyler-smith/go-bip32"
 )
 
+var (
+	ErrNoIdentity = errors.New("the expected SignerID or UniqueID is required")
+)
+
+// SimpleClient is an https service of an enclave which gets its key from keygrantor. Besides the
+// extra handlers, it serves the endpoints to attest its TLS certificate and pubkey, whose results
+// are in SimpleResponse, and which VerifySimpleClient checks.
 type SimpleClient struct {
 	ExtPrivKey *bip32.Key
 	ExtPubKey  *bip32.Key
 	PrivKey    *secp256k1.PrivateKey
 	PubKeyBz   []byte
+
+	ExtraReportData []byte   // endorsed by the report together with PubKeyBz, e.g. a config hash
+	Attester        Attester // DefaultAttester if nil
+
+	cert   []byte
+	server *http.Server
 }
 
-func (sc *SimpleClient) InitKeys(keySrc string, clientData [32]byte, loadFromFile bool) {
-	if loadFromFile {
-		fileExists := false
-		sc.ExtPrivKey, fileExists = RecoverKeyFromFile(keySrc)
-		if !fileExists {
-			panic("Cannot find key file: " + keySrc)
-		}
-	} else {
-		var err error
-		sc.ExtPrivKey, err = GetKeyFromKeyGrantor(keySrc, clientData[:])
-		if err != nil {
-			panic(err)
-		}
+// InitKeys gets the keys for clientData from the keygrantor of kgClient, which must have the expected
+// SignerID or UniqueID to check keygrantor's identity
+func (sc *SimpleClient) InitKeys(kgClient *KeyGrantorClient, clientData [32]byte) {
+	if len(kgClient.SignerID) == 0 && len(kgClient.UniqueID) == 0 {
+		panic(ErrNoIdentity)
+	}
+	key, _, err := kgClient.GetKey(clientData[:], KeyOptions{Epoch: LatestEpoch})
+	if err != nil {
+		panic(err)
+	}
+	sc.setKeys(key)
+}
+
+// InitKeysFromFile loads the keys from a sealed key file
+func (sc *SimpleClient) InitKeysFromFile(keyFile string) {
+	key, fileExists := RecoverKeyFromFile(keyFile)
+	if !fileExists {
+		panic("Cannot find key file: " + keyFile)
 	}
+	sc.setKeys(key)
+}
+
+func (sc *SimpleClient) setKeys(key *bip32.Key) {
+	sc.ExtPrivKey = key
 	sc.ExtPubKey = sc.ExtPrivKey.PublicKey()
 	sc.PrivKey = secp256k1.PrivKeyFromBytes(sc.ExtPrivKey.Key)
 	sc.PubKeyBz = sc.PrivKey.PubKey().SerializeCompressed()
@@ -53,7 +83,7 @@ func (rr RandReader) Read(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func createCertificate(serverName string) ([]byte, crypto.PrivateKey, *tls.Config) {
+func createCertificate(serverName string) ([]byte, crypto.PrivateKey, *tls.Config, error) {
 	template := &x509.Certificate{
 		SerialNumber: &big.Int{},
 		Subject:      pkix.Name{CommonName: serverName},
@@ -61,8 +91,14 @@ func createCertificate(serverName string) ([]byte, crypto.PrivateKey, *tls.Confi
 		DNSNames:     []string{serverName},
 	}
 	randReader := RandReader{}
-	priv, _ := rsa.GenerateKey(randReader, 2048)
-	cert, _ := x509.CreateCertificate(randReader, template, template, &priv.PublicKey, priv)
+	priv, err := rsa.GenerateKey(randReader, 2048)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	cert, err := x509.CreateCertificate(randReader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
 	tlsCfg := &tls.Config{
 		Certificates: []tls.Certificate{
 			{
@@ -71,61 +107,261 @@ func createCertificate(serverName string) ([]byte, crypto.PrivateKey, *tls.Confi
 			},
 		},
 	}
-	return cert, priv, tlsCfg
+	return cert, priv, tlsCfg, nil
+}
+
+// SimpleResponse is the JSON response of all the endpoints of SimpleClient
+type SimpleResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Result  string `json:"result"`
+}
+
+// WriteSimpleResult writes a successful SimpleResponse, e.g. in the extra handlers of SimpleClient
+func WriteSimpleResult(w http.ResponseWriter, result string) {
+	bz, _ := json.Marshal(SimpleResponse{Success: true, Result: result})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bz)
+}
+
+// WriteSimpleError writes a failed SimpleResponse with the http status
+func WriteSimpleError(w http.ResponseWriter, status int, err error) {
+	bz, _ := json.Marshal(SimpleResponse{Error: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bz)
 }
 
-func (sc *SimpleClient) CreateAndStartHttpsServer(serverName, listenURL string, handlers map[string]func(w http.ResponseWriter, r *http.Request)) {
-	// Create a TLS config with a self-signed certificate and an embedded report.
-	//tlsCfg, err := enclave.CreateAttestationServerTLSConfig()
-	cert, _, tlsCfg := createCertificate(serverName)
+// SimpleReportData returns the report data of SimpleClient's '/report', which endorses the TLS
+// certificate, the secp256k1 pubkey and the extra data
+func SimpleReportData(cert, pubKey, extraData []byte) []byte {
 	certHash := sha256.Sum256(cert)
-	pubKeyHash := sha256.Sum256(sc.PubKeyBz)
-	reportData := append(certHash[:], pubKeyHash[:]...)
+	pubKeyHash := sha256.Sum256(append(append([]byte{}, pubKey...), extraData...))
+	return append(certHash[:], pubKeyHash[:]...)
+}
+
+// NewServer creates a self-signed certificate and an https server on its own mux, which serves
+// the attestation endpoints and the extra handlers. The server is started by ListenAndServeTLS("", "").
+func (sc *SimpleClient) NewServer(serverName, listenURL string, handlers map[string]func(w http.ResponseWriter, r *http.Request)) (*http.Server, error) {
+	attester := sc.Attester
+	if attester == nil {
+		attester = DefaultAttester
+	}
+	cert, _, tlsCfg, err := createCertificate(serverName)
+	if err != nil {
+		return nil, err
+	}
+	reportData := SimpleReportData(cert, sc.PubKeyBz, sc.ExtraReportData)
 
+	mux := http.NewServeMux()
 	// init handler for remote attestation
-	http.HandleFunc("/cert", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(hex.EncodeToString(cert)))
+	mux.HandleFunc("/cert", func(w http.ResponseWriter, r *http.Request) {
+		WriteSimpleResult(w, hex.EncodeToString(cert))
 	})
 	// look up secp256k1 pubkey
-	http.HandleFunc("/pubkey", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(hex.EncodeToString(sc.PubKeyBz)))
-		return
+	mux.HandleFunc("/pubkey", func(w http.ResponseWriter, r *http.Request) {
+		WriteSimpleResult(w, hex.EncodeToString(sc.PubKeyBz))
+	})
+	// the extra data endorsed together with the pubkey
+	mux.HandleFunc("/extradata", func(w http.ResponseWriter, r *http.Request) {
+		WriteSimpleResult(w, hex.EncodeToString(sc.ExtraReportData))
 	})
-
 	// attestation report to endorse certification and pubkey
-	http.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
-		peerReport, err := enclave.GetRemoteReport(reportData)
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		report, err := attester.RemoteReport(reportData)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
+			WriteSimpleError(w, http.StatusInternalServerError, err)
+			return
 		}
-		w.Write([]byte(hex.EncodeToString(peerReport)))
+		WriteSimpleResult(w, hex.EncodeToString(report))
 	})
-
 	// send jwt token
-	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
-		var token string
-		var err error
-		for _, url := range AttestationProviderURLs {
-			token, err = enclave.CreateAzureAttestationToken(reportData, url)
-			if err == nil {
-				break
-			}
-		}
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		token, err := attester.Token(reportData)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
+			WriteSimpleError(w, http.StatusInternalServerError, err)
 			return
 		}
-		w.Write([]byte(token))
+		WriteSimpleResult(w, token)
 	})
-
 	for name, handler := range handlers {
-		http.HandleFunc(name, handler)
+		mux.HandleFunc(name, handler)
 	}
 
-	server := http.Server{Addr: listenURL, TLSConfig: tlsCfg, ReadTimeout: 3 * time.Second, WriteTimeout: 5 * time.Second}
+	sc.cert = cert
+	sc.server = &http.Server{Addr: listenURL, Handler: mux, TLSConfig: tlsCfg, ReadTimeout: 3 * time.Second, WriteTimeout: 5 * time.Second}
+	return sc.server, nil
+}
+
+// CreateAndStartHttpsServer serves the attestation endpoints and the extra handlers until Shutdown
+func (sc *SimpleClient) CreateAndStartHttpsServer(serverName, listenURL string, handlers map[string]func(w http.ResponseWriter, r *http.Request)) error {
+	server, err := sc.NewServer(serverName, listenURL, handlers)
+	if err != nil {
+		return err
+	}
 	fmt.Println("listening ...")
-	err := server.ListenAndServeTLS("", "")
-	fmt.Println(err)
+	err = server.ListenAndServeTLS("", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully stops the server created by NewServer, waiting for the active requests
+// until ctx is done
+func (sc *SimpleClient) Shutdown(ctx context.Context) error {
+	if sc.server == nil {
+		return nil
+	}
+	return sc.server.Shutdown(ctx)
+}
+
+// Cert returns the DER of the certificate created by NewServer
+func (sc *SimpleClient) Cert() []byte {
+	return sc.cert
+}
+
+// SimpleClientEvidence is what a SimpleClient serves to attest itself, which is not verified yet
+type SimpleClientEvidence struct {
+	Cert            []byte // the DER of the certificate presented by the server
+	PubKey          []byte
+	ExtraReportData []byte
+	Report          []byte
+	// only connects to the servers presenting Cert, e.g. to call the extra handlers
+	Client *http.Client
+}
+
+// GetSimpleClientEvidence gets the report, pubkey and extra data of a SimpleClient serving rawUrl over
+// https. All of them come from the server presenting the certificate which the report should endorse.
+func GetSimpleClientEvidence(rawUrl string) (*SimpleClientEvidence, error) {
+	return GetSimpleClientEvidenceWithPolicy(rawUrl, nil, nil)
+}
+
+// GetSimpleClientEvidenceWithPolicy is GetSimpleClientEvidence whose client, including the one in the
+// evidence, checks each url and its redirects by checkURL, and connects by dial. Either can be nil.
+func GetSimpleClientEvidenceWithPolicy(rawUrl string, checkURL func(*url.URL) error,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*SimpleClientEvidence, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("SimpleClient must be served over https")
+	}
+	if checkURL != nil {
+		if err = checkURL(u); err != nil {
+			return nil, err
+		}
+	}
+	base := u.Scheme + "://" + u.Host
+	var certHash [32]byte
+	client := pinnedTLSClient(&certHash, nil)
+	if checkURL != nil {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkURL(req.URL)
+		}
+	}
+	if dial != nil {
+		client.Transport.(*http.Transport).DialContext = dial
+	}
+	resp, err := client.Get(base + "/report")
+	if err != nil {
+		return nil, err
+	}
+	reportHex, err := readSimpleResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get report: %w", err)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, ErrCertNotAttested
+	}
+	ev := &SimpleClientEvidence{Cert: resp.TLS.PeerCertificates[0].Raw, Client: client}
+	certHash = sha256.Sum256(ev.Cert)
+	ev.Report, err = hex.DecodeString(reportHex)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range []struct {
+		endpoint string
+		out      *[]byte
+	}{{"/pubkey", &ev.PubKey}, {"/extradata", &ev.ExtraReportData}} {
+		resp, err = client.Get(base + item.endpoint)
+		if err != nil {
+			return nil, err
+		}
+		res, err := readSimpleResponse(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", item.endpoint, err)
+		}
+		*item.out, err = hex.DecodeString(res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ev, nil
+}
+
+// CheckReportData checks that the data of a verified report endorses the evidence
+func (ev *SimpleClientEvidence) CheckReportData(report *attestation.Report) error {
+	reportData := SimpleReportData(ev.Cert, ev.PubKey, ev.ExtraReportData)
+	if len(report.Data) < 64 || !bytes.Equal(report.Data[:32], reportData[:32]) {
+		return ErrCertNotAttested
+	}
+	if !bytes.Equal(report.Data[32:64], reportData[32:]) {
+		return ErrReportDataMismatch
+	}
+	return nil
+}
+
+// AttestedSimpleClient is a SimpleClient whose report is verified by VerifySimpleClient
+type AttestedSimpleClient struct {
+	SimpleClientEvidence
+	VerifiedReport attestation.Report
+}
+
+// VerifySimpleClient gets the evidence of a SimpleClient serving rawUrl, and checks that its report
+// endorses the TLS certificate, the pubkey and the extra data, and that the enclave is not in debug
+// mode and has signerID and uniqueID. One of them can be empty, which is not checked then.
+func VerifySimpleClient(rawUrl string, signerID, uniqueID []byte) (*AttestedSimpleClient, error) {
+	if len(signerID) == 0 && len(uniqueID) == 0 {
+		return nil, ErrNoIdentity
+	}
+	ev, err := GetSimpleClientEvidence(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	report, err := DefaultVerifier.VerifyRemoteReport(ev.Report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify report: %w", err)
+	}
+	err = ev.CheckReportData(&report)
+	if err != nil {
+		return nil, err
+	}
+	err = checkIdentity(&report, signerID, uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	return &AttestedSimpleClient{SimpleClientEvidence: *ev, VerifiedReport: report}, nil
+}
+
+// read the result of a SimpleResponse, or its error
+func readSimpleResponse(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var res SimpleResponse
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return "", fmt.Errorf("invalid response, http status:%s, content:%s", resp.Status, string(body))
+	}
+	if !res.Success {
+		return "", errors.New(res.Error)
+	}
+	return res.Result, nil
 }
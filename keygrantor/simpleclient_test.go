@@ -0,0 +1,155 @@
+package keygrantor
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	secp256k1 "github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSimpleClient(t *testing.T, attester Attester) *SimpleClient {
+	key := newTestMasterKey(t, "simple client")
+	sc := &SimpleClient{ExtPrivKey: key, ExtPubKey: key.PublicKey(), Attester: attester}
+	sc.PrivKey = secp256k1.PrivKeyFromBytes(key.Key)
+	sc.PubKeyBz = sc.PrivKey.PubKey().SerializeCompressed()
+	sc.ExtraReportData = []byte("config hash")
+	return sc
+}
+
+func TestSimpleClient(t *testing.T) {
+	verifier := useMockAttestation(t, "verifier enclave")
+	mock := NewMockAttestation(verifier.signKey, newTestReport("simple client"))
+	sc := newTestSimpleClient(t, mock)
+	httpServer, err := sc.NewServer("simpleclient", "", map[string]func(w http.ResponseWriter, r *http.Request){
+		"/hello": func(w http.ResponseWriter, r *http.Request) { WriteSimpleResult(w, "hello") },
+		"/redirect": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/denied", http.StatusFound)
+		},
+	})
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(httpServer.Handler)
+	server.TLS = httpServer.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	attested, err := VerifySimpleClient(server.URL, []byte("signer"), []byte("simple client"))
+	require.NoError(t, err)
+	require.Equal(t, sc.PubKeyBz, attested.PubKey)
+	require.Equal(t, sc.ExtraReportData, attested.ExtraReportData)
+	require.Equal(t, sc.Cert(), attested.Cert)
+	require.Equal(t, []byte("simple client"), attested.VerifiedReport.UniqueID)
+	resp, err := attested.Client.Get(server.URL + "/hello")
+	require.NoError(t, err)
+	result, err := readSimpleResponse(resp)
+	require.NoError(t, err)
+	require.Equal(t, "hello", result)
+
+	_, err = VerifySimpleClient(server.URL, []byte("signer"), []byte("another enclave"))
+	require.ErrorIs(t, err, ErrUniqueIDMismatch)
+	_, err = VerifySimpleClient(server.URL, []byte("another signer"), nil)
+	require.ErrorIs(t, err, ErrSignerIDMismatch)
+
+	// the urls and the connections of the evidence can be restricted
+	errDenied := errors.New("denied")
+	_, err = GetSimpleClientEvidenceWithPolicy(server.URL, func(*url.URL) error { return errDenied }, nil)
+	require.ErrorIs(t, err, errDenied)
+	_, err = GetSimpleClientEvidenceWithPolicy(server.URL, nil, func(context.Context, string, string) (net.Conn, error) {
+		return nil, errDenied
+	})
+	require.ErrorIs(t, err, errDenied)
+	ev, err := GetSimpleClientEvidenceWithPolicy(server.URL, func(u *url.URL) error {
+		if u.Path == "/denied" {
+			return errDenied
+		}
+		return nil
+	}, nil)
+	require.NoError(t, err)
+	_, err = ev.Client.Get(server.URL + "/redirect")
+	require.ErrorIs(t, err, errDenied)
+
+	// a man in the middle with another certificate
+	_, otherTLS, err := NewSelfSignedTLSConfig("simpleclient")
+	require.NoError(t, err)
+	mitm := httptest.NewUnstartedServer(httpServer.Handler)
+	mitm.TLS = otherTLS
+	mitm.StartTLS()
+	defer mitm.Close()
+	_, err = VerifySimpleClient(mitm.URL, []byte("signer"), nil)
+	require.ErrorIs(t, err, ErrCertNotAttested)
+
+	// the extra data which is not attested
+	sc.ExtraReportData = []byte("another config hash")
+	_, err = VerifySimpleClient(server.URL, []byte("signer"), nil)
+	require.ErrorIs(t, err, ErrReportDataMismatch)
+	sc.ExtraReportData = []byte("config hash")
+
+	// an identity is required, and a debug enclave is never trusted
+	_, err = VerifySimpleClient(server.URL, nil, nil)
+	require.ErrorIs(t, err, ErrNoIdentity)
+	report := newTestReport("simple client")
+	report.Debug = true
+	debugServer, err := newTestSimpleClient(t, NewMockAttestation(verifier.signKey, report)).NewServer("simpleclient", "", nil)
+	require.NoError(t, err)
+	server = httptest.NewUnstartedServer(debugServer.Handler)
+	server.TLS = debugServer.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	_, err = VerifySimpleClient(server.URL, []byte("signer"), nil)
+	require.ErrorIs(t, err, ErrInDebugMode)
+}
+
+func TestSimpleClientInitKeys(t *testing.T) {
+	mock := useMockAttestation(t, "simple client")
+	server, _ := newTestServer(t, mock, "epoch 0")
+	clientData := sha256.Sum256([]byte("client data"))
+
+	sc := &SimpleClient{}
+	sc.InitKeys(NewKeyGrantorClient(server.URL, []byte("signer"), nil), clientData)
+	hash := sha256.Sum256(append([]byte("simple client"), clientData[:]...))
+	require.Equal(t, DeriveKey(newTestMasterKey(t, "epoch 0"), hash).B58Serialize(), sc.ExtPrivKey.B58Serialize())
+	require.Equal(t, sc.PrivKey.PubKey().SerializeCompressed(), sc.PubKeyBz)
+
+	// keygrantor's identity is required and checked
+	require.PanicsWithValue(t, ErrNoIdentity, func() {
+		sc.InitKeys(NewKeyGrantorClient(server.URL, nil, nil), clientData)
+	})
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			require.ErrorIs(t, err, ErrSignerIDMismatch)
+		}()
+		sc.InitKeys(NewKeyGrantorClient(server.URL, []byte("other signer"), nil), clientData)
+	}()
+}
+
+func TestSimpleClientShutdown(t *testing.T) {
+	mock := useMockAttestation(t, "simple client")
+	sc := newTestSimpleClient(t, mock)
+	httpServer, err := sc.NewServer("simpleclient", "127.0.0.1:0", nil)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- httpServer.ServeTLS(ln, "", "") }()
+
+	attested, err := VerifySimpleClient("https://"+ln.Addr().String(), []byte("signer"), nil)
+	require.NoError(t, err)
+	resp, err := attested.Client.Get("https://" + ln.Addr().String() + "/cert")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.NoError(t, sc.Shutdown(context.Background()))
+	require.ErrorIs(t, <-served, http.ErrServerClosed)
+	_, err = VerifySimpleClient("https://"+ln.Addr().String(), []byte("signer"), nil)
+	require.Error(t, err)
+}
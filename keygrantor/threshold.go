@@ -0,0 +1,331 @@
+package keygrantor
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/tyler-smith/go-bip32"
+)
+
+// In the threshold mode, no keygrantor has the master key. Its private key is split with Shamir's
+// scheme across N keygrantors, any t of which can serve a derived key. DeriveKey only uses
+// non-hardened derivation, where a child private key is its parent's plus a scalar computed from
+// public data. So each keygrantor adds the same public offset to its share, and only the client
+// enclave, which combines t derived shares, gets the derived private key. It is identical to the
+// one DeriveKey gives with the master key.
+
+var (
+	ErrDerivedKeyMismatch = errors.New("combined key does not match the public derivation")
+	ErrXpubMismatch       = errors.New("share is not from the expected master key")
+	ErrThresholdMismatch  = errors.New("share does not have the expected threshold")
+)
+
+// MasterKeyShare is the share of the master key held by a keygrantor in the threshold mode
+type MasterKeyShare struct {
+	Threshold int    `json:"threshold"`
+	Total     int    `json:"total"`
+	Index     uint32 `json:"index"`
+	Share     string `json:"share"` // in hex
+	Xpub      string `json:"xpub"`  // the master's extended public key
+}
+
+// DerivedKeyShare is the share of a derived key, returned by '/getkeyshare'
+type DerivedKeyShare struct {
+	Threshold int    `json:"threshold"`
+	Index     uint32 `json:"index"`
+	Share     string `json:"share"` // in hex
+	Xpub      string `json:"xpub"`
+}
+
+// SplitMasterKey splits the master key into 'total' shares, any 'threshold' of which can
+// serve the derived keys
+func SplitMasterKey(master *bip32.Key, threshold, total int, rand io.Reader) ([]*MasterKeyShare, error) {
+	if !master.IsPrivate {
+		return nil, errors.New("not a private key")
+	}
+	secretShares, err := SplitSecret(master.Key, threshold, total, rand)
+	if err != nil {
+		return nil, err
+	}
+	xpub := master.PublicKey().B58Serialize()
+	shares := make([]*MasterKeyShare, total)
+	for i, s := range secretShares {
+		shares[i] = &MasterKeyShare{
+			Threshold: threshold,
+			Total:     total,
+			Index:     s.Index,
+			Share:     hex.EncodeToString(s.Value),
+			Xpub:      xpub,
+		}
+	}
+	return shares, nil
+}
+
+// derivationPath returns the child indexes used by DeriveKey, given no retry happens
+func derivationPath(hash [32]byte) (path [9]uint32) {
+	n := new(big.Int).SetBytes(hash[:])
+	for i := range path {
+		path[i] = uint32(n.Uint64() & (1<<31 - 1))
+		n.Rsh(n, 31)
+	}
+	return
+}
+
+// derivePublic walks the path of DeriveKey from the xpub, and returns the derived public key and
+// the sum of the scalars added to the private key along the path
+func derivePublic(xpub *bip32.Key, hash [32]byte) (*bip32.Key, *big.Int, error) {
+	key := xpub
+	offset := new(big.Int)
+	for _, idx := range derivationPath(hash) {
+		var idxBz [4]byte
+		binary.BigEndian.PutUint32(idxBz[:], idx)
+		mac := hmac.New(sha512.New, key.ChainCode)
+		mac.Write(key.Key)
+		mac.Write(idxBz[:])
+		offset.Add(offset, new(big.Int).SetBytes(mac.Sum(nil)[:32]))
+		offset.Mod(offset, groupOrder())
+		var err error
+		key, err = key.NewChildKey(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, offset, nil
+}
+
+// DeriveShare gives this keygrantor's share of DeriveKey(master, hash)
+func (s *MasterKeyShare) DeriveShare(hash [32]byte) (*DerivedKeyShare, error) {
+	xpub, err := bip32.B58Deserialize(s.Xpub)
+	if err != nil {
+		return nil, err
+	}
+	_, offset, err := derivePublic(xpub, hash)
+	if err != nil {
+		return nil, err
+	}
+	shareBz, err := hex.DecodeString(s.Share)
+	if err != nil {
+		return nil, err
+	}
+	share := new(big.Int).SetBytes(shareBz)
+	share.Add(share, offset)
+	share.Mod(share, groupOrder())
+	return &DerivedKeyShare{
+		Threshold: s.Threshold,
+		Index:     s.Index,
+		Share:     hex.EncodeToString(scalarBytes(share)),
+		Xpub:      s.Xpub,
+	}, nil
+}
+
+// CombineDerivedKeyShares recovers DeriveKey(master, hash) from the shares of the master whose xpub
+// and threshold are expected, and checks it against the public derivation from the xpub, which
+// catches wrong or too few shares
+func CombineDerivedKeyShares(xpub *bip32.Key, threshold int, hash [32]byte, shares []*DerivedKeyShare) (*bip32.Key, error) {
+	if threshold < 1 || len(shares) < threshold {
+		return nil, ErrNotEnoughShares
+	}
+	xpub = xpub.PublicKey()
+	expectedXpub := xpub.B58Serialize()
+	secretShares := make([]SecretShare, len(shares))
+	for i, s := range shares {
+		if s.Xpub != expectedXpub {
+			return nil, ErrXpubMismatch
+		}
+		if s.Threshold != threshold {
+			return nil, ErrThresholdMismatch
+		}
+		value, err := hex.DecodeString(s.Share)
+		if err != nil || len(value) != 32 {
+			return nil, errors.New("share must be 32 bytes in hex")
+		}
+		secretShares[i] = SecretShare{Index: s.Index, Value: value}
+	}
+	privKey, err := CombineShares(secretShares)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, _, err := derivePublic(xpub, hash)
+	if err != nil {
+		return nil, err
+	}
+	key := &bip32.Key{
+		Version:     bip32.PrivateWalletVersion,
+		Depth:       pubKey.Depth,
+		ChildNumber: pubKey.ChildNumber,
+		FingerPrint: pubKey.FingerPrint,
+		ChainCode:   pubKey.ChainCode,
+		Key:         privKey,
+		IsPrivate:   true,
+	}
+	if !IsValidPrivateKey(privKey) || string(key.PublicKey().Key) != string(pubKey.Key) {
+		return nil, ErrDerivedKeyMismatch
+	}
+	return key, nil
+}
+
+// ThresholdClient gets keys from the keygrantors in the threshold mode. The xpub of their master
+// key and the threshold are pinned, instead of taken from the shares. Each keygrantor is attested
+// before its share is used: its '/report' must endorse the xpub and have the expected identity.
+type ThresholdClient struct {
+	Urls      []string
+	Xpub      *bip32.Key
+	Threshold int
+	SignerID  []byte // the expected SignerID of the keygrantors, not checked if empty
+	UniqueID  []byte // the expected UniqueID of the keygrantors, not checked if empty
+
+	lock     sync.Mutex
+	attested map[string]bool
+}
+
+func NewThresholdClient(keyGrantorUrls []string, xpub *bip32.Key, threshold int, signerID, uniqueID []byte) *ThresholdClient {
+	return &ThresholdClient{
+		Urls:      keyGrantorUrls,
+		Xpub:      xpub.PublicKey(),
+		Threshold: threshold,
+		SignerID:  signerID,
+		UniqueID:  uniqueID,
+		attested:  make(map[string]bool),
+	}
+}
+
+// attest a keygrantor once, by its report on the pinned xpub and its identity
+func (c *ThresholdClient) attest(keyGrantorUrl string) error {
+	c.lock.Lock()
+	attested := c.attested[keyGrantorUrl]
+	c.lock.Unlock()
+	if attested {
+		return nil
+	}
+	_, err := getXpubReport(keyGrantorUrl, c.Xpub.B58Serialize(), LatestEpoch, c.checkIdentity)
+	if err != nil {
+		return fmt.Errorf("failed to attest xpub: %w", err)
+	}
+	c.lock.Lock()
+	c.attested[keyGrantorUrl] = true
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *ThresholdClient) checkIdentity(report *attestation.Report) error {
+	return checkIdentity(report, c.SignerID, c.UniqueID)
+}
+
+// GetKey gets derived key shares from the keygrantors and combines them. Unreachable keygrantors,
+// and those failing the attestation or giving unexpected shares, are skipped as long as enough
+// shares are got. There is only one epoch in the threshold mode, so opts.Epoch is ignored.
+func (c *ThresholdClient) GetKey(clientData []byte, opts KeyOptions) (*bip32.Key, error) {
+	selfReport, err := DefaultAttester.SelfReport()
+	if err != nil {
+		return nil, err
+	}
+	// the same hash which '/getkeyshare' derives with, where clientData is padded in the report data
+	selfReport.Data = make([]byte, 64)
+	copy(selfReport.Data[32:], clientData)
+	hash, err := DerivationHash(&selfReport, opts.Mode, opts.MinSVN)
+	if err != nil {
+		return nil, err
+	}
+	params := GetKeyParams{Mode: opts.Mode, MinSVN: opts.MinSVN}
+	expectedXpub := c.Xpub.B58Serialize()
+	var shares []*DerivedKeyShare
+	var lastErr error
+	for _, url := range c.Urls {
+		if err = c.attest(url); err != nil {
+			lastErr = err
+			continue
+		}
+		bz, _, err := postWithAttestation(url+"/getkeyshare", "", clientData, params, c.checkIdentity)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var share DerivedKeyShare
+		err = json.Unmarshal(bz, &share)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if share.Xpub != expectedXpub {
+			lastErr = ErrXpubMismatch
+			continue
+		}
+		if share.Threshold != c.Threshold {
+			lastErr = ErrThresholdMismatch
+			continue
+		}
+		shares = append(shares, &share)
+		if len(shares) == c.Threshold {
+			return CombineDerivedKeyShares(c.Xpub, c.Threshold, hash, shares)
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotEnoughShares, lastErr.Error())
+	}
+	return nil, ErrNotEnoughShares
+}
+
+// GetShareFromDealer gets the master key share of an index from the dealer's '/xshare', which must
+// be the same enclave as this one
+func GetShareFromDealer(dealerUrl string, index uint32) (*MasterKeyShare, error) {
+	check, err := samePeerCheck()
+	if err != nil {
+		return nil, err
+	}
+	bz, _, err := postWithAttestation(dealerUrl+"/xshare", "index="+strconv.FormatUint(uint64(index), 10), nil, GetKeyParams{}, check)
+	if err != nil {
+		return nil, err
+	}
+	var share MasterKeyShare
+	err = json.Unmarshal(bz, &share)
+	if err != nil {
+		return nil, err
+	}
+	if share.Index != index {
+		return nil, errors.New("dealer returned a share of another index")
+	}
+	return &share, nil
+}
+
+// Encrypt the master key share with a key derived from a measurement of the enclave, which is
+// chosen by SealMode, and then save it to file
+func SealShareToFile(fname string, share *MasterKeyShare) error {
+	bz, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	out, err := Seal(bz)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fname, out, 0600)
+}
+
+// Read the encrypted master key share from file and decrypt it
+func RecoverShareFromFile(fname string) (share *MasterKeyShare, fileExists bool, err error) {
+	fileData, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	rawData, err := Unseal(fileData)
+	if err != nil {
+		return nil, true, err
+	}
+	share = &MasterKeyShare{}
+	err = json.Unmarshal(rawData, share)
+	return share, true, err
+}
@@ -0,0 +1,81 @@
+package keygrantor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitAndCombineSecret(t *testing.T) {
+	secret := sha256.Sum256([]byte("secret"))
+	shares, err := SplitSecret(secret[:], 3, 5, rand.Reader)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	recovered, err := CombineShares([]SecretShare{shares[4], shares[0], shares[2]})
+	require.NoError(t, err)
+	require.Equal(t, secret[:], recovered)
+	recovered, err = CombineShares(shares)
+	require.NoError(t, err)
+	require.Equal(t, secret[:], recovered)
+	recovered, err = CombineShares(shares[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret[:], recovered)
+
+	_, err = CombineShares([]SecretShare{shares[0], shares[0], shares[1]})
+	require.ErrorIs(t, err, ErrDuplicateShare)
+	_, err = SplitSecret(secret[:], 6, 5, rand.Reader)
+	require.ErrorIs(t, err, ErrInvalidThreshold)
+}
+
+func TestThresholdDeriveKey(t *testing.T) {
+	master := newTestMasterKey(t, "threshold")
+	shares, err := SplitMasterKey(master, 2, 3, rand.Reader)
+	require.NoError(t, err)
+
+	hash := sha256.Sum256([]byte("unique id and client data"))
+	expected := DeriveKey(master, hash)
+	derived := make([]*DerivedKeyShare, len(shares))
+	for i, s := range shares {
+		derived[i], err = s.DeriveShare(hash)
+		require.NoError(t, err)
+	}
+
+	key, err := CombineDerivedKeyShares(master, 2, hash, []*DerivedKeyShare{derived[2], derived[0]})
+	require.NoError(t, err)
+	require.Equal(t, expected.B58Serialize(), key.B58Serialize())
+	key, err = CombineDerivedKeyShares(master, 2, hash, derived)
+	require.NoError(t, err)
+	require.Equal(t, expected.B58Serialize(), key.B58Serialize())
+
+	_, err = CombineDerivedKeyShares(master, 2, hash, derived[:1])
+	require.ErrorIs(t, err, ErrNotEnoughShares)
+
+	// a share of another hash is caught by the public derivation
+	otherHash := sha256.Sum256([]byte("other"))
+	other, err := shares[1].DeriveShare(otherHash)
+	require.NoError(t, err)
+	_, err = CombineDerivedKeyShares(master, 2, hash, []*DerivedKeyShare{derived[0], other})
+	require.ErrorIs(t, err, ErrDerivedKeyMismatch)
+
+	// shares of another master key cannot be mixed in
+	otherShares, err := SplitMasterKey(newTestMasterKey(t, "other"), 2, 3, rand.Reader)
+	require.NoError(t, err)
+	other, err = otherShares[1].DeriveShare(hash)
+	require.NoError(t, err)
+	_, err = CombineDerivedKeyShares(master, 2, hash, []*DerivedKeyShare{derived[0], other})
+	require.ErrorIs(t, err, ErrXpubMismatch)
+	// nor can the shares of a master other than the pinned one, even if they agree
+	_, err = CombineDerivedKeyShares(newTestMasterKey(t, "other"), 2, hash, derived[:2])
+	require.ErrorIs(t, err, ErrXpubMismatch)
+
+	// the threshold reported by the shares is not trusted
+	_, err = CombineDerivedKeyShares(master, 3, hash, derived[:2])
+	require.ErrorIs(t, err, ErrNotEnoughShares)
+	lying := *derived[0]
+	lying.Threshold = 1
+	_, err = CombineDerivedKeyShares(master, 2, hash, []*DerivedKeyShare{&lying, derived[1]})
+	require.ErrorIs(t, err, ErrThresholdMismatch)
+}
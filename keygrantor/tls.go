@@ -0,0 +1,160 @@
+package keygrantor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+)
+
+var (
+	ErrCertNotAttested = errors.New("TLS certificate is not attested by the keygrantor's report")
+	ErrPlainHTTP       = errors.New("keygrantor must be reached over https")
+)
+
+// AllowPlainHTTP lets the clients reach keygrantor over plain http without any attestation of
+// the connection, only for dev and test
+var AllowPlainHTTP = false
+
+// ReportCheck checks the identity of a keygrantor in its report, e.g. its SignerID, before its TLS
+// certificate is trusted
+type ReportCheck func(report *attestation.Report) error
+
+// an https client pinned to the certificate attested by report
+type pinnedClient struct {
+	client *http.Client
+	report *attestation.Report
+}
+
+var (
+	pinnedClientsLock sync.Mutex
+	pinnedClients     = make(map[string]*pinnedClient) // by scheme://host
+)
+
+// NewSelfSignedTLSConfig creates a self-signed certificate and returns its DER together with a TLS
+// config serving it. The hash of the DER should be attested by '/report'.
+func NewSelfSignedTLSConfig(serverName string) ([]byte, *tls.Config, error) {
+	cert, _, tlsCfg, err := createCertificate(serverName)
+	return cert, tlsCfg, err
+}
+
+// The report data of '/report', which endorses the xpub and, over TLS, the certificate
+func xpubReportData(xpub string, cert []byte) []byte {
+	xpubHash := sha256.Sum256([]byte(xpub))
+	if len(cert) == 0 {
+		return xpubHash[:]
+	}
+	certHash := sha256.Sum256(cert)
+	return append(xpubHash[:], certHash[:]...)
+}
+
+// keyGrantorClient returns an http client for the keygrantor serving rawUrl. Over https, the
+// certificate is self-signed, so it is only trusted after keygrantor's '/report' attests it and
+// passes check, if not nil, and then the client only connects to the servers presenting the same
+// certificate. The client is cached until a server at the same origin presents another certificate.
+func keyGrantorClient(rawUrl string, check ReportCheck) (*http.Client, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		if !AllowPlainHTTP {
+			return nil, ErrPlainHTTP
+		}
+		return &http.Client{Timeout: 3 * time.Second}, nil
+	}
+	origin := u.Scheme + "://" + u.Host
+	pinnedClientsLock.Lock()
+	pinned := pinnedClients[origin]
+	pinnedClientsLock.Unlock()
+	if pinned == nil {
+		pinned, err = newPinnedClient(origin)
+		if err != nil {
+			return nil, err
+		}
+		pinnedClientsLock.Lock()
+		pinnedClients[origin] = pinned
+		pinnedClientsLock.Unlock()
+	}
+	if check != nil {
+		if err = check(pinned.report); err != nil {
+			return nil, err
+		}
+	}
+	return pinned.client, nil
+}
+
+// attest the certificate of the keygrantor at origin by its '/report'
+func newPinnedClient(origin string) (*pinnedClient, error) {
+	var certHash [32]byte
+	client := pinnedTLSClient(&certHash, func() {
+		pinnedClientsLock.Lock()
+		delete(pinnedClients, origin)
+		pinnedClientsLock.Unlock()
+	})
+	resp, err := client.Get(origin + "/report")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get report, http status:%s, content:%s", resp.Status, string(body))
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, ErrCertNotAttested
+	}
+	reportBz, err := hex.DecodeString(string(body))
+	if err != nil {
+		return nil, err
+	}
+	report, err := DefaultVerifier.VerifyRemoteReport(reportBz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify keygrantor's report: %w", err)
+	}
+	peerCertHash := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+	if len(report.Data) < 64 || !bytes.Equal(report.Data[32:64], peerCertHash[:]) {
+		return nil, ErrCertNotAttested
+	}
+	certHash = peerCertHash // the connection to get '/report' can be reused, since it has this certificate
+	return &pinnedClient{client: client, report: &report}, nil
+}
+
+// pinnedTLSClient returns an https client which accepts any certificate while *certHash is all
+// zero, e.g. to get the report attesting the certificate, and only the certificate of *certHash
+// after it is set. onMismatch, if not nil, is called when another certificate is presented, e.g. to
+// attest it again after the server restarts with a new certificate.
+func pinnedTLSClient(certHash *[32]byte, onMismatch func()) *http.Client {
+	return &http.Client{
+		Timeout: 3 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true, // checked by VerifyConnection instead
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					if *certHash == ([32]byte{}) { // the first connection gets '/report'
+						return nil
+					}
+					if len(cs.PeerCertificates) == 0 || sha256.Sum256(cs.PeerCertificates[0].Raw) != *certHash {
+						if onMismatch != nil {
+							onMismatch()
+						}
+						return ErrCertNotAttested
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,82 @@
+package keygrantor
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// most tests serve keygrantor over plain http
+func TestMain(m *testing.M) {
+	AllowPlainHTTP = true
+	os.Exit(m.Run())
+}
+
+// start a keygrantor over TLS, whose '/report' attests attestedCert
+func newTestTLSServer(t *testing.T, verifier *MockAttestation, attestedCert []byte) *httptest.Server {
+	kr, err := NewKeyRing(filepath.Join(t.TempDir(), "keyring.txt"), nil, nil)
+	require.NoError(t, err)
+	_, err = kr.Append(newTestMasterKey(t, "epoch 0"))
+	require.NoError(t, err)
+	cert, tlsCfg, err := NewSelfSignedTLSConfig("keygrantor")
+	require.NoError(t, err)
+	if attestedCert == nil {
+		attestedCert = cert
+	}
+	mux := http.NewServeMux()
+	s := &Server{Keys: kr, Attester: verifier, Verifier: verifier, TLSCert: attestedCert}
+	require.NoError(t, s.RegisterHandlers(mux))
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = tlsCfg
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestKeyGrantorTLS(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	server := newTestTLSServer(t, mock, nil)
+	clientData := sha256.Sum256([]byte("client data"))
+	key, err := GetKeyFromKeyGrantor(server.URL, clientData[:])
+	require.NoError(t, err)
+	hash := sha256.Sum256(append([]byte("client enclave"), clientData[:]...))
+	require.Equal(t, DeriveKey(newTestMasterKey(t, "epoch 0"), hash).B58Serialize(), key.B58Serialize())
+	xpub, err := GetXpubFromKeyGrantor(server.URL)
+	require.NoError(t, err)
+	require.Equal(t, newTestMasterKey(t, "epoch 0").PublicKey().B58Serialize(), xpub.B58Serialize())
+
+	// the identity of keygrantor is checked before its certificate is trusted, even if it is cached
+	_, _, err = NewKeyGrantorClient(server.URL, []byte("other signer"), nil).GetKey(clientData[:], KeyOptions{Epoch: LatestEpoch})
+	require.ErrorIs(t, err, ErrSignerIDMismatch)
+	key, _, err = NewKeyGrantorClient(server.URL, []byte("signer"), nil).GetKey(clientData[:], KeyOptions{Epoch: LatestEpoch})
+	require.NoError(t, err)
+	require.Equal(t, DeriveKey(newTestMasterKey(t, "epoch 0"), hash).B58Serialize(), key.B58Serialize())
+
+	// a server whose certificate is not the attested one, e.g. the host's man in the middle
+	otherCert, _, err := NewSelfSignedTLSConfig("keygrantor")
+	require.NoError(t, err)
+	server = newTestTLSServer(t, mock, otherCert)
+	_, err = GetKeyFromKeyGrantor(server.URL, clientData[:])
+	require.ErrorIs(t, err, ErrCertNotAttested)
+
+	// a server without the certificate in its report
+	server = newTestTLSServer(t, mock, []byte{})
+	_, err = GetXpubFromKeyGrantor(server.URL)
+	require.ErrorIs(t, err, ErrCertNotAttested)
+}
+
+func TestKeyGrantorPlainHTTP(t *testing.T) {
+	mock := useMockAttestation(t, "client enclave")
+	server, _ := newTestServer(t, mock, "epoch 0")
+	AllowPlainHTTP = false
+	defer func() { AllowPlainHTTP = true }()
+	_, err := GetXpubFromKeyGrantor(server.URL)
+	require.ErrorIs(t, err, ErrPlainHTTP)
+	_, err = GetKeyFromKeyGrantor(server.URL, []byte("client data"))
+	require.ErrorIs(t, err, ErrPlainHTTP)
+}